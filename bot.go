@@ -0,0 +1,504 @@
+package bearychat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bearyinnovative/bearychat-go/openapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_BOT_USER_CACHE_TTL = 5 * time.Minute
+)
+
+// BotHandler handles a command call.
+type BotHandler func(ctx context.Context, req *BotRequest) error
+
+// BotCommand declares a command of Bot.
+type BotCommand struct {
+	// Name called with, e.g. `@bot deploy`
+	Name string
+	// Other names of the command
+	Aliases []string
+	// One line description in help
+	Description string
+	// Struct (or pointer to struct) declaring arguments, see CommandArgs.
+	// A new value is bound for each call as BotRequest.Args.
+	// If nil, the command takes free text from BotRequest.Text.
+	Args interface{}
+	// Roles allowed to call the command, e.g. UserRoleAdmin.
+	// Empty means all roles if AllowUIDs is empty as well.
+	Roles []string
+	// Users allowed to call the command regardless of roles.
+	AllowUIDs []string
+	Handler   BotHandler
+
+	args *CommandArgs
+}
+
+// BotRequest is a command call.
+type BotRequest struct {
+	// The triggering message
+	Message RTMMessage
+	Command *BotCommand
+	// Name or alias called with
+	Name string
+	// Text after the command name
+	Text string
+	// Pointer to bound arguments, nil if the command declares no Args
+	Args interface{}
+
+	bot *Bot
+}
+
+// Reply sends text referring the triggering message.
+func (r *BotRequest) Reply(text string) error {
+	return r.bot.reply(r.Message, text)
+}
+
+// Sender returns the user sent the triggering message.
+func (r *BotRequest) Sender() (*User, error) {
+	uid, _ := r.Message["uid"].(string)
+	return r.bot.user(uid)
+}
+
+// Referred returns the message the triggering message replies to, or nil
+// if it isn't a reply, e.g. for "@bot translate this". The bot needs a
+// ThreadResolver, see WithBotThreadResolver.
+func (r *BotRequest) Referred(ctx context.Context) (*openapi.Message, error) {
+	if r.bot.threads == nil {
+		return nil, errors.New("no thread resolver")
+	}
+	return r.bot.threads.Referred(ctx, r.Message)
+}
+
+// Thread returns the reply chain of the triggering message, nearest
+// first, see ThreadResolver.Thread.
+func (r *BotRequest) Thread(ctx context.Context) ([]*openapi.Message, error) {
+	if r.bot.threads == nil {
+		return nil, errors.New("no thread resolver")
+	}
+	return r.bot.threads.Thread(ctx, r.Message)
+}
+
+// Bot runs commands called by mentioning the bot in channels, or in
+// p2p messages:
+//
+//      bot, _ := NewBot(context)
+//      bot.Command(BotCommand{
+//              Name:        "deploy",
+//              Aliases:     []string{"d"},
+//              Description: "deploy a service",
+//              Args:        deployArgs{},
+//              Roles:       []string{UserRoleOwner, UserRoleAdmin},
+//              Handler: func(ctx context.Context, req *BotRequest) error {
+//                      args := req.Args.(*deployArgs)
+//                      return req.Reply("deploying " + args.Service)
+//              },
+//      })
+//
+//      context.Loop.Start()
+//      go context.Loop.Keepalive(time.NewTicker(10 * time.Second))
+//      bot.Run(ctx)
+//
+// `help` lists commands, `help <command>` shows usage of a command.
+// Unknown commands are replied with suggestions. Commands can talk with
+// the user by Ask, see BotConversation.
+type Bot struct {
+	context *RTMContext
+	router  *RTMRouter
+
+	commands []*BotCommand
+	clock    *sync.RWMutex // lock for commands
+
+	resolveUser  func(uid string) (*User, error)
+	userCacheTTL time.Duration
+	users        map[string]botCachedUser
+	ulock        *sync.Mutex // lock for users
+
+	conversations BotConversationStore
+	askTimeout    time.Duration
+	cancelWords   []string
+	resume        BotResumeHandler
+	asking        map[string]chan RTMMessage // answer channels by conversation
+	alock         *sync.Mutex                // lock for asking
+
+	threads *ThreadResolver
+}
+
+type botCachedUser struct {
+	user      *User
+	expiresAt time.Time
+}
+
+type botSetter func(*Bot) error
+
+// Use an existing router instead of creating one, the bot registers its
+// route to the router.
+func WithBotRouter(router *RTMRouter) botSetter {
+	return func(b *Bot) error {
+		if router == nil {
+			return errors.New("router should not be nil")
+		}
+		b.router = router
+		return nil
+	}
+}
+
+// Set how to get user info for role checks, defaults to RTM user api
+// of the context.
+func WithBotUserResolver(resolve func(uid string) (*User, error)) botSetter {
+	return func(b *Bot) error {
+		b.resolveUser = resolve
+		return nil
+	}
+}
+
+// Set how long resolved users are cached, defaults to 5 minutes.
+func WithBotUserCacheTTL(ttl time.Duration) botSetter {
+	return func(b *Bot) error {
+		if ttl < 0 {
+			return errors.New("user cache ttl should not be negative")
+		}
+		b.userCacheTTL = ttl
+		return nil
+	}
+}
+
+// Set resolver of referred messages for BotRequest.Referred & Thread.
+func WithBotThreadResolver(resolver *ThreadResolver) botSetter {
+	return func(b *Bot) error {
+		b.threads = resolver
+		return nil
+	}
+}
+
+func NewBot(context *RTMContext, setters ...botSetter) (*Bot, error) {
+	if context == nil {
+		return nil, errors.New("context should not be nil")
+	}
+
+	b := &Bot{
+		context: context,
+		clock:   &sync.RWMutex{},
+
+		userCacheTTL: DEFAULT_BOT_USER_CACHE_TTL,
+		users:        make(map[string]botCachedUser),
+		ulock:        &sync.Mutex{},
+
+		conversations: NewMemoryBotConversationStore(),
+		askTimeout:    DEFAULT_BOT_ASK_TIMEOUT,
+		cancelWords:   defaultBotCancelWords,
+		asking:        make(map[string]chan RTMMessage),
+		alock:         &sync.Mutex{},
+	}
+	if context.client != nil {
+		b.resolveUser = context.client.User.Info
+	}
+
+	for _, setter := range setters {
+		if err := setter(b); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.router == nil {
+		router, err := NewRTMRouter(context.Loop)
+		if err != nil {
+			return nil, err
+		}
+		b.router = router
+	}
+	b.router.Intercept(b.interceptAnswer)
+	b.router.Handle(b.resumable, b.serveResume)
+	b.router.Handle(
+		RTMPredicateAll(
+			RTMPredicateChatMessage,
+			RTMPredicateNot(RTMPredicateFromUID(context.UID())),
+			RTMPredicateMentionsUID(context.UID()),
+		),
+		b.serve,
+	)
+
+	return b, nil
+}
+
+// Router returns the router running the bot, for registering other
+// routes & middlewares.
+func (b *Bot) Router() *RTMRouter {
+	return b.router
+}
+
+// Command registers a command.
+func (b *Bot) Command(cmd BotCommand) error {
+	if cmd.Handler == nil {
+		return errors.Errorf("handler of command `%s` is required", cmd.Name)
+	}
+	if cmd.Args != nil {
+		args, err := NewCommandArgs(cmd.Args)
+		if err != nil {
+			return errors.Wrapf(err, "invalid args of command `%s`", cmd.Name)
+		}
+		cmd.args = args
+	}
+
+	b.clock.Lock()
+	defer b.clock.Unlock()
+
+	for _, name := range cmd.names() {
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			return errors.Errorf("invalid command name `%s`", name)
+		}
+		if strings.ToLower(name) == "help" || b.lookup(name) != nil {
+			return errors.Errorf("command `%s` already registered", name)
+		}
+	}
+
+	b.commands = append(b.commands, &cmd)
+	return nil
+}
+
+// Run routes messages until ctx is done or the loop failed, see
+// RTMRouter.Run. The loop should be started before.
+func (b *Bot) Run(ctx context.Context) error {
+	return b.router.Run(ctx)
+}
+
+func (b *Bot) serve(ctx context.Context, m RTMMessage) error {
+	_, content := m.ParseMentionUID(b.context.UID())
+	content = strings.TrimSpace(content)
+
+	name := content
+	if fields := strings.Fields(content); len(fields) > 0 {
+		name = fields[0]
+	}
+	text := strings.TrimSpace(content[len(name):])
+	name = strings.ToLower(name)
+
+	if name == "" || name == "help" {
+		return b.reply(m, b.help(text))
+	}
+
+	b.clock.RLock()
+	cmd := b.lookup(name)
+	var unknown string
+	if cmd == nil {
+		unknown = b.unknown(name)
+	}
+	b.clock.RUnlock()
+	if cmd == nil {
+		return b.reply(m, unknown)
+	}
+
+	allowed, err := b.allowed(cmd, m)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return b.reply(m, fmt.Sprintf("you are not allowed to run `%s`", cmd.Name))
+	}
+
+	req := &BotRequest{
+		Message: m,
+		Command: cmd,
+		Name:    name,
+		Text:    text,
+		bot:     b,
+	}
+	if cmd.args != nil {
+		req.Args = cmd.args.New()
+		if err := cmd.args.Parse(text, req.Args); err != nil {
+			return b.reply(m, fmt.Sprintf("%s\n```\n%s```", err, cmd.args.Usage(cmd.Name)))
+		}
+	}
+
+	return cmd.Handler(ctx, req)
+}
+
+func (b *Bot) reply(m RTMMessage, text string) error {
+	return b.context.Loop.Send(m.Refer(text))
+}
+
+// Lookup command by name or alias, requires clock held.
+func (b *Bot) lookup(name string) *BotCommand {
+	for _, cmd := range b.commands {
+		for _, n := range cmd.names() {
+			if strings.ToLower(n) == strings.ToLower(name) {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Bot) allowed(cmd *BotCommand, m RTMMessage) (bool, error) {
+	if len(cmd.Roles) == 0 && len(cmd.AllowUIDs) == 0 {
+		return true, nil
+	}
+
+	uid, _ := m["uid"].(string)
+	if containsString(cmd.AllowUIDs, uid) {
+		return true, nil
+	}
+	if len(cmd.Roles) == 0 {
+		return false, nil
+	}
+
+	user, err := b.user(uid)
+	if err != nil {
+		return false, errors.Wrapf(err, "resolve user %s failed", uid)
+	}
+	return containsString(cmd.Roles, user.Role), nil
+}
+
+func (b *Bot) user(uid string) (*User, error) {
+	b.ulock.Lock()
+	cached, present := b.users[uid]
+	b.ulock.Unlock()
+	if present && time.Now().Before(cached.expiresAt) {
+		return cached.user, nil
+	}
+
+	if b.resolveUser == nil {
+		return nil, errors.New("no user resolver")
+	}
+	user, err := b.resolveUser(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	b.ulock.Lock()
+	b.users[uid] = botCachedUser{
+		user:      user,
+		expiresAt: time.Now().Add(b.userCacheTTL),
+	}
+	b.ulock.Unlock()
+
+	return user, nil
+}
+
+// Render commands list, or usage of the named command.
+func (b *Bot) help(name string) string {
+	b.clock.RLock()
+	defer b.clock.RUnlock()
+
+	if name != "" {
+		cmd := b.lookup(name)
+		if cmd == nil {
+			return b.unknown(name)
+		}
+
+		var buf bytes.Buffer
+		if cmd.Description != "" {
+			buf.WriteString(cmd.Description + "\n")
+		}
+		if len(cmd.Aliases) > 0 {
+			buf.WriteString("Aliases: " + strings.Join(cmd.Aliases, ", ") + "\n")
+		}
+		buf.WriteString("```\n")
+		if cmd.args != nil {
+			buf.WriteString(cmd.args.Usage(cmd.Name))
+		} else {
+			buf.WriteString("Usage: " + cmd.Name + " [text]\n")
+		}
+		buf.WriteString("```")
+		return buf.String()
+	}
+
+	commands := make([]*BotCommand, len(b.commands))
+	copy(commands, b.commands)
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString("Commands:\n")
+	for _, cmd := range commands {
+		buf.WriteString("- `" + cmd.Name + "`")
+		if len(cmd.Aliases) > 0 {
+			buf.WriteString(" (" + strings.Join(cmd.Aliases, ", ") + ")")
+		}
+		if cmd.Description != "" {
+			buf.WriteString(": " + cmd.Description)
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("Send `help <command>` for usage.")
+	return buf.String()
+}
+
+// Render reply of unknown command, with similar names as suggestions,
+// requires clock held.
+func (b *Bot) unknown(name string) string {
+	names := []string{"help"}
+	for _, cmd := range b.commands {
+		names = append(names, cmd.names()...)
+	}
+
+	var suggestions []string
+	for _, n := range names {
+		if isSimilarCommandName(name, n) {
+			suggestions = append(suggestions, "`"+n+"`")
+		}
+	}
+
+	if len(suggestions) == 0 {
+		return fmt.Sprintf("unknown command `%s`, send `help` to list commands", name)
+	}
+	return fmt.Sprintf("unknown command `%s`, did you mean %s?", name, strings.Join(suggestions, " or "))
+}
+
+func (cmd *BotCommand) names() []string {
+	return append([]string{cmd.Name}, cmd.Aliases...)
+}
+
+// Tells if a mistyped name is close to the command name: by prefix or
+// within 2 edits.
+func isSimilarCommandName(name, command string) bool {
+	name, command = strings.ToLower(name), strings.ToLower(command)
+	if len(name) >= 2 && strings.HasPrefix(command, name) {
+		return true
+	}
+
+	threshold := 2
+	if len([]rune(command)) <= 3 {
+		threshold = 1
+	}
+	return editDistance(name, command) <= threshold
+}
+
+// Levenshtein distance of runes.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,344 @@
+package bearychat
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DEFAULT_BOT_ASK_TIMEOUT = 5 * time.Minute
+
+var (
+	// Returned by Ask if no answer in time
+	ErrBotAskTimeout = errors.New("bot ask timeout")
+	// Returned by Ask if the user answered with a cancellation word
+	ErrBotAskCanceled = errors.New("bot ask canceled")
+	// Returned by Ask if already asking the user in the vchannel
+	ErrBotAskBusy = errors.New("bot is asking the user")
+)
+
+var defaultBotCancelWords = []string{"cancel", "取消"}
+
+// BotConversation is a dialog with a user in a vchannel, its state is
+// kept in BotConversationStore between questions.
+//
+//      convo, err := bot.Ask(ctx, req.Message, "Which env?")
+//      if err != nil {
+//              return err
+//      }
+//      convo.Data["env"] = convo.AnswerText
+//
+//      if err := convo.Ask(ctx, "Which version?"); err != nil {
+//              return err
+//      }
+//      defer convo.End()
+//      return convo.Reply("deploying " + convo.AnswerText + " to " + convo.Data["env"])
+type BotConversation struct {
+	VChannelId string `json:"vchannel_id"`
+	UID        string `json:"uid"`
+	// Values collected by the dialog, saved with the conversation
+	Data map[string]string `json:"data"`
+	// The pending or last question
+	Question string `json:"question"`
+	// Waiting for the answer until ExpiresAt
+	Waiting   bool      `json:"waiting"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// The last answer
+	Answer RTMMessage `json:"answer,omitempty"`
+	// Text of the last answer, without mention of the bot
+	AnswerText string `json:"answer_text"`
+
+	bot *Bot
+}
+
+// BotConversationStore keeps conversations by vchannel & user.
+type BotConversationStore interface {
+	// Load the conversation, returns nil conversation if not found.
+	Load(vchannelId, uid string) (*BotConversation, error)
+	// Save the conversation, replaces the saved one.
+	Save(convo *BotConversation) error
+	Delete(vchannelId, uid string) error
+}
+
+// BotResumeHandler continues a conversation answered while nobody is
+// asking, e.g. the bot restarted after asked.
+type BotResumeHandler func(ctx context.Context, convo *BotConversation) error
+
+// MemoryBotConversationStore keeps conversations in memory.
+type MemoryBotConversationStore struct {
+	lock          sync.Mutex
+	conversations map[string][]byte
+}
+
+func NewMemoryBotConversationStore() *MemoryBotConversationStore {
+	return &MemoryBotConversationStore{
+		conversations: make(map[string][]byte),
+	}
+}
+
+func (s *MemoryBotConversationStore) Load(vchannelId, uid string) (*BotConversation, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf, present := s.conversations[botConversationKey(vchannelId, uid)]
+	if !present {
+		return nil, nil
+	}
+
+	convo := new(BotConversation)
+	if err := json.Unmarshal(buf, convo); err != nil {
+		return nil, errors.Wrap(err, "decode conversation failed")
+	}
+	return convo, nil
+}
+
+func (s *MemoryBotConversationStore) Save(convo *BotConversation) error {
+	// saved as JSON so later changes to conversation won't leak in
+	buf, err := json.Marshal(convo)
+	if err != nil {
+		return errors.Wrap(err, "encode conversation failed")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.conversations[botConversationKey(convo.VChannelId, convo.UID)] = buf
+	return nil
+}
+
+func (s *MemoryBotConversationStore) Delete(vchannelId, uid string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.conversations, botConversationKey(vchannelId, uid))
+	return nil
+}
+
+// Set store of conversations, defaults to MemoryBotConversationStore.
+func WithBotConversationStore(store BotConversationStore) botSetter {
+	return func(b *Bot) error {
+		if store == nil {
+			return errors.New("conversation store should not be nil")
+		}
+		b.conversations = store
+		return nil
+	}
+}
+
+// Set how long Ask waits for the answer, defaults to 5 minutes.
+func WithBotAskTimeout(timeout time.Duration) botSetter {
+	return func(b *Bot) error {
+		if timeout <= 0 {
+			return errors.New("ask timeout should be positive")
+		}
+		b.askTimeout = timeout
+		return nil
+	}
+}
+
+// Set answers canceling Ask, defaults to "cancel" and "取消".
+// Words are matched case insensitively.
+func WithBotCancelWords(words ...string) botSetter {
+	return func(b *Bot) error {
+		b.cancelWords = words
+		return nil
+	}
+}
+
+// Set handler of answers to conversations saved in store but not being
+// asked, e.g. asked before the bot restarted.
+func WithBotResumeHandler(handler BotResumeHandler) botSetter {
+	return func(b *Bot) error {
+		b.resume = handler
+		return nil
+	}
+}
+
+// Ask sends question referring m, and waits for the next message from
+// the same user in the vchannel. The conversation is continued if saved
+// before.
+//
+// Messages to the bot in the vchannel are queued until the handler
+// returns, except answers.
+func (b *Bot) Ask(ctx context.Context, m RTMMessage, question string) (*BotConversation, error) {
+	vchannelId, _ := m["vchannel_id"].(string)
+	uid, _ := m["uid"].(string)
+
+	convo, err := b.Conversation(vchannelId, uid)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.ask(ctx, convo, m, question); err != nil {
+		return nil, err
+	}
+	return convo, nil
+}
+
+// Conversation loads the conversation with the user in the vchannel,
+// or a new one if not found.
+func (b *Bot) Conversation(vchannelId, uid string) (*BotConversation, error) {
+	convo, err := b.conversations.Load(vchannelId, uid)
+	if err != nil {
+		return nil, errors.Wrap(err, "load conversation failed")
+	}
+	if convo == nil {
+		convo = &BotConversation{VChannelId: vchannelId, UID: uid}
+	}
+	if convo.Data == nil {
+		convo.Data = make(map[string]string)
+	}
+	convo.bot = b
+	return convo, nil
+}
+
+// Ask the next question referring the last answer.
+func (c *BotConversation) Ask(ctx context.Context, question string) error {
+	if c.Answer == nil {
+		return errors.New("conversation is not answered yet")
+	}
+	return c.bot.ask(ctx, c, c.Answer, question)
+}
+
+// Reply sends text referring the last answer.
+func (c *BotConversation) Reply(text string) error {
+	if c.Answer == nil {
+		return errors.New("conversation is not answered yet")
+	}
+	return c.bot.reply(c.Answer, text)
+}
+
+// Save the conversation, e.g. after Data changed.
+func (c *BotConversation) Save() error {
+	return errors.Wrap(c.bot.conversations.Save(c), "save conversation failed")
+}
+
+// End deletes the conversation from store.
+func (c *BotConversation) End() error {
+	err := c.bot.conversations.Delete(c.VChannelId, c.UID)
+	return errors.Wrap(err, "delete conversation failed")
+}
+
+func (b *Bot) ask(ctx context.Context, convo *BotConversation, m RTMMessage, question string) error {
+	key := botConversationKey(convo.VChannelId, convo.UID)
+	answerC := make(chan RTMMessage, 1)
+
+	b.alock.Lock()
+	if _, busy := b.asking[key]; busy {
+		b.alock.Unlock()
+		return ErrBotAskBusy
+	}
+	b.asking[key] = answerC
+	b.alock.Unlock()
+
+	defer func() {
+		b.alock.Lock()
+		delete(b.asking, key)
+		b.alock.Unlock()
+	}()
+
+	if err := b.reply(m, question); err != nil {
+		return err
+	}
+
+	convo.Question = question
+	convo.Waiting = true
+	convo.ExpiresAt = time.Now().Add(b.askTimeout)
+	if err := convo.Save(); err != nil {
+		return err
+	}
+
+	select {
+	case answer := <-answerC:
+		return b.answer(convo, answer)
+	case <-time.After(b.askTimeout):
+		convo.End()
+		return ErrBotAskTimeout
+	case <-ctx.Done():
+		// kept waiting in store, so answer can be resumed
+		return ctx.Err()
+	}
+}
+
+// Apply the answer to conversation.
+func (b *Bot) answer(convo *BotConversation, answer RTMMessage) error {
+	_, text := answer.ParseMentionUID(b.context.UID())
+	text = strings.TrimSpace(text)
+
+	for _, word := range b.cancelWords {
+		if strings.EqualFold(text, word) {
+			convo.End()
+			return ErrBotAskCanceled
+		}
+	}
+
+	convo.Waiting = false
+	convo.Answer = answer
+	convo.AnswerText = text
+	return convo.Save()
+}
+
+// Intercept answers of ongoing Ask.
+func (b *Bot) interceptAnswer(m RTMMessage) bool {
+	if !m.IsChatMessage() || m.IsFromUID(b.context.UID()) {
+		return false
+	}
+
+	vchannelId, _ := m["vchannel_id"].(string)
+	uid, _ := m["uid"].(string)
+
+	b.alock.Lock()
+	answerC, asking := b.asking[botConversationKey(vchannelId, uid)]
+	b.alock.Unlock()
+	if !asking {
+		return false
+	}
+
+	select {
+	case answerC <- m:
+		return true
+	default:
+		// already answered
+		return false
+	}
+}
+
+// Tells if m answers a conversation waiting in store.
+func (b *Bot) resumable(m RTMMessage) bool {
+	if b.resume == nil || !m.IsChatMessage() || m.IsFromUID(b.context.UID()) {
+		return false
+	}
+
+	vchannelId, _ := m["vchannel_id"].(string)
+	uid, _ := m["uid"].(string)
+	convo, err := b.conversations.Load(vchannelId, uid)
+	if err != nil || convo == nil {
+		return false
+	}
+	return convo.Waiting && time.Now().Before(convo.ExpiresAt)
+}
+
+func (b *Bot) serveResume(ctx context.Context, m RTMMessage) error {
+	vchannelId, _ := m["vchannel_id"].(string)
+	uid, _ := m["uid"].(string)
+
+	convo, err := b.Conversation(vchannelId, uid)
+	if err != nil {
+		return err
+	}
+	if err := b.answer(convo, m); err != nil {
+		if err == ErrBotAskCanceled {
+			return nil
+		}
+		return err
+	}
+
+	return b.resume(ctx, convo)
+}
+
+func botConversationKey(vchannelId, uid string) string {
+	return vchannelId + "/" + uid
+}
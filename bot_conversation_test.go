@@ -0,0 +1,204 @@
+package bearychat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Wait for n messages sent by loop.
+func waitTestRTMLoopSent(t *testing.T, loop *testRTMLoop, n int) []RTMMessage {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		loop.lock.Lock()
+		sent := loop.sent
+		loop.lock.Unlock()
+		if len(sent) >= n {
+			return sent
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d messages sent", n)
+	return nil
+}
+
+func runTestBot(t *testing.T, bot *Bot) (context.CancelFunc, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- bot.Run(ctx)
+	}()
+	return cancel, done
+}
+
+func TestBot_Ask(t *testing.T) {
+	bot, loop := newTestBot(t)
+	errC := make(chan error, 1)
+	err := bot.Command(BotCommand{
+		Name: "setup",
+		Handler: func(ctx context.Context, req *BotRequest) error {
+			convo, err := bot.Ask(ctx, req.Message, "Which env?")
+			if err != nil {
+				errC <- err
+				return req.Reply(err.Error())
+			}
+			convo.Data["env"] = convo.AnswerText
+
+			if err := convo.Ask(ctx, "Which version?"); err != nil {
+				errC <- err
+				return convo.Reply(err.Error())
+			}
+			defer convo.End()
+			return convo.Reply("deploying " + convo.AnswerText + " to " + convo.Data["env"])
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	cancel, done := runTestBot(t, bot)
+	defer cancel()
+
+	loop.rtmC <- testBotChannelMessage("1", "=bw52O", "@<==bot=> setup")
+	waitTestRTMLoopSent(t, loop, 1)
+
+	// queued until the handler returns
+	loop.rtmC <- testBotChannelMessage("2", "=bw52P", "@<==bot=> echo hi")
+	// from other user
+	loop.rtmC <- testBotChannelMessage("3", "=bw52P", "staging")
+	loop.rtmC <- testBotChannelMessage("4", "=bw52O", "prod")
+	waitTestRTMLoopSent(t, loop, 2)
+
+	if _, err := bot.Ask(context.Background(), testBotChannelMessage("5", "=bw52O", "hi"), "?"); err != ErrBotAskBusy {
+		t.Errorf("expected busy, got %v", err)
+	}
+
+	loop.rtmC <- testBotChannelMessage("6", "=bw52O", "@<==bot=>  v2 ")
+	sent := waitTestRTMLoopSent(t, loop, 4)
+
+	expected := []struct {
+		text  string
+		refer string
+	}{
+		{"Which env?", "1"},
+		{"Which version?", "4"},
+		{"deploying v2 to prod", "6"},
+		{"hi", "2"},
+	}
+	for i, e := range expected {
+		if sent[i].Text() != e.text || sent[i]["refer_key"] != e.refer {
+			t.Errorf("#%d: unexpected sent: %+v", i, sent[i])
+		}
+	}
+
+	convo, err := bot.conversations.Load("=bw52Q", "=bw52O")
+	if err != nil || convo != nil {
+		t.Errorf("conversation should be ended: %+v %v", convo, err)
+	}
+
+	cancel()
+	<-done
+	select {
+	case err := <-errC:
+		t.Errorf("unexpected error: %+v", err)
+	default:
+	}
+}
+
+func TestBot_Ask_CancelAndTimeout(t *testing.T) {
+	bot, loop := newTestBot(t, WithBotAskTimeout(50*time.Millisecond))
+	errC := make(chan error, 2)
+	err := bot.Command(BotCommand{
+		Name: "setup",
+		Handler: func(ctx context.Context, req *BotRequest) error {
+			_, err := bot.Ask(ctx, req.Message, "Which env?")
+			errC <- err
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	cancel, done := runTestBot(t, bot)
+	defer cancel()
+
+	loop.rtmC <- testBotChannelMessage("1", "=bw52O", "@<==bot=> setup")
+	waitTestRTMLoopSent(t, loop, 1)
+	loop.rtmC <- testBotChannelMessage("2", "=bw52O", "@<==bot=> Cancel")
+	if err := <-errC; err != ErrBotAskCanceled {
+		t.Errorf("expected canceled, got %v", err)
+	}
+
+	loop.rtmC <- testBotChannelMessage("3", "=bw52O", "@<==bot=> setup")
+	if err := <-errC; err != ErrBotAskTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	convo, err := bot.conversations.Load("=bw52Q", "=bw52O")
+	if err != nil || convo != nil {
+		t.Errorf("conversation should be ended: %+v %v", convo, err)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestBot_Ask_Resume(t *testing.T) {
+	store := NewMemoryBotConversationStore()
+	bot, loop := newTestBot(t, WithBotConversationStore(store))
+
+	// the bot stopped while asking
+	ctx, cancel := context.WithCancel(context.Background())
+	m := testBotChannelMessage("1", "=bw52O", "@<==bot=> setup")
+	go func() {
+		waitTestRTMLoopSent(t, loop, 1)
+		cancel()
+	}()
+	convo, err := bot.Conversation("=bw52Q", "=bw52O")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	convo.Data["step"] = "env"
+	if err := convo.Save(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if _, err := bot.Ask(ctx, m, "Which env?"); err != context.Canceled {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+
+	resumed := make(chan *BotConversation, 1)
+	restarted, loop := newTestBot(
+		t,
+		WithBotConversationStore(store),
+		WithBotResumeHandler(func(ctx context.Context, convo *BotConversation) error {
+			resumed <- convo
+			return convo.Reply("got " + convo.AnswerText)
+		}),
+	)
+	cancelRun, done := runTestBot(t, restarted)
+	defer cancelRun()
+
+	loop.rtmC <- testBotChannelMessage("2", "=bw52O", "prod")
+	select {
+	case convo := <-resumed:
+		if convo.Question != "Which env?" || convo.AnswerText != "prod" || convo.Data["step"] != "env" || convo.Waiting {
+			t.Errorf("unexpected conversation: %+v", convo)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("conversation should be resumed")
+	}
+
+	sent := waitTestRTMLoopSent(t, loop, 1)
+	if sent[0].Text() != "got prod" || sent[0]["refer_key"] != "2" {
+		t.Errorf("unexpected sent: %+v", sent[0])
+	}
+
+	// not waiting anymore
+	loop.rtmC <- testBotChannelMessage("3", "=bw52O", "prod")
+	cancelRun()
+	<-done
+	if len(resumed) != 0 {
+		t.Errorf("should not resume again")
+	}
+}
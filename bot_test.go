@@ -0,0 +1,211 @@
+package bearychat
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+type testBotDeployArgs struct {
+	Service string `arg:"service" required:"true" help:"service to deploy"`
+	Env     string `flag:"env" default:"staging" enum:"staging,prod"`
+}
+
+func newTestBot(t *testing.T, setters ...botSetter) (*Bot, *testRTMLoop) {
+	loop := newTestRTMLoop()
+	bot, err := NewBot(&RTMContext{Loop: loop, uid: "=bot"}, setters...)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	err = bot.Command(BotCommand{
+		Name:        "deploy",
+		Aliases:     []string{"d"},
+		Description: "deploy a service",
+		Args:        testBotDeployArgs{},
+		Roles:       []string{UserRoleOwner, UserRoleAdmin},
+		AllowUIDs:   []string{"=bw52P"},
+		Handler: func(ctx context.Context, req *BotRequest) error {
+			args := req.Args.(*testBotDeployArgs)
+			return req.Reply("deploying " + args.Service + " to " + args.Env)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	err = bot.Command(BotCommand{
+		Name:        "echo",
+		Description: "echo text",
+		Handler: func(ctx context.Context, req *BotRequest) error {
+			return req.Reply(req.Text)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	return bot, loop
+}
+
+func testBotChannelMessage(key, uid, text string) RTMMessage {
+	return RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"key":         key,
+		"uid":         uid,
+		"channel_id":  "=bw52Q",
+		"vchannel_id": "=bw52Q",
+		"text":        text,
+	}
+}
+
+func TestBot_Commands(t *testing.T) {
+	var lock sync.Mutex
+	resolved := map[string]int{}
+	bot, loop := newTestBot(t, WithBotUserResolver(func(uid string) (*User, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		resolved[uid] = resolved[uid] + 1
+		switch uid {
+		case "=admin":
+			return &User{Id: uid, Role: UserRoleAdmin}, nil
+		case "=normal":
+			return &User{Id: uid, Role: UserRoleNormal}, nil
+		}
+		return nil, errors.New("user not found")
+	}))
+
+	var errs []error
+	bot.Router().errorHandler = func(err error) {
+		errs = append(errs, err)
+	}
+
+	runTestRTMRouter(
+		t, bot.Router(), loop,
+		testBotChannelMessage("1", "=admin", "@<==bot=> deploy api --env=prod"),
+		testBotChannelMessage("2", "=admin", "@<==bot=> D web"),
+		testBotChannelMessage("3", "=normal", "@<==bot=> deploy api"),
+		testBotChannelMessage("4", "=bw52P", "@<==bot=> deploy api"),
+		testBotChannelMessage("5", "=normal", "@<==bot=> echo  hello  world "),
+		testBotChannelMessage("6", "=normal", "echo not mentioned"),
+		testBotChannelMessage("7", "=bot", "@<==bot=> echo self"),
+		testBotChannelMessage("8", "=admin", "@<==bot=> deploy --env=dev api"),
+		testBotChannelMessage("9", "=normal", "@<==bot=> deplo api"),
+		testBotChannelMessage("10", "=normal", "@<==bot=> whatever"),
+		testBotChannelMessage("11", "=unknown", "@<==bot=> deploy api"),
+		testBotChannelMessage("12", "=admin", "@<==bot=> deploy api"),
+	)
+
+	expected := []string{
+		"deploying api to prod",
+		"deploying web to staging",
+		"you are not allowed to run `deploy`",
+		"deploying api to staging",
+		"hello  world",
+		"--env should be one of: staging, prod\n```\nUsage: deploy <service> [flags]\n\nArguments:\n  service   service to deploy (required)\n\nFlags:\n  --env   one of: staging, prod, default: staging\n```",
+		"unknown command `deplo`, did you mean `deploy`?",
+		"unknown command `whatever`, send `help` to list commands",
+		"deploying api to staging",
+	}
+	expectedRefers := []string{"1", "2", "3", "4", "5", "8", "9", "10", "12"}
+	if len(loop.sent) != len(expected) {
+		t.Fatalf("unexpected sent: %+v", loop.sent)
+	}
+	for i, m := range loop.sent {
+		if m.Text() != expected[i] {
+			t.Errorf("#%d: expected %q, got %q", i, expected[i], m.Text())
+		}
+		if m["refer_key"] != expectedRefers[i] || m["channel_id"] != "=bw52Q" {
+			t.Errorf("#%d: unexpected reply: %+v", i, m)
+		}
+	}
+
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "resolve user =unknown failed") {
+		t.Errorf("unexpected errors: %+v", errs)
+	}
+	// cached, allowlist doesn't resolve
+	if resolved["=admin"] != 1 || resolved["=normal"] != 1 || resolved["=bw52P"] != 0 {
+		t.Errorf("unexpected resolved: %+v", resolved)
+	}
+}
+
+func TestBot_Help(t *testing.T) {
+	bot, loop := newTestBot(t)
+
+	p2p := newRTMP2PMessage("=bot", "=bw52O", "help")
+	p2p["uid"] = "=bw52O"
+	p2p["key"] = "1"
+
+	runTestRTMRouter(t, bot.Router(), loop, p2p)
+	runTestRTMRouter(
+		t, bot.Router(), loop,
+		testBotChannelMessage("2", "=bw52O", "@<==bot=> "),
+		testBotChannelMessage("3", "=bw52O", "@<==bot=> help d"),
+		testBotChannelMessage("4", "=bw52O", "@<==bot=> help hepl"),
+	)
+
+	list := strings.Join([]string{
+		"Commands:",
+		"- `deploy` (d): deploy a service",
+		"- `echo`: echo text",
+		"Send `help <command>` for usage.",
+	}, "\n")
+	expected := []string{
+		list,
+		list,
+		"deploy a service\nAliases: d\n```\nUsage: deploy <service> [flags]\n\nArguments:\n  service   service to deploy (required)\n\nFlags:\n  --env   one of: staging, prod, default: staging\n```",
+		"unknown command `hepl`, did you mean `help`?",
+	}
+	if len(loop.sent) != len(expected) {
+		t.Fatalf("unexpected sent: %+v", loop.sent)
+	}
+	for i, m := range loop.sent {
+		if m.Text() != expected[i] {
+			t.Errorf("#%d: expected %q, got %q", i, expected[i], m.Text())
+		}
+	}
+	if loop.sent[0]["to_uid"] != "=bw52O" || loop.sent[0]["vchannel_id"] != "=bw52O" || loop.sent[0]["refer_key"] != "1" {
+		t.Errorf("unexpected p2p reply: %+v", loop.sent[0])
+	}
+}
+
+func TestBot_Command_Invalid(t *testing.T) {
+	bot, _ := newTestBot(t)
+	handler := func(ctx context.Context, req *BotRequest) error { return nil }
+
+	invalids := []BotCommand{
+		{Name: "noop"},
+		{Name: "", Handler: handler},
+		{Name: "two words", Handler: handler},
+		{Name: "Help", Handler: handler},
+		{Name: "ship", Aliases: []string{"D"}, Handler: handler},
+		{Name: "ship", Args: 1, Handler: handler},
+	}
+	for _, cmd := range invalids {
+		if err := bot.Command(cmd); err == nil {
+			t.Errorf("%+v: expected error", cmd)
+		}
+	}
+}
+
+func TestIsSimilarCommandName(t *testing.T) {
+	cases := map[[2]string]bool{
+		{"deplyo", "deploy"}: true,
+		{"dep", "deploy"}:    true,
+		{"d", "deploy"}:      false,
+		{"stauts", "status"}: true,
+		{"ls", "ps"}:         true,
+		{"cd", "ps"}:         false,
+		{"部署", "部暑"}:         true,
+	}
+
+	for c, expected := range cases {
+		if similar := isSimilarCommandName(c[0], c[1]); similar != expected {
+			t.Errorf("%q: expected %v", c, expected)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package bearychat
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SplitCommandArgs splits text into arguments like a shell:
+//
+// - arguments are separated by whitespaces
+// - text in single quotes is kept as is
+// - text in double quotes is kept as is except `\"` and `\\`
+// - backslash escapes the next character outside quotes
+//
+//      SplitCommandArgs(`deploy api --env=prod "fix login"`)
+//      // []string{"deploy", "api", "--env=prod", "fix login"}
+func SplitCommandArgs(text string) ([]string, error) {
+	var (
+		args    []string
+		arg     bytes.Buffer
+		inArg   bool // an argument is started, may be empty quotes
+		quote   rune // current quote, 0 if not quoted
+		escaped bool
+	)
+
+	for _, c := range text {
+		switch {
+		case escaped:
+			if quote == '"' && c != '"' && c != '\\' {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case unicode.IsSpace(c):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed quote `%c`", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("unexpected `\\` at end of command")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
+// CommandArgs binds command arguments into a struct by field tags:
+//
+// - `arg:"name"`: positional argument, in field order; a slice field
+//   collects the rest arguments and should be the last one
+// - `flag:"name,n"`: flag `--name` with optional short name `-n`,
+//   bool flags don't take value; a slice flag can be repeated
+// - `default:"value"`: default value, comma separated for slices
+// - `required:"true"`: argument or flag must be given
+// - `enum:"a,b"`: allowed values
+// - `help:"text"`: description in usage
+//
+// Supported field types are string, bool, ints, uints, floats,
+// time.Duration and slices of them.
+//
+//      type deployArgs struct {
+//              Service string   `arg:"service" required:"true" help:"service to deploy"`
+//              Reason  []string `arg:"reason" help:"deploy reason"`
+//              Env     string   `flag:"env,e" default:"staging" enum:"staging,prod"`
+//              Force   bool     `flag:"force,f" help:"skip checks"`
+//      }
+//
+//      var args deployArgs
+//      err := ParseCommandArgs(`api --env=prod "fix login"`, &args)
+type CommandArgs struct {
+	typ   reflect.Type
+	args  []*commandArg
+	flags []*commandArg
+}
+
+type commandArg struct {
+	index      int
+	name       string
+	short      string
+	isFlag     bool
+	help       string
+	defaults   string
+	hasDefault bool
+	required   bool
+	enum       []string
+	typ        reflect.Type
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// NewCommandArgs builds arguments spec from a struct or a pointer to struct.
+func NewCommandArgs(v interface{}) (*CommandArgs, error) {
+	if v == nil {
+		return nil, fmt.Errorf("command args should be a struct")
+	}
+	typ := reflect.TypeOf(v)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("command args should be a struct, got %s", typ)
+	}
+
+	c := &CommandArgs{typ: typ}
+	names := map[string]bool{}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		argTag, isArg := field.Tag.Lookup("arg")
+		flagTag, isFlag := field.Tag.Lookup("flag")
+		if !isArg && !isFlag {
+			continue
+		}
+		if isArg && isFlag {
+			return nil, fmt.Errorf("field `%s` can't be both arg and flag", field.Name)
+		}
+		if field.PkgPath != "" {
+			return nil, fmt.Errorf("field `%s` should be exported", field.Name)
+		}
+		if !isCommandArgType(field.Type) {
+			return nil, fmt.Errorf("field `%s` has unsupported type %s", field.Name, field.Type)
+		}
+
+		spec := &commandArg{
+			index:    i,
+			isFlag:   isFlag,
+			help:     field.Tag.Get("help"),
+			required: field.Tag.Get("required") == "true",
+			typ:      field.Type,
+		}
+		if isArg {
+			spec.name = argTag
+		} else {
+			parts := strings.SplitN(flagTag, ",", 2)
+			spec.name = parts[0]
+			if len(parts) == 2 {
+				spec.short = parts[1]
+			}
+		}
+		if spec.name == "" {
+			spec.name = strings.ToLower(field.Name)
+		}
+		for _, name := range []string{spec.name, spec.short} {
+			if name == "" {
+				continue
+			}
+			if names[name] {
+				return nil, fmt.Errorf("duplicated argument `%s`", name)
+			}
+			names[name] = true
+		}
+		if enum := field.Tag.Get("enum"); enum != "" {
+			spec.enum = strings.Split(enum, ",")
+		}
+		spec.defaults, spec.hasDefault = field.Tag.Lookup("default")
+		if spec.hasDefault {
+			if err := spec.setDefault(reflect.New(field.Type).Elem()); err != nil {
+				return nil, fmt.Errorf("invalid default of `%s`: %s", spec.name, err)
+			}
+		}
+
+		if isFlag {
+			c.flags = append(c.flags, spec)
+			continue
+		}
+		if n := len(c.args); n > 0 && c.args[n-1].typ.Kind() == reflect.Slice {
+			return nil, fmt.Errorf("slice argument `%s` should be the last one", c.args[n-1].name)
+		}
+		c.args = append(c.args, spec)
+	}
+
+	return c, nil
+}
+
+// New returns a pointer to a new value of the spec struct, for binding.
+func (c *CommandArgs) New() interface{} {
+	return reflect.New(c.typ).Interface()
+}
+
+// ParseCommandArgs splits text and binds arguments into dst, which should
+// be a pointer to struct.
+func ParseCommandArgs(text string, dst interface{}) error {
+	c, err := NewCommandArgs(dst)
+	if err != nil {
+		return err
+	}
+	return c.Parse(text, dst)
+}
+
+// Parse splits text and binds arguments into dst.
+func (c *CommandArgs) Parse(text string, dst interface{}) error {
+	args, err := SplitCommandArgs(text)
+	if err != nil {
+		return err
+	}
+	return c.Bind(args, dst)
+}
+
+// Bind binds split arguments into dst, which should be a pointer to the
+// spec struct. Flags can be put anywhere, arguments after `--` are
+// always positional.
+func (c *CommandArgs) Bind(args []string, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Type() != c.typ {
+		return fmt.Errorf("command args should be bound to *%s", c.typ)
+	}
+	s := v.Elem()
+
+	for _, spec := range c.all() {
+		field := s.Field(spec.index)
+		field.Set(reflect.Zero(spec.typ))
+		if spec.hasDefault {
+			spec.setDefault(field)
+		}
+	}
+
+	given := map[*commandArg]bool{}
+	set := func(spec *commandArg, value string) error {
+		field := s.Field(spec.index)
+		if !given[spec] {
+			field.Set(reflect.Zero(spec.typ))
+			given[spec] = true
+		}
+		return spec.set(field, value)
+	}
+
+	var positional []string
+	flagsEnded := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if flagsEnded || !isCommandFlag(arg) {
+			positional = append(positional, arg)
+			continue
+		}
+		if arg == "--" {
+			flagsEnded = true
+			continue
+		}
+
+		name, value, hasValue := arg, "", false
+		if eq := strings.Index(arg, "="); eq >= 0 {
+			name, value, hasValue = arg[:eq], arg[eq+1:], true
+		}
+		spec := c.lookupFlag(name)
+		if spec == nil {
+			return fmt.Errorf("unknown flag `%s`", name)
+		}
+		if !hasValue {
+			if spec.typ.Kind() == reflect.Bool {
+				value = "true"
+			} else if i+1 < len(args) {
+				i = i + 1
+				value = args[i]
+			} else {
+				return fmt.Errorf("flag `%s` needs a value", name)
+			}
+		}
+		if err := set(spec, value); err != nil {
+			return err
+		}
+	}
+
+	for _, spec := range c.args {
+		if len(positional) == 0 {
+			break
+		}
+		if spec.typ.Kind() == reflect.Slice {
+			for _, value := range positional {
+				if err := set(spec, value); err != nil {
+					return err
+				}
+			}
+			positional = nil
+			break
+		}
+		if err := set(spec, positional[0]); err != nil {
+			return err
+		}
+		positional = positional[1:]
+	}
+	if len(positional) > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(positional, " "))
+	}
+
+	for _, spec := range c.all() {
+		if spec.required && !given[spec] {
+			return fmt.Errorf("%s is required", spec.display())
+		}
+	}
+
+	return nil
+}
+
+// Usage renders usage text of the command:
+//
+//      Usage: deploy <service> [reason...] [flags]
+//
+//      Arguments:
+//        service       service to deploy (required)
+//        reason        deploy reason
+//
+//      Flags:
+//        --env, -e     one of: staging, prod, default: staging
+//        --force, -f   skip checks
+func (c *CommandArgs) Usage(command string) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("Usage: " + command)
+	for _, spec := range c.args {
+		name := spec.name
+		if spec.typ.Kind() == reflect.Slice {
+			name = name + "..."
+		}
+		if spec.required {
+			buf.WriteString(" <" + name + ">")
+		} else {
+			buf.WriteString(" [" + name + "]")
+		}
+	}
+	if len(c.flags) > 0 {
+		buf.WriteString(" [flags]")
+	}
+	buf.WriteString("\n")
+
+	writeSection := func(title string, specs []*commandArg) {
+		if len(specs) == 0 {
+			return
+		}
+		names := make([]string, len(specs))
+		width := 0
+		for i, spec := range specs {
+			names[i] = spec.display()
+			if len(names[i]) > width {
+				width = len(names[i])
+			}
+		}
+
+		buf.WriteString("\n" + title + ":\n")
+		for i, spec := range specs {
+			line := fmt.Sprintf("  %-*s   %s", width, names[i], spec.describe())
+			buf.WriteString(strings.TrimRight(line, " ") + "\n")
+		}
+	}
+	writeSection("Arguments", c.args)
+	writeSection("Flags", c.flags)
+
+	return buf.String()
+}
+
+func (c *CommandArgs) all() []*commandArg {
+	specs := make([]*commandArg, 0, len(c.args)+len(c.flags))
+	specs = append(specs, c.args...)
+	return append(specs, c.flags...)
+}
+
+func (c *CommandArgs) lookupFlag(name string) *commandArg {
+	for _, spec := range c.flags {
+		if name == "--"+spec.name || spec.short != "" && name == "-"+spec.short {
+			return spec
+		}
+	}
+	return nil
+}
+
+// Tells if an argument looks like a flag, negative numbers are not flags.
+func isCommandFlag(arg string) bool {
+	if len(arg) < 2 || arg[0] != '-' {
+		return false
+	}
+	_, err := strconv.ParseFloat(arg, 64)
+	return err != nil
+}
+
+func isCommandArgType(t reflect.Type) bool {
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Bool {
+			return false
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func (spec *commandArg) display() string {
+	if !spec.isFlag {
+		return spec.name
+	}
+	if spec.short != "" {
+		return "--" + spec.name + ", -" + spec.short
+	}
+	return "--" + spec.name
+}
+
+func (spec *commandArg) describe() string {
+	var notes []string
+	if spec.required {
+		notes = append(notes, "required")
+	}
+	if len(spec.enum) > 0 {
+		notes = append(notes, "one of: "+strings.Join(spec.enum, ", "))
+	}
+	if spec.hasDefault {
+		notes = append(notes, "default: "+spec.defaults)
+	}
+
+	switch {
+	case len(notes) == 0:
+		return spec.help
+	case spec.help == "":
+		return strings.Join(notes, ", ")
+	default:
+		return spec.help + " (" + strings.Join(notes, ", ") + ")"
+	}
+}
+
+func (spec *commandArg) setDefault(field reflect.Value) error {
+	if spec.typ.Kind() != reflect.Slice {
+		return spec.set(field, spec.defaults)
+	}
+	if spec.defaults == "" {
+		return nil
+	}
+	for _, value := range strings.Split(spec.defaults, ",") {
+		if err := spec.set(field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set (or append to slice) field from value.
+func (spec *commandArg) set(field reflect.Value, value string) error {
+	if len(spec.enum) > 0 && !containsString(spec.enum, value) {
+		return fmt.Errorf(
+			"%s should be one of: %s",
+			spec.display(),
+			strings.Join(spec.enum, ", "),
+		)
+	}
+
+	if field.Kind() == reflect.Slice {
+		elem := reflect.New(field.Type().Elem()).Elem()
+		if err := spec.setValue(elem, value); err != nil {
+			return err
+		}
+		field.Set(reflect.Append(field, elem))
+		return nil
+	}
+	return spec.setValue(field, value)
+}
+
+func (spec *commandArg) setValue(field reflect.Value, value string) error {
+	var err error
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(value); err == nil {
+			field.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if field.Type() == durationType {
+			var d time.Duration
+			d, err = time.ParseDuration(value)
+			i = int64(d)
+		} else {
+			i, err = strconv.ParseInt(value, 10, field.Type().Bits())
+		}
+		if err == nil {
+			field.SetInt(i)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		if u, err = strconv.ParseUint(value, 10, field.Type().Bits()); err == nil {
+			field.SetUint(u)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(value, field.Type().Bits()); err == nil {
+			field.SetFloat(f)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s", value, spec.display())
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
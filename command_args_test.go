@@ -0,0 +1,185 @@
+package bearychat
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCommandArgs(t *testing.T) {
+	cases := []struct {
+		text string
+		args []string
+	}{
+		{"", nil},
+		{"  deploy   api  ", []string{"deploy", "api"}},
+		{`deploy api --env=prod "fix login"`, []string{"deploy", "api", "--env=prod", "fix login"}},
+		{`say 'it''s "ok"'`, []string{"say", `its "ok"`}},
+		{`say "a \"b\" \\ \n"`, []string{"say", `a "b" \ \n`}},
+		{`say a\ b \"c`, []string{"say", "a b", `"c`}},
+		{`say "" ''`, []string{"say", "", ""}},
+		{"@<==bw52O=> 你好\t世界", []string{"@<==bw52O=>", "你好", "世界"}},
+	}
+
+	for _, c := range cases {
+		args, err := SplitCommandArgs(c.text)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %+v", c.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%q: expected %q, got %q", c.text, c.args, args)
+		}
+	}
+
+	for _, text := range []string{`say "hi`, `say 'hi`, `say hi\`} {
+		if _, err := SplitCommandArgs(text); err == nil {
+			t.Errorf("%q: expected error", text)
+		}
+	}
+}
+
+type testDeployArgs struct {
+	Service string        `arg:"service" required:"true" help:"service to deploy"`
+	Reason  []string      `arg:"reason" help:"deploy reason"`
+	Env     string        `flag:"env,e" default:"staging" enum:"staging,prod"`
+	Force   bool          `flag:"force,f" help:"skip checks"`
+	Replica int           `flag:"replica" default:"1"`
+	Timeout time.Duration `flag:"timeout" default:"1m"`
+	Tags    []string      `flag:"tag" default:"auto"`
+	ignored string
+}
+
+func TestParseCommandArgs(t *testing.T) {
+	var args testDeployArgs
+	err := ParseCommandArgs(`api --env=prod "fix login" -f --replica -2 --tag a --tag=b -- --not-flag`, &args)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expected := testDeployArgs{
+		Service: "api",
+		Reason:  []string{"fix login", "--not-flag"},
+		Env:     "prod",
+		Force:   true,
+		Replica: -2,
+		Timeout: time.Minute,
+		Tags:    []string{"a", "b"},
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("unexpected args: %+v", args)
+	}
+
+	// defaults are restored when reused
+	if err := ParseCommandArgs("web", &args); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expected = testDeployArgs{
+		Service: "web",
+		Env:     "staging",
+		Replica: 1,
+		Timeout: time.Minute,
+		Tags:    []string{"auto"},
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("unexpected args: %+v", args)
+	}
+}
+
+func TestParseCommandArgs_Error(t *testing.T) {
+	cases := map[string]string{
+		"":                         "service is required",
+		"api --env=dev":            "--env, -e should be one of: staging, prod",
+		"api --unknown":            "unknown flag `--unknown`",
+		"api --replica":            "flag `--replica` needs a value",
+		"api --replica=x":          `invalid value "x" for --replica`,
+		"api --force=maybe":        `invalid value "maybe" for --force, -f`,
+		`api "unclosed`:            "unclosed quote `\"`",
+		"api --timeout=forever -f": `invalid value "forever" for --timeout`,
+	}
+
+	for text, message := range cases {
+		var args testDeployArgs
+		err := ParseCommandArgs(text, &args)
+		if err == nil || err.Error() != message {
+			t.Errorf("%q: expected error %q, got %v", text, message, err)
+		}
+	}
+
+	type pair struct {
+		A string `arg:"a"`
+		B string `arg:"b"`
+	}
+	var p pair
+	if err := ParseCommandArgs("1 2 3", &p); err == nil || err.Error() != "unexpected arguments: 3" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewCommandArgs_Invalid(t *testing.T) {
+	invalids := []interface{}{
+		nil,
+		"string",
+		struct {
+			Rest []string `arg:"rest"`
+			Last string   `arg:"last"`
+		}{},
+		struct {
+			A string `arg:"a" flag:"a"`
+		}{},
+		struct {
+			A map[string]string `flag:"a"`
+		}{},
+		struct {
+			A string `flag:"name"`
+			B string `flag:"other,name"`
+		}{},
+		struct {
+			A int `flag:"a" default:"x"`
+		}{},
+		struct {
+			a string `flag:"a"`
+		}{},
+	}
+
+	for _, v := range invalids {
+		if _, err := NewCommandArgs(v); err == nil {
+			t.Errorf("%#v: expected error", v)
+		}
+	}
+
+	c, err := NewCommandArgs(testDeployArgs{})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := c.Bind(nil, &struct{}{}); err == nil {
+		t.Errorf("expected error for mismatched type")
+	}
+}
+
+func TestCommandArgs_Usage(t *testing.T) {
+	c, err := NewCommandArgs(&testDeployArgs{})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expected := strings.Join([]string{
+		"Usage: deploy <service> [reason...] [flags]",
+		"",
+		"Arguments:",
+		"  service   service to deploy (required)",
+		"  reason    deploy reason",
+		"",
+		"Flags:",
+		"  --env, -e     one of: staging, prod, default: staging",
+		"  --force, -f   skip checks",
+		"  --replica     default: 1",
+		"  --timeout     default: 1m",
+		"  --tag         default: auto",
+		"",
+	}, "\n")
+	if usage := c.Usage("deploy"); usage != expected {
+		t.Errorf("unexpected usage:\n%s", usage)
+	}
+}
@@ -8,6 +8,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -36,21 +37,14 @@ func (c Config) randomVictim() string {
 	return c.victims[rand.Intn(len(c.victims))]
 }
 
-func (c Config) insultMessage(user *bearychat.User) bearychat.RTMMessage {
+func (c Config) insultMessage(user *bearychat.User) (bearychat.RTMMessage, error) {
 	messages := []string{
 		fmt.Sprintf("hi %s", user.Name),
 		fmt.Sprintf("hey %s, are you chill?", user.Name),
 		fmt.Sprintf("苟利国家生死以，岂因祸福避趋之，%s 识得唔识得啊？", user.Name),
 	}
 
-	return bearychat.RTMMessage{
-		"type":        bearychat.RTMMessageTypeP2PMessage,
-		"vchannel_id": user.VChannelId,
-		"to_uid":      user.Id,
-		"text":        messages[rand.Intn(len(messages))],
-		"call_id":     rand.Int(), // FIXME `call_id` sequence generator
-		"refer_key":   nil,
-	}
+	return bearychat.NewP2PMessage(user, messages[rand.Intn(len(messages))])
 }
 
 func main() {
@@ -80,24 +74,30 @@ func main() {
 	for {
 		select {
 		case err := <-errC:
+			if !errors.Is(err, bearychat.ErrRTMLoopFatal) {
+				log.Printf("rtm loop error: %+v", err)
+				continue
+			}
 			checkErr(err)
 			return
 		case message := <-messageC:
-			if !message.IsChatMessage() {
+			event, err := message.Event()
+			if err != nil {
+				log.Printf("decode message failed: %+v", err)
 				continue
 			}
-			if !message.IsP2P() {
+			p2p, ok := event.(*bearychat.RTMP2PMessage)
+			if !ok {
 				continue
 			}
-			if message.IsFromUser(*user) {
+			if p2p.UserId == user.Id {
 				continue
 			}
-			uid := message["uid"].(string)
-			if !config.isVictimUID(uid) {
+			if !config.isVictimUID(p2p.UserId) {
 				continue
 			}
 
-			log.Printf("user %s said: %s", uid, message["text"])
+			log.Printf("user %s said: %s", p2p.UserId, p2p.Text)
 
 			checkErr(rtmLoop.Send(message.Refer("🙊")))
 		case <-tickTock.C:
@@ -105,7 +105,9 @@ func main() {
 			checkErr(err)
 
 			log.Printf("insulting user %s", user.Name)
-			checkErr(rtmLoop.Send(config.insultMessage(user)))
+			insult, err := config.insultMessage(user)
+			checkErr(err)
+			checkErr(rtmLoop.Send(insult))
 		}
 	}
 }
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 
@@ -35,6 +36,9 @@ func main() {
 		select {
 		case err := <-errC:
 			log.Printf("rtm loop error: %+v", err)
+			if !errors.Is(err, bearychat.ErrRTMLoopFatal) {
+				continue
+			}
 			if err := context.Loop.Stop(); err != nil {
 				log.Fatal(err)
 			}
@@ -0,0 +1,249 @@
+// Package markup tokenizes BearyChat message text, shared by message
+// types of bearychat & openapi packages.
+package markup
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+type TokenType string
+
+const (
+	// Plain text
+	TokenText TokenType = "text"
+	// User mention: `@<==bw52O=>`
+	TokenMentionUser TokenType = "mention_user"
+	// Mention everyone in channel: `@<-channel->`
+	TokenMentionAll TokenType = "mention_all"
+	// Channel reference: `#<==bw52Q=>`
+	TokenChannel TokenType = "channel"
+	// Link: `[text](url)` or a bare url
+	TokenLink TokenType = "link"
+	// Emoji shortcode: `:smile:`
+	TokenEmoji TokenType = "emoji"
+	// Markdown: `**bold**`, `*italic*`, `~~strike~~`
+	TokenBold   TokenType = "bold"
+	TokenItalic TokenType = "italic"
+	TokenStrike TokenType = "strike"
+	// Inline code: `code`
+	TokenCode TokenType = "code"
+	// Code block fenced with ```, the first line may be language.
+	TokenCodeBlock TokenType = "code_block"
+	// Punctuation escaped by backslash: `\*`
+	TokenEscaped TokenType = "escaped"
+)
+
+// Token is a piece of message text.
+type Token struct {
+	Type TokenType
+	// Text of text, code, link & escaped tokens, emoji name
+	Text string
+	// User or channel id of mentions & channel references
+	Id string
+	// Url of links
+	URL string
+	// Tokens inside bold, italic & strike
+	Children []Token
+}
+
+var (
+	mentionUserRegex = regexp.MustCompile(`^@<=(=[A-Za-z0-9]+)=>`)
+	mentionAllRegex  = regexp.MustCompile(`^@<-channel->`)
+	channelRegex     = regexp.MustCompile(`^#<=(=[A-Za-z0-9]+)=>`)
+	linkRegex        = regexp.MustCompile(`^\[([^\]\n]+)\]\(([^)\s]+)\)`)
+	urlRegex         = regexp.MustCompile(`^https?://[^\s<>()\[\]]+`)
+	emojiRegex       = regexp.MustCompile(`^:([a-z0-9_+\-]*[a-z][a-z0-9_+\-]*):`)
+)
+
+// Punctuation can be escaped by backslash.
+const Escapable = "\\`*_~[]()#>!|:-+"
+
+// Parse splits message text into tokens. Unclosed markdown is kept as
+// text.
+func Parse(text string) []Token {
+	p := &parser{}
+	p.parse(text)
+	return p.tokens
+}
+
+type parser struct {
+	tokens []Token
+	text   bytes.Buffer // pending text
+}
+
+func (p *parser) parse(text string) {
+	for i := 0; i < len(text); {
+		token, size := parseToken(text, i)
+		if size == 0 {
+			p.text.WriteByte(text[i])
+			i = i + 1
+			continue
+		}
+
+		p.flush()
+		p.tokens = append(p.tokens, token)
+		i = i + size
+	}
+	p.flush()
+}
+
+// Append pending text as a token.
+func (p *parser) flush() {
+	if p.text.Len() == 0 {
+		return
+	}
+	p.tokens = append(p.tokens, Token{
+		Type: TokenText,
+		Text: p.text.String(),
+	})
+	p.text.Reset()
+}
+
+// Parse a token at i, returns the token and its size in bytes,
+// or 0 size if no token starts at i.
+func parseToken(text string, i int) (Token, int) {
+	rest := text[i:]
+
+	switch rest[0] {
+	case '\\':
+		if len(rest) > 1 && strings.IndexByte(Escapable, rest[1]) >= 0 {
+			return Token{
+				Type: TokenEscaped,
+				Text: rest[1:2],
+			}, 2
+		}
+	case '`':
+		if strings.HasPrefix(rest, "```") {
+			if end := strings.Index(rest[3:], "```"); end >= 0 {
+				return Token{
+					Type: TokenCodeBlock,
+					Text: rest[3 : 3+end],
+				}, end + 6
+			}
+			return Token{}, 0
+		}
+		if end := strings.IndexAny(rest[1:], "`\n"); end > 0 && rest[1+end] == '`' {
+			return Token{
+				Type: TokenCode,
+				Text: rest[1 : 1+end],
+			}, end + 2
+		}
+	case '@':
+		if loc := mentionUserRegex.FindStringSubmatch(rest); loc != nil {
+			return Token{
+				Type: TokenMentionUser,
+				Id:   loc[1],
+			}, len(loc[0])
+		}
+		if loc := mentionAllRegex.FindString(rest); loc != "" {
+			return Token{Type: TokenMentionAll}, len(loc)
+		}
+	case '#':
+		if loc := channelRegex.FindStringSubmatch(rest); loc != nil {
+			return Token{
+				Type: TokenChannel,
+				Id:   loc[1],
+			}, len(loc[0])
+		}
+	case '[':
+		if loc := linkRegex.FindStringSubmatch(rest); loc != nil {
+			return Token{
+				Type: TokenLink,
+				Text: loc[1],
+				URL:  loc[2],
+			}, len(loc[0])
+		}
+	case 'h':
+		if !isWordBoundary(text, i) {
+			break
+		}
+		if url := urlRegex.FindString(rest); url != "" {
+			// trailing punctuation belongs to the sentence
+			url = strings.TrimRight(url, ".,;:!?'\"")
+			return Token{
+				Type: TokenLink,
+				URL:  url,
+			}, len(url)
+		}
+	case ':':
+		if !isWordBoundary(text, i) {
+			break
+		}
+		if loc := emojiRegex.FindStringSubmatch(rest); loc != nil {
+			return Token{
+				Type: TokenEmoji,
+				Text: loc[1],
+			}, len(loc[0])
+		}
+	case '*':
+		if strings.HasPrefix(rest, "**") {
+			return parseEmphasis(rest, "**", TokenBold)
+		}
+		return parseEmphasis(rest, "*", TokenItalic)
+	case '~':
+		if strings.HasPrefix(rest, "~~") {
+			return parseEmphasis(rest, "~~", TokenStrike)
+		}
+	}
+
+	return Token{}, 0
+}
+
+// Parse emphasis surrounded by delimiter, the content should not be
+// empty or start with space.
+func parseEmphasis(rest, delimiter string, t TokenType) (Token, int) {
+	inner := rest[len(delimiter):]
+	end := strings.Index(inner, delimiter)
+	if end <= 0 || inner[0] == ' ' || strings.Contains(inner[:end], "\n") {
+		return Token{}, 0
+	}
+
+	return Token{
+		Type:     t,
+		Children: Parse(inner[:end]),
+	}, end + 2*len(delimiter)
+}
+
+// Urls & emoji should not start in the middle of a word.
+func isWordBoundary(text string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	c := text[i-1]
+	return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_')
+}
+
+// Mentions returns mentioned uids in tokens in order, without
+// duplication.
+func Mentions(tokens []Token) []string {
+	return collectIds(tokens, TokenMentionUser, nil, map[string]bool{})
+}
+
+// MentionsAll tells if tokens mention everyone in channel.
+func MentionsAll(tokens []Token) bool {
+	for _, token := range tokens {
+		if token.Type == TokenMentionAll || MentionsAll(token.Children) {
+			return true
+		}
+	}
+	return false
+}
+
+// MentionedChannels returns referenced channel ids in tokens in order,
+// without duplication.
+func MentionedChannels(tokens []Token) []string {
+	return collectIds(tokens, TokenChannel, nil, map[string]bool{})
+}
+
+func collectIds(tokens []Token, t TokenType, ids []string, seen map[string]bool) []string {
+	for _, token := range tokens {
+		if token.Type == t && !seen[token.Id] {
+			seen[token.Id] = true
+			ids = append(ids, token.Id)
+		}
+		ids = collectIds(token.Children, t, ids, seen)
+	}
+	return ids
+}
@@ -0,0 +1,317 @@
+package bearychat
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bearyinnovative/bearychat-go/internal/markup"
+)
+
+// Inserted into mention markup to break it, it's invisible.
+const zeroWidthSpace = "\u200b"
+
+var mentionMarkupReplacer = strings.NewReplacer(
+	"@<=", "@"+zeroWidthSpace+"<=",
+	"@<-", "@"+zeroWidthSpace+"<-",
+	"#<=", "#"+zeroWidthSpace+"<=",
+)
+
+// EscapeMentions breaks mention & channel markup in text, so untrusted
+// text can't mention users. It's for messages without markdown.
+func EscapeMentions(text string) string {
+	return mentionMarkupReplacer.Replace(text)
+}
+
+// EscapeMarkdown escapes markdown punctuation and breaks mention markup,
+// so untrusted text is shown as is in markdown messages.
+//
+//      EscapeMarkdown("**hi** :smile:") // `\*\*hi\*\* \:smile\:`
+func EscapeMarkdown(text string) string {
+	text = EscapeMentions(text)
+
+	var buf bytes.Buffer
+	lineStart := true
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '-' || c == '+':
+			// list markers only at line start
+			if lineStart {
+				buf.WriteByte('\\')
+			}
+		case strings.IndexByte(markup.Escapable, c) >= 0:
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(c)
+		lineStart = c == '\n' || lineStart && (c == ' ' || c == '\t')
+	}
+	return buf.String()
+}
+
+// MarkdownBuilder builds markdown text for Incoming & RTM messages.
+// Text from arguments is escaped, except Raw.
+//
+//      b := NewMarkdownBuilder()
+//      b.Bold("Deploy ").Text(service).Text(" by ").Mention(uid).Newline()
+//      b.List("api: ok", "web: "+userInput)
+//      b.Table([]string{"service", "status"}, [][]string{{"api", "ok"}})
+//      loop.Send(b.Refer(m))
+type MarkdownBuilder struct {
+	buf bytes.Buffer
+}
+
+func NewMarkdownBuilder() *MarkdownBuilder {
+	return &MarkdownBuilder{}
+}
+
+// Text appends escaped text.
+func (b *MarkdownBuilder) Text(text string) *MarkdownBuilder {
+	b.buf.WriteString(EscapeMarkdown(text))
+	return b
+}
+
+// Textf appends escaped formatted text.
+func (b *MarkdownBuilder) Textf(format string, args ...interface{}) *MarkdownBuilder {
+	return b.Text(fmt.Sprintf(format, args...))
+}
+
+// Raw appends trusted markup as is.
+func (b *MarkdownBuilder) Raw(markup string) *MarkdownBuilder {
+	b.buf.WriteString(markup)
+	return b
+}
+
+// Newline appends a line break.
+func (b *MarkdownBuilder) Newline() *MarkdownBuilder {
+	b.buf.WriteString("\n")
+	return b
+}
+
+// Bold appends escaped bold text.
+func (b *MarkdownBuilder) Bold(text string) *MarkdownBuilder {
+	return b.emphasis("**", text)
+}
+
+// Italic appends escaped italic text.
+func (b *MarkdownBuilder) Italic(text string) *MarkdownBuilder {
+	return b.emphasis("*", text)
+}
+
+// Strike appends escaped strikethrough text.
+func (b *MarkdownBuilder) Strike(text string) *MarkdownBuilder {
+	return b.emphasis("~~", text)
+}
+
+// Emphasis can't start or end with spaces, which are kept outside.
+func (b *MarkdownBuilder) emphasis(delimiter, text string) *MarkdownBuilder {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return b.Text(text)
+	}
+
+	start := strings.Index(text, trimmed)
+	b.buf.WriteString(text[:start])
+	b.buf.WriteString(delimiter + EscapeMarkdown(trimmed) + delimiter)
+	b.buf.WriteString(text[start+len(trimmed):])
+	return b
+}
+
+// Code appends inline code. Code with backtick or line break can't be
+// inline, it's appended as escaped text.
+func (b *MarkdownBuilder) Code(code string) *MarkdownBuilder {
+	if code == "" || strings.ContainsAny(code, "`\n") {
+		return b.Text(code)
+	}
+	b.buf.WriteString("`" + EscapeMentions(code) + "`")
+	return b
+}
+
+// CodeBlock appends a fenced code block, lang can be empty.
+func (b *MarkdownBuilder) CodeBlock(code, lang string) *MarkdownBuilder {
+	if strings.ContainsAny(lang, " \t\n`") {
+		lang = ""
+	}
+
+	b.block()
+	b.buf.WriteString("```" + lang + "\n")
+	b.buf.WriteString(escapeCodeBlock(strings.TrimRight(code, "\n")))
+	b.buf.WriteString("\n```\n")
+	return b
+}
+
+// Link appends a link with escaped text, link text defaults to url.
+func (b *MarkdownBuilder) Link(text, link string) *MarkdownBuilder {
+	// keep url in the parentheses, and break mention markup
+	link = strings.NewReplacer(
+		" ", "%20",
+		"\n", "%0A",
+		"(", "%28",
+		")", "%29",
+		"<", "%3C",
+		">", "%3E",
+	).Replace(link)
+	if text == "" {
+		text = link
+	}
+
+	b.buf.WriteString("[" + EscapeMarkdown(text) + "](" + link + ")")
+	return b
+}
+
+// Mention appends mention of the user.
+func (b *MarkdownBuilder) Mention(uid string) *MarkdownBuilder {
+	b.buf.WriteString(MentionUID(uid))
+	return b
+}
+
+// MentionAll appends mention of everyone in channel.
+func (b *MarkdownBuilder) MentionAll() *MarkdownBuilder {
+	b.buf.WriteString(MentionAll())
+	return b
+}
+
+// Channel appends reference of the channel.
+func (b *MarkdownBuilder) Channel(channelId string) *MarkdownBuilder {
+	b.buf.WriteString(MentionChannel(channelId))
+	return b
+}
+
+// List appends a bullet list of escaped items.
+func (b *MarkdownBuilder) List(items ...string) *MarkdownBuilder {
+	b.block()
+	for _, item := range items {
+		b.buf.WriteString("- " + EscapeMarkdown(singleLine(item)) + "\n")
+	}
+	return b
+}
+
+// OrderedList appends a numbered list of escaped items.
+func (b *MarkdownBuilder) OrderedList(items ...string) *MarkdownBuilder {
+	b.block()
+	for i, item := range items {
+		b.buf.WriteString(fmt.Sprintf("%d. %s\n", i+1, EscapeMarkdown(singleLine(item))))
+	}
+	return b
+}
+
+// Table appends a table as fixed-width code block, columns are aligned
+// by display width, CJK characters are counted as 2.
+//
+//      service | status
+//      --------+-------
+//      api     | ok
+func (b *MarkdownBuilder) Table(header []string, rows [][]string) *MarkdownBuilder {
+	columns := len(header)
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	if columns == 0 {
+		return b
+	}
+
+	widths := make([]int, columns)
+	cells := func(row []string) []string {
+		normalized := make([]string, columns)
+		for i := range normalized {
+			if i < len(row) {
+				normalized[i] = singleLine(row[i])
+			}
+			if w := displayWidth(normalized[i]); w > widths[i] {
+				widths[i] = w
+			}
+		}
+		return normalized
+	}
+	lines := make([][]string, 0, len(rows)+1)
+	if len(header) > 0 {
+		lines = append(lines, cells(header))
+	}
+	for _, row := range rows {
+		lines = append(lines, cells(row))
+	}
+
+	var table bytes.Buffer
+	writeLine := func(line []string) {
+		var cols []string
+		for i, cell := range line {
+			cols = append(cols, cell+strings.Repeat(" ", widths[i]-displayWidth(cell)))
+		}
+		table.WriteString(strings.TrimRight(strings.Join(cols, " | "), " ") + "\n")
+	}
+	for i, line := range lines {
+		writeLine(line)
+		if i == 0 && len(header) > 0 {
+			var separators []string
+			for _, w := range widths {
+				separators = append(separators, strings.Repeat("-", w))
+			}
+			table.WriteString(strings.Join(separators, "-+-") + "\n")
+		}
+	}
+
+	return b.CodeBlock(table.String(), "")
+}
+
+// String returns the built markdown.
+func (b *MarkdownBuilder) String() string {
+	return strings.TrimRight(b.buf.String(), "\n")
+}
+
+// Incoming builds an incoming message with markdown enabled.
+func (b *MarkdownBuilder) Incoming() Incoming {
+	return Incoming{Text: b.String(), Markdown: true}
+}
+
+// Refer builds a markdown message referring m.
+func (b *MarkdownBuilder) Refer(m RTMMessage) RTMMessage {
+	refer := m.Refer(b.String())
+	refer["markdown"] = true
+	return refer
+}
+
+// Blocks start at a new line.
+func (b *MarkdownBuilder) block() {
+	if b.buf.Len() > 0 && !bytes.HasSuffix(b.buf.Bytes(), []byte("\n")) {
+		b.buf.WriteString("\n")
+	}
+}
+
+// Fences in code would close the code block, which are broken by zero
+// width space. Mentions are broken as well.
+func escapeCodeBlock(code string) string {
+	return EscapeMentions(strings.Replace(code, "```", "``"+zeroWidthSpace+"`", -1))
+}
+
+func singleLine(text string) string {
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\t", " ").Replace(text)
+}
+
+// Display width of text in fixed-width fonts.
+func displayWidth(text string) int {
+	width := 0
+	for _, r := range text {
+		if isWideRune(r) {
+			width = width + 2
+		} else if r != utf8.RuneError && r != '\u200b' {
+			width = width + 1
+		}
+	}
+	return width
+}
+
+func isWideRune(r rune) bool {
+	return r >= 0x1100 && r <= 0x115F ||
+		r >= 0x2E80 && r <= 0xA4CF ||
+		r >= 0xAC00 && r <= 0xD7A3 ||
+		r >= 0xF900 && r <= 0xFAFF ||
+		r >= 0xFE30 && r <= 0xFE4F ||
+		r >= 0xFF00 && r <= 0xFF60 ||
+		r >= 0xFFE0 && r <= 0xFFE6 ||
+		r >= 0x1F300 && r <= 0x1F64F ||
+		r >= 0x1F900 && r <= 0x1F9FF ||
+		r >= 0x20000 && r <= 0x3FFFD
+}
@@ -0,0 +1,159 @@
+package bearychat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bearyinnovative/bearychat-go/openapi"
+)
+
+func TestEscapeMarkdown(t *testing.T) {
+	untrusted := "**bold** `code` ~~s~~ [x](http://evil) :smile: @<==bw52O=> @<-channel-> #<==bw52Q=> C:\\dir"
+	escaped := EscapeMarkdown(untrusted)
+
+	m := RTMMessage{"text": escaped}
+	if len(m.Mentions()) != 0 || m.MentionsAll() || len(m.MentionedChannels()) != 0 {
+		t.Errorf("mentions should be escaped: %q", escaped)
+	}
+	for _, token := range m.Markup() {
+		if token.Type != MarkupTokenText && token.Type != MarkupTokenEscaped {
+			t.Errorf("unexpected token: %+v", token)
+		}
+	}
+
+	// shown as is
+	plain := strings.Replace(RenderMarkupPlain(m.Markup(), nil), zeroWidthSpace, "", -1)
+	if plain != untrusted {
+		t.Errorf("unexpected plain text: %q", plain)
+	}
+	if rendered := RenderMarkup(m.Markup()); rendered != escaped {
+		t.Errorf("unexpected rendered: %q", rendered)
+	}
+
+	cases := map[string]string{
+		"- item\n  + item": "\\- item\n  \\+ item",
+		"1 - 2 + 3":        "1 - 2 + 3",
+		"a_b":              "a\\_b",
+	}
+	for text, expected := range cases {
+		if escaped := EscapeMarkdown(text); escaped != expected {
+			t.Errorf("%q: expected %q, got %q", text, expected, escaped)
+		}
+	}
+}
+
+func TestEscapeMentions(t *testing.T) {
+	m := RTMMessage{"text": EscapeMentions("**hi** @<==bw52O=> @<-channel-> #<==bw52Q=>")}
+	if len(m.Mentions()) != 0 || m.MentionsAll() || len(m.MentionedChannels()) != 0 {
+		t.Errorf("mentions should be escaped: %q", m.Text())
+	}
+	if !strings.HasPrefix(m.Text(), "**hi** @") {
+		t.Errorf("markdown should be kept: %q", m.Text())
+	}
+}
+
+func TestMarkdownBuilder(t *testing.T) {
+	b := NewMarkdownBuilder()
+	b.Bold(" Deploy ").Text("api*").Text(" by ").Mention("=bw52O").Italic("now").Newline()
+	b.Strike("old").Text(" ").Code("make @<==bw52P=>").Text(" ").Code("a`b").Text(" ")
+	b.Link("docs [v2]", "https://example.com/a b(1)")
+	b.List("first *", "second\nline")
+	b.OrderedList("one", "#two")
+	b.CodeBlock("fmt.Println(\"```\")\n", "go")
+	b.Text("end").MentionAll().Channel("=bw52Q").Raw("**raw**")
+
+	expected := strings.Join([]string{
+		" **Deploy** api\\* by @<==bw52O=> *now*",
+		"~~old~~ `make @\u200b<==bw52P=>` a\\`b [docs \\[v2\\]](https://example.com/a%20b%281%29)",
+		"- first \\*",
+		"- second line",
+		"1. one",
+		"2. \\#two",
+		"```go",
+		"fmt.Println(\"``\u200b`\")",
+		"```",
+		"end@<-channel-> #<==bw52Q=> **raw**",
+	}, "\n")
+	if text := b.String(); text != expected {
+		t.Errorf("unexpected text:\n%s\nexpected:\n%s", text, expected)
+	}
+
+	m := RTMMessage{"text": b.String()}
+	if mentions := m.Mentions(); len(mentions) != 1 || mentions[0] != "=bw52O" {
+		t.Errorf("unexpected mentions: %+v", mentions)
+	}
+	var blocks int
+	for _, token := range m.Markup() {
+		if token.Type == MarkupTokenCodeBlock {
+			blocks = blocks + 1
+		}
+	}
+	if blocks != 1 {
+		t.Errorf("code block should not be broken: %+v", m.Markup())
+	}
+
+	incoming := b.Incoming()
+	if !incoming.Markdown || incoming.Text != expected || incoming.Validate() != nil {
+		t.Errorf("unexpected incoming: %+v", incoming)
+	}
+
+	refer := b.Refer(RTMMessage{
+		"type":        RTMMessageTypeP2PMessage,
+		"key":         "1",
+		"uid":         "=bw52O",
+		"vchannel_id": "=bw52O",
+	})
+	if refer["markdown"] != true || refer.Text() != expected || refer.Validate() != nil {
+		t.Errorf("unexpected refer: %+v", refer)
+	}
+}
+
+func TestMarkdownBuilder_Link(t *testing.T) {
+	b := NewMarkdownBuilder()
+	b.Link("x", "http://a/@<==bw52O=>/@<-channel->/#<==bw52Q=>").Text(" ")
+	b.Link("", "http://a/@<==bw52P=>")
+
+	text := b.String()
+	if text != "[x](http://a/@%3C==bw52O=%3E/@%3C-channel-%3E/#%3C==bw52Q=%3E) [http\\://a/@%3C==bw52P=%3E](http://a/@%3C==bw52P=%3E)" {
+		t.Errorf("unexpected text: %q", text)
+	}
+
+	m := RTMMessage{"text": text}
+	if len(m.Mentions()) != 0 || m.MentionsAll() || len(m.MentionedChannels()) != 0 {
+		t.Errorf("mentions in url should be escaped: %q", text)
+	}
+	history := openapi.Message{Text: &text}
+	if len(history.Mentions()) != 0 || history.MentionsAll() || len(history.MentionedChannels()) != 0 {
+		t.Errorf("mentions in url should be escaped: %q", text)
+	}
+}
+
+func TestMarkdownBuilder_Table(t *testing.T) {
+	b := NewMarkdownBuilder().Text("status")
+	b.Table(
+		[]string{"service", "状态"},
+		[][]string{
+			{"api", "正常"},
+			{"web\nfront", "down", "extra"},
+			{"@<==bw52O=>"},
+		},
+	)
+
+	expected := strings.Join([]string{
+		"status",
+		"```",
+		"service     | 状态 |",
+		"------------+------+------",
+		"api         | 正常 |",
+		"web front   | down | extra",
+		"@\u200b<==bw52O=> |      |",
+		"```",
+	}, "\n")
+	if text := b.String(); text != expected {
+		t.Errorf("unexpected table:\n%s\nexpected:\n%s", text, expected)
+	}
+
+	if text := NewMarkdownBuilder().Table(nil, nil).String(); text != "" {
+		t.Errorf("unexpected empty table: %q", text)
+	}
+}
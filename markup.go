@@ -0,0 +1,181 @@
+package bearychat
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/bearyinnovative/bearychat-go/internal/markup"
+)
+
+type MarkupTokenType = markup.TokenType
+
+const (
+	// Plain text
+	MarkupTokenText = markup.TokenText
+	// User mention: `@<==bw52O=>`
+	MarkupTokenMentionUser = markup.TokenMentionUser
+	// Mention everyone in channel: `@<-channel->`
+	MarkupTokenMentionAll = markup.TokenMentionAll
+	// Channel reference: `#<==bw52Q=>`
+	MarkupTokenChannel = markup.TokenChannel
+	// Link: `[text](url)` or a bare url
+	MarkupTokenLink = markup.TokenLink
+	// Emoji shortcode: `:smile:`
+	MarkupTokenEmoji = markup.TokenEmoji
+	// Markdown: `**bold**`, `*italic*`, `~~strike~~`
+	MarkupTokenBold   = markup.TokenBold
+	MarkupTokenItalic = markup.TokenItalic
+	MarkupTokenStrike = markup.TokenStrike
+	// Inline code: `code`
+	MarkupTokenCode = markup.TokenCode
+	// Code block fenced with ```, the first line may be language.
+	MarkupTokenCodeBlock = markup.TokenCodeBlock
+	// Punctuation escaped by backslash: `\*`
+	MarkupTokenEscaped = markup.TokenEscaped
+)
+
+// MarkupToken is a piece of message text, with fields:
+//
+//      Type     MarkupTokenType
+//      Text     string        // text of text, code, link & escaped tokens, emoji name
+//      Id       string        // user or channel id of mentions & channel references
+//      URL      string        // url of links
+//      Children []MarkupToken // tokens inside bold, italic & strike
+type MarkupToken = markup.Token
+
+// MarkupResolver resolves names for rendering plain text.
+type MarkupResolver interface {
+	// Returns empty string if unknown.
+	UserName(uid string) string
+	// Returns empty string if unknown.
+	ChannelName(channelId string) string
+}
+
+// MarkupNames resolves names from maps by id.
+type MarkupNames struct {
+	Users    map[string]string
+	Channels map[string]string
+}
+
+func (n MarkupNames) UserName(uid string) string {
+	return n.Users[uid]
+}
+
+func (n MarkupNames) ChannelName(channelId string) string {
+	return n.Channels[channelId]
+}
+
+// ParseMarkup splits message text into tokens.
+//
+//      tokens := ParseMarkup(message.Text())
+//      plain := RenderMarkupPlain(tokens, resolver)
+//
+// Text of history messages (openapi.Message) can be parsed as well.
+// Unclosed markdown is kept as text.
+func ParseMarkup(text string) []MarkupToken {
+	return markup.Parse(text)
+}
+
+// Markup parses text of the message, see ParseMarkup.
+func (m RTMMessage) Markup() []MarkupToken {
+	return ParseMarkup(m.Text())
+}
+
+// RenderMarkup renders tokens back to message markup.
+func RenderMarkup(tokens []MarkupToken) string {
+	var buf bytes.Buffer
+	for _, token := range tokens {
+		switch token.Type {
+		case MarkupTokenMentionUser:
+			buf.WriteString("@<=" + token.Id + "=>")
+		case MarkupTokenMentionAll:
+			buf.WriteString("@<-channel->")
+		case MarkupTokenChannel:
+			buf.WriteString("#<=" + token.Id + "=>")
+		case MarkupTokenLink:
+			if token.Text == "" {
+				buf.WriteString(token.URL)
+			} else {
+				buf.WriteString("[" + token.Text + "](" + token.URL + ")")
+			}
+		case MarkupTokenEmoji:
+			buf.WriteString(":" + token.Text + ":")
+		case MarkupTokenBold:
+			buf.WriteString("**" + RenderMarkup(token.Children) + "**")
+		case MarkupTokenItalic:
+			buf.WriteString("*" + RenderMarkup(token.Children) + "*")
+		case MarkupTokenStrike:
+			buf.WriteString("~~" + RenderMarkup(token.Children) + "~~")
+		case MarkupTokenCode:
+			buf.WriteString("`" + token.Text + "`")
+		case MarkupTokenCodeBlock:
+			buf.WriteString("```" + token.Text + "```")
+		case MarkupTokenEscaped:
+			buf.WriteString("\\" + token.Text)
+		default:
+			buf.WriteString(token.Text)
+		}
+	}
+	return buf.String()
+}
+
+// RenderMarkupPlain renders tokens as plain text without markup.
+// Mentions & channels are rendered with names from resolver (can be nil),
+// or ids if unknown.
+//
+//      "@<==bw52O=> see [docs](https://bearychat.com) **now**"
+//      // "@alice see docs (https://bearychat.com) now"
+func RenderMarkupPlain(tokens []MarkupToken, resolver MarkupResolver) string {
+	var buf bytes.Buffer
+	for _, token := range tokens {
+		switch token.Type {
+		case MarkupTokenMentionUser:
+			name := ""
+			if resolver != nil {
+				name = resolver.UserName(token.Id)
+			}
+			if name == "" {
+				name = token.Id
+			}
+			buf.WriteString("@" + name)
+		case MarkupTokenMentionAll:
+			buf.WriteString("@all")
+		case MarkupTokenChannel:
+			name := ""
+			if resolver != nil {
+				name = resolver.ChannelName(token.Id)
+			}
+			if name == "" {
+				name = token.Id
+			}
+			buf.WriteString("#" + name)
+		case MarkupTokenLink:
+			if token.Text == "" || token.Text == token.URL {
+				buf.WriteString(token.URL)
+			} else {
+				buf.WriteString(token.Text + " (" + token.URL + ")")
+			}
+		case MarkupTokenEmoji:
+			buf.WriteString(":" + token.Text + ":")
+		case MarkupTokenBold, MarkupTokenItalic, MarkupTokenStrike:
+			buf.WriteString(RenderMarkupPlain(token.Children, resolver))
+		case MarkupTokenCodeBlock:
+			buf.WriteString(markupCodeBlockContent(token.Text))
+		default:
+			buf.WriteString(token.Text)
+		}
+	}
+	return buf.String()
+}
+
+// Strip language line of a code block.
+func markupCodeBlockContent(text string) string {
+	newline := strings.Index(text, "\n")
+	if newline < 0 {
+		return text
+	}
+	if lang := text[:newline]; lang != "" && !strings.ContainsAny(lang, " \t") {
+		return text[newline+1:]
+	}
+	return strings.TrimPrefix(text, "\n")
+}
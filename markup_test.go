@@ -0,0 +1,146 @@
+package bearychat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMarkup(t *testing.T) {
+	text := "@<==bw52O=> hi @<-channel->, see #<==bw52Q=> and [docs](https://bearychat.com) :smile:"
+	expected := []MarkupToken{
+		{Type: MarkupTokenMentionUser, Id: "=bw52O"},
+		{Type: MarkupTokenText, Text: " hi "},
+		{Type: MarkupTokenMentionAll},
+		{Type: MarkupTokenText, Text: ", see "},
+		{Type: MarkupTokenChannel, Id: "=bw52Q"},
+		{Type: MarkupTokenText, Text: " and "},
+		{Type: MarkupTokenLink, Text: "docs", URL: "https://bearychat.com"},
+		{Type: MarkupTokenText, Text: " "},
+		{Type: MarkupTokenEmoji, Text: "smile"},
+	}
+
+	tokens := ParseMarkup(text)
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("unexpected tokens: %+v", tokens)
+	}
+	if rendered := RenderMarkup(tokens); rendered != text {
+		t.Errorf("unexpected rendered: %s", rendered)
+	}
+}
+
+func TestParseMarkup_Markdown(t *testing.T) {
+	text := "**bold @<==bw52O=>** *italic* ~~strike~~ `code` ```go\nfmt.Println()\n```"
+	expected := []MarkupToken{
+		{Type: MarkupTokenBold, Children: []MarkupToken{
+			{Type: MarkupTokenText, Text: "bold "},
+			{Type: MarkupTokenMentionUser, Id: "=bw52O"},
+		}},
+		{Type: MarkupTokenText, Text: " "},
+		{Type: MarkupTokenItalic, Children: []MarkupToken{{Type: MarkupTokenText, Text: "italic"}}},
+		{Type: MarkupTokenText, Text: " "},
+		{Type: MarkupTokenStrike, Children: []MarkupToken{{Type: MarkupTokenText, Text: "strike"}}},
+		{Type: MarkupTokenText, Text: " "},
+		{Type: MarkupTokenCode, Text: "code"},
+		{Type: MarkupTokenText, Text: " "},
+		{Type: MarkupTokenCodeBlock, Text: "go\nfmt.Println()\n"},
+	}
+
+	tokens := ParseMarkup(text)
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("unexpected tokens: %+v", tokens)
+	}
+	if rendered := RenderMarkup(tokens); rendered != text {
+		t.Errorf("unexpected rendered: %s", rendered)
+	}
+}
+
+func TestParseMarkup_Text(t *testing.T) {
+	cases := []string{
+		"",
+		"2 * 3 * 4",
+		"at 10:30:45",
+		"**unclosed",
+		"`unclosed",
+		"```unclosed",
+		"mail@<=foo",
+		"not:emoji:",
+		"shttp://example.com",
+	}
+
+	for _, text := range cases {
+		tokens := ParseMarkup(text)
+		if text == "" {
+			if len(tokens) != 0 {
+				t.Errorf("unexpected tokens: %+v", tokens)
+			}
+			continue
+		}
+		if len(tokens) != 1 || tokens[0].Type != MarkupTokenText || tokens[0].Text != text {
+			t.Errorf("%q should be text, got: %+v", text, tokens)
+		}
+	}
+}
+
+func TestParseMarkup_URL(t *testing.T) {
+	tokens := ParseMarkup("visit https://bearychat.com/foo?a=1.")
+	expected := []MarkupToken{
+		{Type: MarkupTokenText, Text: "visit "},
+		{Type: MarkupTokenLink, URL: "https://bearychat.com/foo?a=1"},
+		{Type: MarkupTokenText, Text: "."},
+	}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("unexpected tokens: %+v", tokens)
+	}
+}
+
+func TestRenderMarkupPlain(t *testing.T) {
+	resolver := MarkupNames{
+		Users:    map[string]string{"=bw52O": "alice"},
+		Channels: map[string]string{"=bw52Q": "general"},
+	}
+
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"@<==bw52O=> hi @<==bw52P=>", "@alice hi @=bw52P"},
+		{"@<-channel-> #<==bw52Q=>", "@all #general"},
+		{"see [docs](https://bearychat.com) https://bearychat.com", "see docs (https://bearychat.com) https://bearychat.com"},
+		{"**bold *nested* text** ~~no~~ `code`", "bold nested text no code"},
+		{"```go\nfmt.Println()\n```", "fmt.Println()\n"},
+		{"```\nls -al\n```", "ls -al\n"},
+		{":smile:", ":smile:"},
+	}
+
+	for _, c := range cases {
+		if plain := RenderMarkupPlain(ParseMarkup(c.text), resolver); plain != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.text, c.expected, plain)
+		}
+	}
+
+	if plain := RenderMarkupPlain(ParseMarkup("@<==bw52O=>"), nil); plain != "@=bw52O" {
+		t.Errorf("unexpected plain: %s", plain)
+	}
+}
+
+func TestParseMarkup_Escaped(t *testing.T) {
+	text := `\*not italic\* C:\dir \\`
+	expected := []MarkupToken{
+		{Type: MarkupTokenEscaped, Text: "*"},
+		{Type: MarkupTokenText, Text: "not italic"},
+		{Type: MarkupTokenEscaped, Text: "*"},
+		{Type: MarkupTokenText, Text: ` C:\dir `},
+		{Type: MarkupTokenEscaped, Text: `\`},
+	}
+
+	tokens := ParseMarkup(text)
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("unexpected tokens: %+v", tokens)
+	}
+	if rendered := RenderMarkup(tokens); rendered != text {
+		t.Errorf("unexpected rendered: %s", rendered)
+	}
+	if plain := RenderMarkupPlain(tokens, nil); plain != `*not italic* C:\dir \` {
+		t.Errorf("unexpected plain: %s", plain)
+	}
+}
@@ -0,0 +1,58 @@
+package bearychat
+
+import "github.com/bearyinnovative/bearychat-go/internal/markup"
+
+// MentionUID renders mention markup of the user, with a trailing space.
+//
+//      loop.Send(m.Reply(MentionUID(m["uid"].(string)) + "done"))
+func MentionUID(uid string) string {
+	return "@<=" + uid + "=> "
+}
+
+// MentionUser renders mention markup of the user, with a trailing space.
+func MentionUser(u User) string {
+	return MentionUID(u.Id)
+}
+
+// MentionAll renders markup mentioning everyone in channel, with a
+// trailing space.
+func MentionAll() string {
+	return "@<-channel-> "
+}
+
+// MentionChannel renders channel reference markup, with a trailing space.
+func MentionChannel(channelId string) string {
+	return "#<=" + channelId + "=> "
+}
+
+// Mentions returns mentioned uids in order, without duplication.
+// Mentions in code are ignored.
+func (m RTMMessage) Mentions() []string {
+	return MarkupMentions(m.Markup())
+}
+
+// MentionsAll tells if everyone in channel is mentioned.
+func (m RTMMessage) MentionsAll() bool {
+	return MarkupMentionsAll(m.Markup())
+}
+
+// MentionedChannels returns referenced channel ids in order, without
+// duplication.
+func (m RTMMessage) MentionedChannels() []string {
+	return MarkupMentionedChannels(m.Markup())
+}
+
+// MarkupMentions returns mentioned uids in tokens, see RTMMessage.Mentions.
+func MarkupMentions(tokens []MarkupToken) []string {
+	return markup.Mentions(tokens)
+}
+
+// MarkupMentionsAll tells if tokens mention everyone in channel.
+func MarkupMentionsAll(tokens []MarkupToken) bool {
+	return markup.MentionsAll(tokens)
+}
+
+// MarkupMentionedChannels returns referenced channel ids in tokens.
+func MarkupMentionedChannels(tokens []MarkupToken) []string {
+	return markup.MentionedChannels(tokens)
+}
@@ -0,0 +1,76 @@
+package bearychat
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bearyinnovative/bearychat-go/openapi"
+)
+
+func TestRTMMessage_Mentions(t *testing.T) {
+	m := RTMMessage{
+		"text": "@<==bw52O=> **ask @<==bw52P=>** and @<==bw52O=> `@<==bw52R=>` in #<==bw52Q=> @<-channel->",
+	}
+
+	if mentions := m.Mentions(); !reflect.DeepEqual(mentions, []string{"=bw52O", "=bw52P"}) {
+		t.Errorf("unexpected mentions: %+v", mentions)
+	}
+	if !m.MentionsAll() {
+		t.Errorf("should mention all")
+	}
+	if channels := m.MentionedChannels(); !reflect.DeepEqual(channels, []string{"=bw52Q"}) {
+		t.Errorf("unexpected channels: %+v", channels)
+	}
+
+	m["text"] = "hello"
+	if len(m.Mentions()) != 0 || m.MentionsAll() || len(m.MentionedChannels()) != 0 {
+		t.Errorf("unexpected mentions: %+v", m)
+	}
+}
+
+func TestMentions_OpenAPIMessage(t *testing.T) {
+	texts := []string{
+		"@<==bw52O=> **ask @<==bw52P=>** and @<==bw52O=> `@<==bw52R=>` in #<==bw52Q=> @<-channel->",
+		"```\n@<==bw52O=> @<-channel->\n``` @<==bw52P=>",
+		"[@<==bw52O=>](http://x) [#<==bw52Q=>](http://x)",
+		"\\`@<==bw52O=>\\` \\@<-channel->",
+		"~~@<==bw52O=>~~ *#<==bw52Q=>* `unclosed @<==bw52P=>",
+		"",
+	}
+
+	for _, text := range texts {
+		text := text
+		m := RTMMessage{"text": text}
+		history := openapi.Message{Text: &text}
+
+		if !reflect.DeepEqual(m.Mentions(), history.Mentions()) {
+			t.Errorf("%q: mentions mismatched: %+v, %+v", text, m.Mentions(), history.Mentions())
+		}
+		if m.MentionsAll() != history.MentionsAll() {
+			t.Errorf("%q: mentions all mismatched", text)
+		}
+		if !reflect.DeepEqual(m.MentionedChannels(), history.MentionedChannels()) {
+			t.Errorf("%q: channels mismatched", text)
+		}
+	}
+
+	if mentions := (openapi.Message{}).Mentions(); mentions != nil {
+		t.Errorf("unexpected mentions: %+v", mentions)
+	}
+}
+
+func TestMentionUser(t *testing.T) {
+	u := User{Id: "=bw52O"}
+	text := MentionUser(u) + MentionAll() + MentionChannel("=bw52Q") + "hi"
+	if text != "@<==bw52O=> @<-channel-> #<==bw52Q=> hi" {
+		t.Errorf("unexpected text: %s", text)
+	}
+
+	m := RTMMessage{"text": text}
+	if mentioned, content := m.ParseMentionUser(u); !mentioned || content != "@<-channel-> #<==bw52Q=> hi" {
+		t.Errorf("unexpected parsed: %v %s", mentioned, content)
+	}
+	if mentions := m.Mentions(); !reflect.DeepEqual(mentions, []string{u.Id}) {
+		t.Errorf("unexpected mentions: %+v", mentions)
+	}
+}
@@ -0,0 +1,353 @@
+package bearychat
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bearyinnovative/bearychat-go/openapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_MESSAGE_SPLITTER_MAX_LENGTH = 4000
+	MIN_MESSAGE_SPLITTER_MAX_LENGTH     = 32
+)
+
+// MessageUploader uploads the whole text as a file, returns url of
+// the file.
+type MessageUploader func(ctx context.Context, text string) (string, error)
+
+// MessageSplitter splits long text into parts not longer than max length
+// (in characters), so they won't be rejected or truncated. Text is split
+// at paragraphs, lines or words if possible, code blocks are closed and
+// reopened when split inside. Parts are numbered like "(1/3)".
+//
+//      splitter, _ := NewMessageSplitter(WithMessageSplitterMaxLength(2000))
+//      err := splitter.SendRTM(ctx, loop, m.Refer(buildLog))
+type MessageSplitter struct {
+	maxLength int
+	numbered  bool
+
+	upload         MessageUploader
+	uploadMaxParts int
+}
+
+type messageSplitterSetter func(*MessageSplitter) error
+
+// Set max length of parts in characters, defaults to 4000.
+func WithMessageSplitterMaxLength(length int) messageSplitterSetter {
+	return func(s *MessageSplitter) error {
+		if length < MIN_MESSAGE_SPLITTER_MAX_LENGTH {
+			return errors.Errorf("max length should be at least %d", MIN_MESSAGE_SPLITTER_MAX_LENGTH)
+		}
+		s.maxLength = length
+		return nil
+	}
+}
+
+// Number parts or not, defaults to true.
+func WithMessageSplitterNumbering(numbered bool) messageSplitterSetter {
+	return func(s *MessageSplitter) error {
+		s.numbered = numbered
+		return nil
+	}
+}
+
+// Upload the whole text instead if it's split into more than maxParts
+// parts, the url is sent as the only part.
+func WithMessageSplitterUploader(upload MessageUploader, maxParts int) messageSplitterSetter {
+	return func(s *MessageSplitter) error {
+		if upload == nil {
+			return errors.New("uploader should not be nil")
+		}
+		if maxParts < 1 {
+			return errors.New("max parts should be positive")
+		}
+		s.upload = upload
+		s.uploadMaxParts = maxParts
+		return nil
+	}
+}
+
+func NewMessageSplitter(setters ...messageSplitterSetter) (*MessageSplitter, error) {
+	s := &MessageSplitter{
+		maxLength: DEFAULT_MESSAGE_SPLITTER_MAX_LENGTH,
+		numbered:  true,
+	}
+
+	for _, setter := range setters {
+		if err := setter(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Split text into numbered parts.
+func (s *MessageSplitter) Split(text string) []string {
+	if utf8.RuneCountInString(text) <= s.maxLength {
+		return []string{text}
+	}
+	if !s.numbered {
+		return splitMessageText(text, s.maxLength)
+	}
+
+	// reserve space for numbering, retry if count of parts has more
+	// digits than reserved
+	for digits := 1; ; digits = digits + 1 {
+		parts := splitMessageText(text, s.maxLength-(2*digits+4))
+		if len(fmt.Sprint(len(parts))) > digits {
+			continue
+		}
+
+		for i, part := range parts {
+			separator := " "
+			if strings.HasPrefix(part, "```") {
+				separator = "\n"
+			}
+			parts[i] = fmt.Sprintf("(%d/%d)%s%s", i+1, len(parts), separator, part)
+		}
+		return parts
+	}
+}
+
+// Parts splits text, or uploads it if there are too many parts.
+func (s *MessageSplitter) Parts(ctx context.Context, text string) ([]string, error) {
+	parts := s.Split(text)
+	if s.upload == nil || len(parts) <= s.uploadMaxParts {
+		return parts, nil
+	}
+
+	url, err := s.upload(ctx, text)
+	if err != nil {
+		return nil, errors.Wrap(err, "upload message failed")
+	}
+	return []string{url}, nil
+}
+
+// SendRTM sends text of m in parts through the loop in order,
+// attachments are sent with the last part.
+func (s *MessageSplitter) SendRTM(ctx context.Context, loop RTMLoop, m RTMMessage) error {
+	parts, err := s.Parts(ctx, m.Text())
+	if err != nil {
+		return err
+	}
+
+	for i, part := range parts {
+		partial := make(RTMMessage, len(m))
+		for k, v := range m {
+			partial[k] = v
+		}
+		partial["text"] = part
+		if i < len(parts)-1 {
+			delete(partial, "attachments")
+		}
+
+		if err := loop.Send(partial); err != nil {
+			return errors.Wrapf(err, "send part %d/%d failed", i+1, len(parts))
+		}
+	}
+	return nil
+}
+
+// CreateMessages creates text of opt in parts in order, attachments are
+// created with the last part.
+func (s *MessageSplitter) CreateMessages(ctx context.Context, client *openapi.Client, opt *openapi.MessageCreateOptions) ([]*openapi.Message, error) {
+	parts, err := s.Parts(ctx, opt.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*openapi.Message
+	for i, part := range parts {
+		partial := &openapi.MessageCreateOptions{
+			VChannelID: opt.VChannelID,
+			Text:       part,
+		}
+		if i == len(parts)-1 {
+			partial.Attachments = opt.Attachments
+		}
+
+		message, _, err := client.Message.Create(ctx, partial)
+		if err != nil {
+			return messages, errors.Wrapf(err, "create part %d/%d failed", i+1, len(parts))
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// SendIncoming sends text of m in parts through the webhook in order,
+// attachments are sent with the last part.
+func (s *MessageSplitter) SendIncoming(ctx context.Context, client WebhookClient, m Incoming) ([]*WebhookResponse, error) {
+	parts, err := s.Parts(ctx, m.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []*WebhookResponse
+	for i, part := range parts {
+		partial := m
+		partial.Text = part
+		if i < len(parts)-1 {
+			partial.Attachments = nil
+		}
+
+		payload, err := partial.Build()
+		if err != nil {
+			return responses, err
+		}
+		resp, err := client.Send(payload)
+		if err != nil {
+			return responses, errors.Wrapf(err, "send part %d/%d failed", i+1, len(parts))
+		}
+		responses = append(responses, resp)
+		if !resp.IsOk() {
+			return responses, errors.Errorf("send part %d/%d failed: %s", i+1, len(parts), resp.Error)
+		}
+	}
+	return responses, nil
+}
+
+// Split text into parts not longer than limit characters.
+func splitMessageText(text string, limit int) []string {
+	var (
+		parts  []string
+		reopen string // fence reopening code block split in last part
+	)
+	appendPart := func(part string) {
+		if strings.TrimSpace(part) != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	for {
+		body := reopen + text
+		if utf8.RuneCountInString(body) <= limit {
+			appendPart(strings.TrimRight(body, " \n"))
+			return parts
+		}
+
+		end := runeOffset(body, limit)
+		cut := messageTextBoundary(body, len(reopen), end, "\n\n", "\n", " ")
+		fence := openedCodeFence(body[:cut])
+		if fence < 0 {
+			appendPart(strings.TrimRight(body[:cut], " \n"))
+			text = strings.TrimLeft(body[cut:], " \n")
+			reopen = ""
+			continue
+		}
+		if fence > len(reopen) && strings.TrimSpace(body[len(reopen):fence]) != "" {
+			// move the whole code block to next part
+			appendPart(strings.TrimRight(body[:fence], " \n"))
+			text = body[fence:]
+			reopen = ""
+			continue
+		}
+
+		start := len(body)
+		if i := strings.Index(body[fence:], "\n"); i >= 0 {
+			start = fence + i
+		}
+		closing := -1
+		if i := strings.Index(body[fence+3:], "```"); i >= 0 {
+			closing = fence + 3 + i
+		}
+		if closing >= 0 && closing+3 <= end {
+			// the block closes within the part, which ends the part
+			appendPart(strings.TrimRight(body[:closing+3], " \n"))
+			text = strings.TrimLeft(body[closing+3:], " \n")
+			reopen = ""
+			continue
+		}
+
+		// split inside the code block after its opening line, reserve
+		// space for closing fence, and don't go past the closing fence
+		end = runeOffset(body, limit-len("\n```"))
+		if closing >= 0 && closing < end {
+			end = closing
+		}
+		cut = messageTextBoundary(body, start, end, "\n")
+		if cut > start && strings.TrimSpace(body[start:cut]) == "" {
+			// nothing but blank lines, split the long line instead
+			cut = messageTextBoundary(body, cut, end, " ")
+		}
+		parts = append(parts, strings.TrimRight(body[:cut], "\n")+"\n```")
+
+		text = strings.TrimPrefix(body[cut:], "\n")
+		reopen = codeFenceOpening(body[fence:], limit)
+		if strings.HasPrefix(text, "```") {
+			// closed right after the split
+			text = strings.TrimLeft(text[3:], " \n")
+			reopen = ""
+		}
+	}
+}
+
+// Find the last boundary in body[start+1:end], by order of separators.
+// Returns end if not found, moved before backticks around it.
+func messageTextBoundary(body string, start, end int, separators ...string) int {
+	for _, separator := range separators {
+		if start >= end {
+			break
+		}
+		// separator right at end is fine, it's not in the part
+		window := end + len(separator)
+		if window > len(body) {
+			window = len(body)
+		}
+		if i := strings.LastIndex(body[:window], separator); i > start && i <= end {
+			return i
+		}
+	}
+	// don't break fences
+	for end > start+1 && end < len(body) && body[end-1] == '`' && body[end] == '`' {
+		end = end - 1
+	}
+	return end
+}
+
+// Returns offset of the fence opening unclosed code block in text, or -1.
+func openedCodeFence(text string) int {
+	opened := -1
+	for i := 0; i < len(text); {
+		j := strings.Index(text[i:], "```")
+		if j < 0 {
+			break
+		}
+		if opened < 0 {
+			opened = i + j
+		} else {
+			opened = -1
+		}
+		i = i + j + 3
+	}
+	return opened
+}
+
+// Returns the opening line of code block starting with fence, language
+// is dropped if too long.
+func codeFenceOpening(block string, limit int) string {
+	line := block
+	if i := strings.Index(block, "\n"); i >= 0 {
+		line = block[:i]
+	}
+	if strings.ContainsAny(line[3:], " \t`") || utf8.RuneCountInString(line) > limit/4 {
+		line = "```"
+	}
+	return line + "\n"
+}
+
+// Byte offset of the n-th character.
+func runeOffset(text string, n int) int {
+	for i := range text {
+		if n == 0 {
+			return i
+		}
+		n = n - 1
+	}
+	return len(text)
+}
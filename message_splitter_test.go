@@ -0,0 +1,280 @@
+package bearychat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/bearyinnovative/bearychat-go/openapi"
+	"github.com/pkg/errors"
+)
+
+func newTestMessageSplitter(t *testing.T, setters ...messageSplitterSetter) *MessageSplitter {
+	s, err := NewMessageSplitter(setters...)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	return s
+}
+
+func TestMessageSplitter_Split(t *testing.T) {
+	s := newTestMessageSplitter(t, WithMessageSplitterMaxLength(40), WithMessageSplitterNumbering(false))
+
+	cases := []struct {
+		text  string
+		parts []string
+	}{
+		{"short", []string{"short"}},
+		{
+			"first paragraph is here\n\nsecond paragraph is here",
+			[]string{"first paragraph is here", "second paragraph is here"},
+		},
+		{
+			"line one is here\nline two is here\nline three is here",
+			[]string{"line one is here\nline two is here", "line three is here"},
+		},
+		{
+			"words words words words words words words words",
+			[]string{"words words words words words words", "words words"},
+		},
+		{
+			strings.Repeat("中", 50),
+			[]string{strings.Repeat("中", 40), strings.Repeat("中", 10)},
+		},
+		{
+			"see the log:\n```go\nline 1\nline 2\n```\ndone",
+			[]string{"see the log:\n```go\nline 1\nline 2\n```", "done"},
+		},
+		{
+			"see the log:\n```go\nline 1\nline 2\nline 3\n```",
+			[]string{"see the log:", "```go\nline 1\nline 2\nline 3\n```"},
+		},
+		{
+			"```\naaaaaaaaaa\nbbbbbbbbbb\ncccccccccc\ndddddddddd\n```",
+			[]string{"```\naaaaaaaaaa\nbbbbbbbbbb\ncccccccccc\n```", "```\ndddddddddd\n```"},
+		},
+	}
+
+	for _, c := range cases {
+		if parts := s.Split(c.text); !reflect.DeepEqual(parts, c.parts) {
+			t.Errorf("%q: expected %q, got %q", c.text, c.parts, parts)
+		}
+	}
+
+	// block closed before the boundary isn't reopened
+	s = newTestMessageSplitter(t, WithMessageSplitterMaxLength(32), WithMessageSplitterNumbering(false))
+	text := "```\nfoo\n\nbar\n```\nplain text after the block that is long"
+	expected := []string{"```\nfoo\n\nbar\n```", "plain text after the block that", "is long"}
+	if parts := s.Split(text); !reflect.DeepEqual(parts, expected) {
+		t.Errorf("%q: expected %q, got %q", text, expected, parts)
+	}
+}
+
+func TestMessageSplitter_Split_Numbered(t *testing.T) {
+	s := newTestMessageSplitter(t, WithMessageSplitterMaxLength(40))
+
+	parts := s.Split("line one is here\nline two is here\n```\nline three is here\n```")
+	expected := []string{
+		"(1/2) line one is here\nline two is here",
+		"(2/2)\n```\nline three is here\n```",
+	}
+	if !reflect.DeepEqual(parts, expected) {
+		t.Errorf("unexpected parts: %q", parts)
+	}
+
+	// reserves more digits
+	parts = s.Split(strings.Repeat("word ", 200))
+	if len(parts) < 10 || !strings.HasPrefix(parts[0], fmt.Sprintf("(1/%d) ", len(parts))) {
+		t.Errorf("unexpected parts: %q", parts)
+	}
+	for _, part := range parts {
+		if n := utf8.RuneCountInString(part); n > 40 {
+			t.Errorf("part too long (%d): %q", n, part)
+		}
+	}
+}
+
+var testMessageSplitterPrefix = regexp.MustCompile(`^\(\d+/\d+\)[ \n]`)
+
+func TestMessageSplitter_Split_Properties(t *testing.T) {
+	texts := []string{
+		strings.Repeat("日志 log line with 中文 and emoji 🎉\n", 30),
+		"intro\n```python\n" + strings.Repeat("print('hello 世界')\n", 20) + "```\noutro " + strings.Repeat("x", 100),
+		strings.Repeat("```\ncode\n```\ntext\n", 10) + strings.Repeat("🎉", 77),
+		"```\n" + strings.Repeat("a", 200) + "\n```",
+		"```\nfoo\n\nbar\n```\nplain text after the block that is long",
+		"x```go\n\n\nfoo plain text after the block that is long\n\nbar```go```go```🎉 x",
+	}
+
+	for _, length := range []int{32, 50, 97} {
+		s := newTestMessageSplitter(t, WithMessageSplitterMaxLength(length))
+		for _, text := range texts {
+			var joined []string
+			for _, part := range s.Split(text) {
+				if n := utf8.RuneCountInString(part); n > length {
+					t.Errorf("%d: part too long (%d): %q", length, n, part)
+				}
+				if !utf8.ValidString(part) {
+					t.Errorf("%d: invalid utf8: %q", length, part)
+				}
+				if strings.Count(part, "```")%2 != 0 {
+					t.Errorf("%d: unbalanced fences: %q", length, part)
+				}
+				joined = append(joined, testMessageSplitterPrefix.ReplaceAllString(part, ""))
+			}
+
+			// no content lost, fences & whitespaces may be added
+			strip := func(s string) string {
+				return strings.Join(strings.Fields(strings.Replace(regexp.MustCompile("```[a-z]*").ReplaceAllString(s, ""), "\n", " ", -1)), "")
+			}
+			if strip(strings.Join(joined, "\n")) != strip(text) {
+				t.Errorf("%d: content changed: %q", length, joined)
+			}
+		}
+	}
+}
+
+func TestMessageSplitter_Upload(t *testing.T) {
+	var uploaded string
+	s := newTestMessageSplitter(
+		t,
+		WithMessageSplitterMaxLength(40),
+		WithMessageSplitterUploader(func(ctx context.Context, text string) (string, error) {
+			uploaded = text
+			return "https://files.example.com/1", nil
+		}, 2),
+	)
+
+	text := strings.Repeat("word ", 12)
+	if parts, err := s.Parts(context.Background(), text); err != nil || len(parts) != 2 {
+		t.Errorf("unexpected parts: %q %v", parts, err)
+	}
+	if uploaded != "" {
+		t.Errorf("should not upload")
+	}
+
+	text = strings.Repeat("word ", 50)
+	parts, err := s.Parts(context.Background(), text)
+	if err != nil || !reflect.DeepEqual(parts, []string{"https://files.example.com/1"}) || uploaded != text {
+		t.Errorf("unexpected parts: %q %v", parts, err)
+	}
+
+	failed := newTestMessageSplitter(
+		t,
+		WithMessageSplitterMaxLength(40),
+		WithMessageSplitterUploader(func(ctx context.Context, text string) (string, error) {
+			return "", errors.New("boom")
+		}, 1),
+	)
+	if _, err := failed.Parts(context.Background(), text); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestMessageSplitter_SendRTM(t *testing.T) {
+	s := newTestMessageSplitter(t, WithMessageSplitterMaxLength(40))
+	loop := newTestRTMLoop()
+
+	m := newRTMP2PMessage("=bw52O", "=bw52O", strings.Repeat("word ", 12))
+	m["attachments"] = []IncomingAttachment{{Text: "attachment"}}
+	if err := s.SendRTM(context.Background(), loop, m); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if len(loop.sent) != 2 {
+		t.Fatalf("unexpected sent: %+v", loop.sent)
+	}
+	if !strings.HasPrefix(loop.sent[0].Text(), "(1/2) ") || loop.sent[0]["attachments"] != nil {
+		t.Errorf("unexpected first part: %+v", loop.sent[0])
+	}
+	if !strings.HasPrefix(loop.sent[1].Text(), "(2/2) ") || loop.sent[1]["attachments"] == nil {
+		t.Errorf("unexpected last part: %+v", loop.sent[1])
+	}
+	if loop.sent[1]["to_uid"] != "=bw52O" || m.Text() != strings.Repeat("word ", 12) {
+		t.Errorf("message should be copied")
+	}
+}
+
+func TestMessageSplitter_CreateMessages(t *testing.T) {
+	var texts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opt := new(openapi.MessageCreateOptions)
+		json.NewDecoder(r.Body).Decode(opt)
+		texts = append(texts, opt.Text)
+		json.NewEncoder(w).Encode(openapi.Message{Text: &opt.Text})
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL + "/")
+	client := openapi.NewClient("token", openapi.NewClientWithBaseURL(base))
+	s := newTestMessageSplitter(t, WithMessageSplitterMaxLength(40))
+
+	messages, err := s.CreateMessages(context.Background(), client, &openapi.MessageCreateOptions{
+		VChannelID: "=bw52O",
+		Text:       strings.Repeat("word ", 12),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(messages) != 2 || len(texts) != 2 || *messages[1].Text != texts[1] || !strings.HasPrefix(texts[0], "(1/2) ") {
+		t.Errorf("unexpected messages: %q", texts)
+	}
+}
+
+type testWebhookClient struct {
+	sent []Incoming
+}
+
+func (c *testWebhookClient) SetWebhook(webhook string) WebhookClient  { return c }
+func (c *testWebhookClient) SetHTTPClient(*http.Client) WebhookClient { return c }
+
+func (c *testWebhookClient) Send(payload io.Reader) (*WebhookResponse, error) {
+	var m Incoming
+	if err := json.NewDecoder(payload).Decode(&m); err != nil {
+		return nil, err
+	}
+	c.sent = append(c.sent, m)
+	return &WebhookResponse{}, nil
+}
+
+func TestMessageSplitter_SendIncoming(t *testing.T) {
+	s := newTestMessageSplitter(t, WithMessageSplitterMaxLength(40))
+	client := &testWebhookClient{}
+
+	responses, err := s.SendIncoming(context.Background(), client, Incoming{
+		Text:        strings.Repeat("word ", 12),
+		Markdown:    true,
+		Attachments: []IncomingAttachment{{Text: "attachment"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(responses) != 2 || len(client.sent) != 2 {
+		t.Fatalf("unexpected sent: %+v", client.sent)
+	}
+	if !client.sent[0].Markdown || client.sent[0].Attachments != nil || len(client.sent[1].Attachments) != 1 {
+		t.Errorf("unexpected sent: %+v", client.sent)
+	}
+}
+
+func TestNewMessageSplitter_Invalid(t *testing.T) {
+	invalids := []messageSplitterSetter{
+		WithMessageSplitterMaxLength(10),
+		WithMessageSplitterUploader(nil, 1),
+		WithMessageSplitterUploader(func(context.Context, string) (string, error) { return "", nil }, 0),
+	}
+	for i, setter := range invalids {
+		if _, err := NewMessageSplitter(setter); err == nil {
+			t.Errorf("#%d: expected error", i)
+		}
+	}
+}
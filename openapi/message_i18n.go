@@ -0,0 +1,78 @@
+package openapi
+
+import (
+	"sort"
+	"strings"
+)
+
+// LocalizedText returns text in the best matched locale of preferred ones,
+// or Text if none matched, see MatchLocale.
+//
+//      message.LocalizedText("zh-TW", "en")
+func (m Message) LocalizedText(preferred ...string) string {
+	if m.TextI18n != nil {
+		texts := *m.TextI18n
+		locales := make([]string, 0, len(texts))
+		for locale := range texts {
+			locales = append(locales, locale)
+		}
+		if locale := MatchLocale(locales, preferred...); locale != "" {
+			return texts[locale]
+		}
+	}
+
+	if m.Text == nil {
+		return ""
+	}
+	return *m.Text
+}
+
+// MatchLocale returns the best available locale for preferred ones in
+// order, or empty string if none matched. Locales are compared case
+// insensitively, `_` and `-` are the same. For each preferred locale:
+//
+// - the same locale is the best
+// - the language without region, e.g. "zh" for "zh-TW"
+// - the same language of other regions, e.g. "zh-CN" for "zh-TW"
+func MatchLocale(available []string, preferred ...string) string {
+	sorted := make([]string, len(available))
+	copy(sorted, available)
+	sort.Strings(sorted)
+
+	for _, p := range preferred {
+		p = normalizeLocale(p)
+		language := localeLanguage(p)
+		if p == "" {
+			continue
+		}
+
+		sameLanguage := ""
+		for _, locale := range sorted {
+			normalized := normalizeLocale(locale)
+			if normalized == p {
+				return locale
+			}
+			if normalized == language {
+				sameLanguage = locale
+			} else if sameLanguage == "" && localeLanguage(normalized) == language {
+				sameLanguage = locale
+			}
+		}
+		if sameLanguage != "" {
+			return sameLanguage
+		}
+	}
+
+	return ""
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+func localeLanguage(locale string) string {
+	if i := strings.Index(locale, "-"); i >= 0 {
+		return locale[:i]
+	}
+	return locale
+}
@@ -0,0 +1,52 @@
+package openapi
+
+import "testing"
+
+func TestMatchLocale(t *testing.T) {
+	available := []string{"en", "zh-CN", "zh_TW", "ja-JP"}
+	cases := []struct {
+		preferred []string
+		locale    string
+	}{
+		{[]string{"zh-TW"}, "zh_TW"},
+		{[]string{"ZH_cn"}, "zh-CN"},
+		{[]string{"zh-HK"}, "zh-CN"},
+		{[]string{"zh"}, "zh-CN"},
+		{[]string{"ja"}, "ja-JP"},
+		{[]string{"en-US"}, "en"},
+		{[]string{"fr", "en-GB"}, "en"},
+		{[]string{"fr"}, ""},
+		{[]string{"", "ja"}, "ja-JP"},
+		{nil, ""},
+	}
+
+	for _, c := range cases {
+		if locale := MatchLocale(available, c.preferred...); locale != c.locale {
+			t.Errorf("%q: expected %q, got %q", c.preferred, c.locale, locale)
+		}
+	}
+
+	// language without region is preferred
+	if locale := MatchLocale([]string{"zh-CN", "zh", "zh-SG"}, "zh-TW"); locale != "zh" {
+		t.Errorf("unexpected locale: %s", locale)
+	}
+}
+
+func TestMessage_LocalizedText(t *testing.T) {
+	text := "hello"
+	i18n := map[string]string{"en": "hello", "zh-CN": "你好"}
+	m := Message{Text: &text, TextI18n: &i18n}
+
+	if localized := m.LocalizedText("zh-TW", "en"); localized != "你好" {
+		t.Errorf("unexpected text: %s", localized)
+	}
+	if localized := m.LocalizedText("fr"); localized != "hello" {
+		t.Errorf("unexpected text: %s", localized)
+	}
+	if localized := (Message{Text: &text}).LocalizedText("zh"); localized != "hello" {
+		t.Errorf("unexpected text: %s", localized)
+	}
+	if localized := (Message{}).LocalizedText("zh"); localized != "" {
+		t.Errorf("unexpected text: %s", localized)
+	}
+}
@@ -0,0 +1,28 @@
+package openapi
+
+import "github.com/bearyinnovative/bearychat-go/internal/markup"
+
+// Mentions returns mentioned uids in order, without duplication.
+// Mentions in code are ignored.
+func (m Message) Mentions() []string {
+	return markup.Mentions(m.markup())
+}
+
+// MentionsAll tells if everyone in channel is mentioned.
+func (m Message) MentionsAll() bool {
+	return markup.MentionsAll(m.markup())
+}
+
+// MentionedChannels returns referenced channel ids in order, without
+// duplication.
+func (m Message) MentionedChannels() []string {
+	return markup.MentionedChannels(m.markup())
+}
+
+// Tokens of text, parsed the same way as bearychat.ParseMarkup.
+func (m Message) markup() []markup.Token {
+	if m.Text == nil {
+		return nil
+	}
+	return markup.Parse(*m.Text)
+}
@@ -0,0 +1,345 @@
+package bearychat
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bearyinnovative/bearychat-go/openapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_RTM_BACKFILL_LIMIT   = 100
+	DEFAULT_RTM_BACKFILL_TIMEOUT = 30 * time.Second
+)
+
+// RTMBackfillQuerier queries message history, implemented by
+// openapi.MessageService.
+type RTMBackfillQuerier interface {
+	Query(ctx context.Context, opt *openapi.MessageQueryOptions) (*openapi.MessageQueryResult, *http.Response, error)
+}
+
+// RTMVChannelCursor is the last seen message of a vchannel.
+type RTMVChannelCursor struct {
+	Key       string `json:"key"`
+	CreatedTS int64  `json:"created_ts"`
+
+	// for building backfilled messages
+	Type      RTMMessageType `json:"type"`
+	ChannelId string         `json:"channel_id,omitempty"`
+}
+
+// RTMBackfill tracks the last seen message of each vchannel, and fetches
+// messages missed during disconnected from message history.
+//
+//      client := openapi.NewClient(token)
+//      backfill, _ := NewRTMBackfill(client.Message)
+//      loop, _ := NewRTMLoop(wsHost, WithRTMLoopBackfill(backfill))
+//
+// Backfilled messages are flagged, see RTMMessage.IsBackfilled.
+type RTMBackfill struct {
+	querier RTMBackfillQuerier
+	limit   uint
+	timeout time.Duration
+
+	lock    sync.Mutex // lock for cursors
+	cursors map[string]RTMVChannelCursor
+}
+
+type rtmBackfillSetter func(*RTMBackfill) error
+
+// Set max messages fetched for each vchannel, defaults to 100.
+func WithRTMBackfillLimit(limit uint) rtmBackfillSetter {
+	return func(b *RTMBackfill) error {
+		if limit == 0 {
+			return errors.New("backfill limit should be positive")
+		}
+		b.limit = limit
+		return nil
+	}
+}
+
+// Set timeout for fetching all vchannels, defaults to 30 seconds.
+func WithRTMBackfillTimeout(timeout time.Duration) rtmBackfillSetter {
+	return func(b *RTMBackfill) error {
+		if timeout <= 0 {
+			return errors.New("backfill timeout should be positive")
+		}
+		b.timeout = timeout
+		return nil
+	}
+}
+
+func NewRTMBackfill(querier RTMBackfillQuerier, setters ...rtmBackfillSetter) (*RTMBackfill, error) {
+	b := &RTMBackfill{
+		querier: querier,
+		limit:   DEFAULT_RTM_BACKFILL_LIMIT,
+		timeout: DEFAULT_RTM_BACKFILL_TIMEOUT,
+		cursors: make(map[string]RTMVChannelCursor),
+	}
+
+	for _, setter := range setters {
+		if err := setter(b); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// Track updates vchannel cursor with a received chat message.
+func (b *RTMBackfill) Track(m RTMMessage) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	advanceRTMVChannelCursor(b.cursors, m)
+}
+
+// Move vchannel cursor to the chat message if it's newer.
+func advanceRTMVChannelCursor(cursors map[string]RTMVChannelCursor, m RTMMessage) {
+	if !m.IsChatMessage() {
+		return
+	}
+
+	vchannelId, _ := m["vchannel_id"].(string)
+	key, _ := m["key"].(string)
+	createdTS := m.CreatedTS()
+	if vchannelId == "" || key == "" || createdTS == 0 {
+		return
+	}
+
+	if cursor, present := cursors[vchannelId]; present && cursor.CreatedTS > createdTS {
+		return
+	}
+
+	channelId, _ := m["channel_id"].(string)
+	cursors[vchannelId] = RTMVChannelCursor{
+		Key:       key,
+		CreatedTS: createdTS,
+		Type:      m.Type(),
+		ChannelId: channelId,
+	}
+}
+
+// Cursors returns a copy of tracked cursors by vchannel id.
+func (b *RTMBackfill) Cursors() map[string]RTMVChannelCursor {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	cursors := make(map[string]RTMVChannelCursor, len(b.cursors))
+	for vchannelId, cursor := range b.cursors {
+		cursors[vchannelId] = cursor
+	}
+	return cursors
+}
+
+// Restore replaces tracked cursors.
+func (b *RTMBackfill) Restore(cursors map[string]RTMVChannelCursor) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.cursors = make(map[string]RTMVChannelCursor, len(cursors))
+	for vchannelId, cursor := range cursors {
+		b.cursors[vchannelId] = cursor
+	}
+}
+
+// Fetch returns messages after tracked cursors, ordered by created time in
+// each vchannel. Cursors are advanced to fetched messages.
+// Failed vchannels are skipped and the first error is returned. Vchannels
+// missed more than limit messages are fetched up to the limit, and
+// reported by the error as well.
+func (b *RTMBackfill) Fetch(ctx context.Context) ([]RTMMessage, error) {
+	return b.fetch(ctx, b.Cursors())
+}
+
+// Fetch messages after given cursors.
+func (b *RTMBackfill) fetch(ctx context.Context, cursors map[string]RTMVChannelCursor) ([]RTMMessage, error) {
+	var (
+		messages []RTMMessage
+		firstErr error
+	)
+
+	for vchannelId, cursor := range cursors {
+		fetched, truncated, err := b.fetchVChannel(ctx, vchannelId, cursor)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "backfill vchannel %s failed", vchannelId)
+			}
+			continue
+		}
+		if truncated && firstErr == nil {
+			firstErr = errors.Errorf("backfill vchannel %s truncated at %d messages", vchannelId, b.limit)
+		}
+
+		for _, m := range fetched {
+			b.Track(m)
+		}
+		messages = append(messages, fetched...)
+	}
+
+	return messages, firstErr
+}
+
+// Fetch messages of the vchannel after cursor, tells if there may be more
+// than limit messages.
+func (b *RTMBackfill) fetchVChannel(ctx context.Context, vchannelId string, cursor RTMVChannelCursor) ([]RTMMessage, bool, error) {
+	sinceTS := openapi.VChannelTS(cursor.CreatedTS)
+	result, _, err := b.querier.Query(ctx, &openapi.MessageQueryOptions{
+		VChannelID: vchannelId,
+		Query: &openapi.MessageQuery{
+			Since: &openapi.MessageQueryBySince{
+				SinceTS: &sinceTS,
+				Forward: openapi.MessageQueryWithForward(b.limit),
+			},
+		},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	var messages []RTMMessage
+	for _, message := range result.Messages {
+		m := newRTMBackfilledMessage(vchannelId, cursor, message)
+		if m["key"] == cursor.Key || m.CreatedTS() < cursor.CreatedTS {
+			continue
+		}
+		messages = append(messages, m)
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].CreatedTS() < messages[j].CreatedTS()
+	})
+
+	return messages, uint(len(result.Messages)) >= b.limit, nil
+}
+
+// Build a RTM message from history message.
+func newRTMBackfilledMessage(vchannelId string, cursor RTMVChannelCursor, message *openapi.Message) RTMMessage {
+	m := RTMMessage{
+		"type":        cursor.Type,
+		"vchannel_id": vchannelId,
+		"backfilled":  true,
+	}
+	if cursor.ChannelId != "" {
+		m["channel_id"] = cursor.ChannelId
+	}
+	if message.Key != nil {
+		m["key"] = string(*message.Key)
+	}
+	if message.UID != nil {
+		m["uid"] = *message.UID
+	}
+	if message.Text != nil {
+		m["text"] = *message.Text
+	}
+	if message.ReferKey != nil {
+		m["refer_key"] = *message.ReferKey
+	}
+	if message.Subtype != nil {
+		m["subtype"] = string(*message.Subtype)
+	}
+	if message.CreatedTS != nil {
+		m["created_ts"] = int64(*message.CreatedTS)
+	}
+
+	return m
+}
+
+// Set backfill for fetching missed messages after restarted.
+// Received chat messages are tracked by the backfill, and held until
+// missed messages are delivered.
+func WithRTMLoopBackfill(backfill *RTMBackfill) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		r.backfill = backfill
+		return nil
+	}
+}
+
+// Fetch missed messages in background, returns the function delivering
+// received messages. Received messages are held until missed ones are
+// delivered, so the socket is kept read while fetching.
+func (l *rtmLoop) startBackfill(closeC chan struct{}) func(RTMMessage) {
+	var (
+		lock       sync.Mutex
+		delivered  bool
+		held       []RTMMessage    // received before delivered
+		backfilled map[string]bool // keys of delivered missed messages
+	)
+
+	// cursors are taken before any message received, or missed messages
+	// would be skipped
+	cursors := l.backfill.Cursors()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), l.backfill.timeout)
+		defer cancel()
+		go func() {
+			select {
+			case <-closeC:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		messages, err := l.backfill.fetch(ctx, cursors)
+		if err != nil {
+			l.deliverError(
+				&RTMLoopError{Kind: ErrRTMLoopBackfill, Err: err},
+				closeC,
+			)
+		}
+
+		keys := make(map[string]bool, len(messages))
+		for _, m := range messages {
+			if key, _ := m["key"].(string); key != "" {
+				keys[key] = true
+			}
+		}
+		lock.Lock()
+		backfilled = keys
+		lock.Unlock()
+
+		for _, m := range messages {
+			l.deliverMessage(m, closeC)
+		}
+
+		// deliver held messages until no more held, messages received
+		// after reconnected are fetched as well, which are skipped
+		for {
+			lock.Lock()
+			pending := held
+			held = nil
+			delivered = len(pending) == 0
+			lock.Unlock()
+
+			if delivered {
+				return
+			}
+			for _, m := range pending {
+				if key, _ := m["key"].(string); !backfilled[key] {
+					l.deliverMessage(m, closeC)
+				}
+			}
+		}
+	}()
+
+	return func(m RTMMessage) {
+		lock.Lock()
+		if !delivered {
+			held = append(held, m)
+			lock.Unlock()
+			return
+		}
+		key, _ := m["key"].(string)
+		duplicated := backfilled[key]
+		lock.Unlock()
+
+		if !duplicated {
+			l.deliverMessage(m, closeC)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package bearychat
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bearyinnovative/bearychat-go/openapi"
+)
+
+type testRTMBackfillQuerier struct {
+	messages map[string][]*openapi.Message
+	queries  []*openapi.MessageQueryOptions
+}
+
+func (q *testRTMBackfillQuerier) Query(ctx context.Context, opt *openapi.MessageQueryOptions) (*openapi.MessageQueryResult, *http.Response, error) {
+	q.queries = append(q.queries, opt)
+
+	messages, present := q.messages[opt.VChannelID]
+	if !present {
+		return nil, nil, errors.New("vchannel not found")
+	}
+	return &openapi.MessageQueryResult{Messages: messages}, nil, nil
+}
+
+func newTestHistoryMessage(key string, createdTS int64, text string) *openapi.Message {
+	messageKey := openapi.MessageKey(key)
+	ts := openapi.VChannelTS(createdTS)
+	uid := "=bw52O"
+	return &openapi.Message{
+		Key:       &messageKey,
+		CreatedTS: &ts,
+		Text:      &text,
+		UID:       &uid,
+	}
+}
+
+func TestRTMBackfill_Track(t *testing.T) {
+	b, err := NewRTMBackfill(&testRTMBackfillQuerier{})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	b.Track(RTMMessage{"type": RTMMessageTypePong})
+	b.Track(RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"vchannel_id": "a",
+		"channel_id":  "a",
+		"key":         "2",
+		"created_ts":  float64(2),
+	})
+	b.Track(RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"vchannel_id": "a",
+		"key":         "1",
+		"created_ts":  float64(1),
+	})
+
+	cursors := b.Cursors()
+	if len(cursors) != 1 {
+		t.Fatalf("unexpected cursors: %+v", cursors)
+	}
+	expected := RTMVChannelCursor{
+		Key:       "2",
+		CreatedTS: 2,
+		Type:      RTMMessageTypeChannelMessage,
+		ChannelId: "a",
+	}
+	if cursors["a"] != expected {
+		t.Errorf("unexpected cursor: %+v", cursors["a"])
+	}
+}
+
+func TestRTMBackfill_Fetch(t *testing.T) {
+	q := &testRTMBackfillQuerier{
+		messages: map[string][]*openapi.Message{
+			"a": {
+				newTestHistoryMessage("4", 4, "four"),
+				newTestHistoryMessage("2", 2, "two"),
+				newTestHistoryMessage("3", 3, "three"),
+			},
+		},
+	}
+	b, err := NewRTMBackfill(q, WithRTMBackfillLimit(10))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	b.Restore(map[string]RTMVChannelCursor{
+		"a": {Key: "2", CreatedTS: 2, Type: RTMMessageTypeP2PMessage},
+		"b": {Key: "1", CreatedTS: 1, Type: RTMMessageTypeP2PMessage},
+	})
+
+	messages, err := b.Fetch(context.Background())
+	if err == nil {
+		t.Errorf("expected error for vchannel b")
+	}
+	if len(messages) != 2 {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+	for i, text := range []string{"three", "four"} {
+		m := messages[i]
+		if m.Text() != text || !m.IsBackfilled() || m.Type() != RTMMessageTypeP2PMessage {
+			t.Errorf("unexpected message: %+v", m)
+		}
+		if m["vchannel_id"] != "a" {
+			t.Errorf("unexpected message: %+v", m)
+		}
+	}
+
+	if cursor := b.Cursors()["a"]; cursor.Key != "4" || cursor.CreatedTS != 4 {
+		t.Errorf("cursor should be advanced: %+v", cursor)
+	}
+
+	for _, opt := range q.queries {
+		if opt.VChannelID != "a" {
+			continue
+		}
+		since := opt.Query.Since
+		if *since.SinceTS != 2 || *since.Forward != 10 {
+			t.Errorf("unexpected query: %+v", since)
+		}
+	}
+}
+
+func TestRTMBackfill_Fetch_Truncated(t *testing.T) {
+	q := &testRTMBackfillQuerier{
+		messages: map[string][]*openapi.Message{
+			"a": {
+				newTestHistoryMessage("2", 2, "two"),
+				newTestHistoryMessage("3", 3, "three"),
+			},
+		},
+	}
+	b, err := NewRTMBackfill(q, WithRTMBackfillLimit(2))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	b.Restore(map[string]RTMVChannelCursor{
+		"a": {Key: "1", CreatedTS: 1, Type: RTMMessageTypeP2PMessage},
+	})
+
+	messages, err := b.Fetch(context.Background())
+	if err == nil {
+		t.Errorf("expected error for truncated vchannel")
+	}
+	if len(messages) != 2 {
+		t.Errorf("unexpected messages: %+v", messages)
+	}
+}
+
+func TestRTMLoop_Backfill(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	q := &testRTMBackfillQuerier{
+		messages: map[string][]*openapi.Message{
+			"a": {newTestHistoryMessage("2", 2, "missed")},
+		},
+	}
+	b, err := NewRTMBackfill(q)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	b.Restore(map[string]RTMVChannelCursor{
+		"a": {Key: "1", CreatedTS: 1, Type: RTMMessageTypeChannelMessage},
+	})
+
+	l, err := NewRTMLoop(s.WSHost(), WithRTMLoopBackfill(b))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	conn := <-s.conns
+	conn.WriteJSON(RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"vchannel_id": "a",
+		"key":         "3",
+		"created_ts":  3,
+		"text":        "live",
+	})
+
+	messageC, err := l.ReadC()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	for _, text := range []string{"missed", "live"} {
+		select {
+		case m := <-messageC:
+			if m.Text() != text {
+				t.Errorf("unexpected message: %+v", m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected message: %s", text)
+		}
+	}
+
+	if cursor := b.Cursors()["a"]; cursor.Key != "3" {
+		t.Errorf("unexpected cursor: %+v", cursor)
+	}
+}
+
+// Blocks queries until released.
+type testBlockingBackfillQuerier struct {
+	testRTMBackfillQuerier
+	releaseC chan struct{}
+}
+
+func (q *testBlockingBackfillQuerier) Query(ctx context.Context, opt *openapi.MessageQueryOptions) (*openapi.MessageQueryResult, *http.Response, error) {
+	select {
+	case <-q.releaseC:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	return q.testRTMBackfillQuerier.Query(ctx, opt)
+}
+
+func TestRTMLoop_Backfill_KeepsReading(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	q := &testBlockingBackfillQuerier{
+		testRTMBackfillQuerier: testRTMBackfillQuerier{
+			messages: map[string][]*openapi.Message{
+				"a": {newTestHistoryMessage("2", 2, "missed")},
+			},
+		},
+		releaseC: make(chan struct{}),
+	}
+	b, err := NewRTMBackfill(q)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	b.Restore(map[string]RTMVChannelCursor{
+		"a": {Key: "1", CreatedTS: 1, Type: RTMMessageTypeChannelMessage},
+	})
+
+	l, err := NewRTMLoop(s.WSHost(), WithRTMLoopBackfill(b), WithRTMLoopBacklog(10))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	conn := <-s.conns
+	for i, text := range []string{"live 1", "live 2"} {
+		conn.WriteJSON(RTMMessage{
+			"type":        RTMMessageTypeChannelMessage,
+			"vchannel_id": "a",
+			"key":         text,
+			"created_ts":  3 + i,
+			"text":        text,
+		})
+	}
+
+	// live messages are read while fetching, but held
+	deadline := time.Now().Add(time.Second)
+	for b.Cursors()["a"].Key != "live 2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("socket should be read while fetching")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	messageC, _ := l.ReadC()
+	select {
+	case m := <-messageC:
+		t.Errorf("live message should be held: %+v", m)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(q.releaseC)
+	for _, text := range []string{"missed", "live 1", "live 2"} {
+		select {
+		case m := <-messageC:
+			if m.Text() != text {
+				t.Errorf("unexpected message: %+v", m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected message: %s", text)
+		}
+	}
+}
+
+func TestRTMLoop_Backfill_SkipsReceived(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	// history has the live message as well
+	q := &testBlockingBackfillQuerier{
+		testRTMBackfillQuerier: testRTMBackfillQuerier{
+			messages: map[string][]*openapi.Message{
+				"a": {
+					newTestHistoryMessage("2", 2, "missed"),
+					newTestHistoryMessage("3", 3, "live"),
+				},
+			},
+		},
+		releaseC: make(chan struct{}),
+	}
+	b, err := NewRTMBackfill(q)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	b.Restore(map[string]RTMVChannelCursor{
+		"a": {Key: "1", CreatedTS: 1, Type: RTMMessageTypeChannelMessage},
+	})
+
+	l, err := NewRTMLoop(s.WSHost(), WithRTMLoopBackfill(b), WithRTMLoopBacklog(10))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	conn := <-s.conns
+	conn.WriteJSON(RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"vchannel_id": "a",
+		"key":         "3",
+		"created_ts":  3,
+		"text":        "live",
+	})
+	deadline := time.Now().Add(time.Second)
+	for b.Cursors()["a"].Key != "3" {
+		if time.Now().After(deadline) {
+			t.Fatalf("live message should be received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(q.releaseC)
+
+	// received again after backfilled
+	conn.WriteJSON(RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"vchannel_id": "a",
+		"key":         "3",
+		"created_ts":  3,
+		"text":        "live",
+	})
+	conn.WriteJSON(RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"vchannel_id": "a",
+		"key":         "4",
+		"created_ts":  4,
+		"text":        "next",
+	})
+
+	messageC, _ := l.ReadC()
+	for _, text := range []string{"missed", "live", "next"} {
+		select {
+		case m := <-messageC:
+			if m.Text() != text {
+				t.Errorf("unexpected message: %+v", m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected message: %s", text)
+		}
+	}
+	select {
+	case m := <-messageC:
+		t.Errorf("message should be delivered once: %+v", m)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
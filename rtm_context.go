@@ -5,32 +5,46 @@ import "time"
 type RTMContext struct {
 	Loop RTMLoop
 
-	uid string
+	uid    string
+	teamId string
+	client *RTMClient
 }
 
 func (c *RTMContext) UID() string {
 	return c.uid
 }
 
-func NewRTMContext(token string) (*RTMContext, error) {
+func (c *RTMContext) TeamId() string {
+	return c.teamId
+}
+
+func NewRTMContext(token string, setters ...rtmLoopSetter) (*RTMContext, error) {
 	rtmClient, err := NewRTMClient(token)
 	if err != nil {
 		return nil, err
 	}
 
+	return NewRTMContextWithClient(rtmClient, setters...)
+}
+
+// NewRTMContextWithClient creates context with a configured client, e.g.
+// using another api base.
+func NewRTMContextWithClient(rtmClient *RTMClient, setters ...rtmLoopSetter) (*RTMContext, error) {
 	user, wsHost, err := rtmClient.Start()
 	if err != nil {
 		return nil, err
 	}
 
-	rtmLoop, err := NewRTMLoop(wsHost)
+	rtmLoop, err := NewRTMLoop(wsHost, setters...)
 	if err != nil {
 		return nil, err
 	}
 
 	return &RTMContext{
-		Loop: rtmLoop,
-		uid:  user.Id,
+		Loop:   rtmLoop,
+		uid:    user.Id,
+		teamId: user.TeamId,
+		client: rtmClient,
 	}, nil
 }
 
@@ -39,7 +53,6 @@ func (c *RTMContext) Run() (error, chan RTMMessage, chan error) {
 	if err != nil {
 		return err, nil, nil
 	}
-	defer c.Loop.Stop()
 
 	go c.Loop.Keepalive(time.NewTicker(10 * time.Second))
 
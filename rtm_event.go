@@ -0,0 +1,171 @@
+package bearychat
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RTMEvent is a typed RTM message, decode one with DecodeRTMEvent.
+//
+//      event, _ := message.Event()
+//      switch e := event.(type) {
+//      case *RTMP2PMessage:
+//              log.Printf("%s said: %s", e.UserId, e.Text)
+//      case *RTMRawEvent:
+//              // unknown message type
+//      }
+type RTMEvent interface {
+	Type() RTMMessageType
+}
+
+// RTMChatMessage contains fields shared by p2p and channel messages.
+type RTMChatMessage struct {
+	Key        string `json:"key"`
+	UserId     string `json:"uid"`
+	VChannelId string `json:"vchannel_id"`
+	Text       string `json:"text"`
+	ReferKey   string `json:"refer_key,omitempty"`
+	Subtype    string `json:"subtype,omitempty"`
+	CreatedTS  int64  `json:"created_ts,omitempty"`
+}
+
+// RTMP2PMessage is a message sent to a user directly.
+type RTMP2PMessage struct {
+	RTMChatMessage
+	ToUserId string `json:"to_uid,omitempty"`
+}
+
+func (RTMP2PMessage) Type() RTMMessageType { return RTMMessageTypeP2PMessage }
+
+// RTMChannelMessage is a message sent to a channel.
+type RTMChannelMessage struct {
+	RTMChatMessage
+	ChannelId string `json:"channel_id"`
+}
+
+func (RTMChannelMessage) Type() RTMMessageType { return RTMMessageTypeChannelMessage }
+
+// RTMP2PTyping tells a user is typing to you.
+type RTMP2PTyping struct {
+	UserId     string `json:"uid"`
+	VChannelId string `json:"vchannel_id"`
+}
+
+func (RTMP2PTyping) Type() RTMMessageType { return RTMMessageTypeP2PTyping }
+
+// RTMChannelTyping tells a user is typing in a channel.
+type RTMChannelTyping struct {
+	UserId     string `json:"uid"`
+	VChannelId string `json:"vchannel_id"`
+	ChannelId  string `json:"channel_id"`
+}
+
+func (RTMChannelTyping) Type() RTMMessageType { return RTMMessageTypeChannelTyping }
+
+// RTMUpdateUserConnection tells a user's connection status changed.
+type RTMUpdateUserConnection struct {
+	Data struct {
+		UserId     string `json:"uid"`
+		Connection string `json:"connection"`
+	} `json:"data"`
+	TS int64 `json:"ts,omitempty"`
+}
+
+func (RTMUpdateUserConnection) Type() RTMMessageType {
+	return RTMMessageTypeUpdateUserConnection
+}
+
+// IsOnline tells user connection status.
+func (e RTMUpdateUserConnection) IsOnline() bool {
+	return e.Data.Connection == "connected"
+}
+
+// RTMReply is the response of a sent message.
+type RTMReply struct {
+	CallId uint64          `json:"call_id"`
+	Code   int             `json:"code"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+func (RTMReply) Type() RTMMessageType { return RTMMessageTypeReply }
+
+// RTMOk acknowledges a sent message.
+type RTMOk struct {
+	CallId uint64 `json:"call_id"`
+}
+
+func (RTMOk) Type() RTMMessageType { return RTMMessageTypeOk }
+
+// RTMPong is the response of a ping.
+type RTMPong struct {
+	CallId uint64 `json:"call_id"`
+}
+
+func (RTMPong) Type() RTMMessageType { return RTMMessageTypePong }
+
+// RTMRawEvent holds messages of unregistered types.
+type RTMRawEvent struct {
+	Message RTMMessage
+}
+
+func (e RTMRawEvent) Type() RTMMessageType { return e.Message.Type() }
+
+var (
+	rtmEventTypesLock = &sync.RWMutex{}
+	rtmEventTypes     = map[RTMMessageType]func() RTMEvent{
+		RTMMessageTypeP2PMessage:           func() RTMEvent { return new(RTMP2PMessage) },
+		RTMMessageTypeChannelMessage:       func() RTMEvent { return new(RTMChannelMessage) },
+		RTMMessageTypeP2PTyping:            func() RTMEvent { return new(RTMP2PTyping) },
+		RTMMessageTypeChannelTyping:        func() RTMEvent { return new(RTMChannelTyping) },
+		RTMMessageTypeUpdateUserConnection: func() RTMEvent { return new(RTMUpdateUserConnection) },
+		RTMMessageTypeReply:                func() RTMEvent { return new(RTMReply) },
+		RTMMessageTypeOk:                   func() RTMEvent { return new(RTMOk) },
+		RTMMessageTypePong:                 func() RTMEvent { return new(RTMPong) },
+	}
+)
+
+// RegisterRTMEventType registers a new event type for decoding, or replaces
+// the builtin one. newEvent should return a pointer for json decoding.
+//
+//      type RTMFooEvent struct { Foo string `json:"foo"` }
+//
+//      func (RTMFooEvent) Type() RTMMessageType { return "foo" }
+//
+//      RegisterRTMEventType("foo", func() RTMEvent { return new(RTMFooEvent) })
+func RegisterRTMEventType(t RTMMessageType, newEvent func() RTMEvent) {
+	rtmEventTypesLock.Lock()
+	defer rtmEventTypesLock.Unlock()
+
+	rtmEventTypes[t] = newEvent
+}
+
+// DecodeRTMEvent decodes a message into registered event type,
+// falls back to RTMRawEvent for unknown types.
+func DecodeRTMEvent(m RTMMessage) (RTMEvent, error) {
+	rtmEventTypesLock.RLock()
+	newEvent, registered := rtmEventTypes[m.Type()]
+	rtmEventTypesLock.RUnlock()
+
+	if !registered {
+		return &RTMRawEvent{Message: m}, nil
+	}
+
+	rawMessage, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode message failed")
+	}
+
+	event := newEvent()
+	if err := json.Unmarshal(rawMessage, event); err != nil {
+		return nil, errors.Wrapf(err, "decode %s event failed", m.Type())
+	}
+
+	return event, nil
+}
+
+// Event decodes message into typed event.
+func (m RTMMessage) Event() (RTMEvent, error) {
+	return DecodeRTMEvent(m)
+}
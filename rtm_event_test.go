@@ -0,0 +1,161 @@
+package bearychat
+
+import "testing"
+
+func TestDecodeRTMEvent_P2PMessage(t *testing.T) {
+	m := RTMMessage{
+		"type":        RTMMessageTypeP2PMessage,
+		"key":         "foo",
+		"uid":         "=bw52O",
+		"to_uid":      "=bw52P",
+		"vchannel_id": "=bw52O=bw52P",
+		"text":        "hello",
+		"refer_key":   nil,
+		"created_ts":  1485236262366,
+	}
+
+	event, err := m.Event()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	e, ok := event.(*RTMP2PMessage)
+	if !ok {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if e.Type() != RTMMessageTypeP2PMessage {
+		t.Errorf("unexpected type: %s", e.Type())
+	}
+	if e.Key != "foo" || e.UserId != "=bw52O" || e.ToUserId != "=bw52P" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if e.Text != "hello" || e.CreatedTS != 1485236262366 {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+func TestDecodeRTMEvent_ChannelMessage(t *testing.T) {
+	m := RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"uid":         "=bw52O",
+		"channel_id":  "=bw52Q",
+		"vchannel_id": "=bw52Q",
+		"text":        "hello",
+	}
+
+	event, err := DecodeRTMEvent(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	e, ok := event.(*RTMChannelMessage)
+	if !ok {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if e.ChannelId != "=bw52Q" || e.VChannelId != "=bw52Q" || e.Text != "hello" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+func TestDecodeRTMEvent_Builtin(t *testing.T) {
+	cases := []struct {
+		m     RTMMessage
+		check func(RTMEvent) bool
+	}{
+		{
+			RTMMessage{"type": RTMMessageTypeP2PTyping, "uid": "=bw52O"},
+			func(e RTMEvent) bool { return e.(*RTMP2PTyping).UserId == "=bw52O" },
+		},
+		{
+			RTMMessage{"type": RTMMessageTypeChannelTyping, "channel_id": "=bw52Q"},
+			func(e RTMEvent) bool { return e.(*RTMChannelTyping).ChannelId == "=bw52Q" },
+		},
+		{
+			RTMMessage{
+				"type": RTMMessageTypeUpdateUserConnection,
+				"data": map[string]interface{}{
+					"uid":        "=bw52O",
+					"connection": "connected",
+				},
+			},
+			func(e RTMEvent) bool {
+				u := e.(*RTMUpdateUserConnection)
+				return u.Data.UserId == "=bw52O" && u.IsOnline()
+			},
+		},
+		{
+			RTMMessage{"type": RTMMessageTypeReply, "call_id": 1, "code": 0},
+			func(e RTMEvent) bool { return e.(*RTMReply).CallId == 1 },
+		},
+		{
+			RTMMessage{"type": RTMMessageTypeOk, "call_id": 2},
+			func(e RTMEvent) bool { return e.(*RTMOk).CallId == 2 },
+		},
+		{
+			RTMMessage{"type": RTMMessageTypePong, "call_id": 3},
+			func(e RTMEvent) bool { return e.(*RTMPong).CallId == 3 },
+		},
+	}
+
+	for _, c := range cases {
+		event, err := c.m.Event()
+		if err != nil {
+			t.Errorf("unexpected error: %+v", err)
+			continue
+		}
+		if event.Type() != c.m.Type() {
+			t.Errorf("unexpected type: %s", event.Type())
+		}
+		if !c.check(event) {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	}
+}
+
+func TestDecodeRTMEvent_Raw(t *testing.T) {
+	m := RTMMessage{"type": "foobar", "foo": "bar"}
+
+	event, err := m.Event()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	e, ok := event.(*RTMRawEvent)
+	if !ok {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if e.Type() != "foobar" || e.Message["foo"] != "bar" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+func TestDecodeRTMEvent_Malformed(t *testing.T) {
+	m := RTMMessage{"type": RTMMessageTypeP2PMessage, "uid": 1}
+
+	if _, err := m.Event(); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+type testRTMFooEvent struct {
+	Foo string `json:"foo"`
+}
+
+func (testRTMFooEvent) Type() RTMMessageType { return "test_foo" }
+
+func TestRegisterRTMEventType(t *testing.T) {
+	RegisterRTMEventType("test_foo", func() RTMEvent { return new(testRTMFooEvent) })
+
+	event, err := RTMMessage{"type": "test_foo", "foo": "bar"}.Event()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	e, ok := event.(*testRTMFooEvent)
+	if !ok {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if e.Foo != "bar" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
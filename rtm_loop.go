@@ -1,21 +1,128 @@
 package bearychat
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"time"
 )
 
 type RTMLoopState string
 
 const (
+	// Dialing for the first time or after stopped.
+	RTMLoopStateConnecting RTMLoopState = "connecting"
+	// Connected, messages can be sent and received.
+	RTMLoopStateOpen RTMLoopState = "open"
+	// Dialing again after failed.
+	RTMLoopStateReconnecting RTMLoopState = "reconnecting"
+	// Stopping by Stop.
+	RTMLoopStateClosing RTMLoopState = "closing"
+	// Stopped by Stop, or not started yet.
 	RTMLoopStateClosed RTMLoopState = "closed"
-	RTMLoopStateOpen                = "open"
+	// Stopped because of dialing failure or a fatal error.
+	RTMLoopStateFailed RTMLoopState = "failed"
 )
 
+// RTMLoopStateChange describes a state transition of a loop.
+type RTMLoopStateChange struct {
+	From RTMLoopState
+	To   RTMLoopState
+	// Why the transition happened
+	Reason string
+	// Error caused the transition, only set when failed
+	Err error
+	At  time.Time
+}
+
+// RTMLoopOverflowPolicy decides what to do when the receiving channel is full.
+type RTMLoopOverflowPolicy string
+
+const (
+	// Wait for consumer, socket reading will be stalled.
+	RTMLoopOverflowBlock RTMLoopOverflowPolicy = "block"
+	// Discard the oldest queued message to make room.
+	RTMLoopOverflowDropOldest RTMLoopOverflowPolicy = "drop_oldest"
+	// Discard the incoming message.
+	RTMLoopOverflowDropNewest RTMLoopOverflowPolicy = "drop_newest"
+	// Write incoming messages to a temporary file and deliver them later.
+	RTMLoopOverflowSpillToDisk RTMLoopOverflowPolicy = "spill_to_disk"
+)
+
+var (
+	ErrRTMLoopClosed        = errors.New("rtm loop is closed")
+	ErrRTMLoopSendQueueFull = errors.New("rtm loop send queue is full")
+	ErrRTMLoopOverflow      = errors.New("rtm loop receiving channel overflowed")
+	ErrRTMLoopRateLimited   = errors.New("rtm loop send rate limited")
+	// Sending to the vchannel is paused by circuit breaker.
+	ErrRTMLoopVChannelPaused = errors.New("rtm loop vchannel paused")
+)
+
+// Error classes, errors sent via RTMLoop.ErrC can be matched with errors.Is.
+var (
+	// Loop stopped because of the error, needs restart.
+	ErrRTMLoopFatal = errors.New("rtm loop fatal error")
+	// Loop keeps running, the error is for reporting only.
+	ErrRTMLoopTransient = errors.New("rtm loop transient error")
+)
+
+// Tells if err stops the loop, wrapped errors are matched as well.
+func isRTMLoopFatal(err error) bool {
+	return errors.Is(err, ErrRTMLoopFatal)
+}
+
+// Error kinds.
 var (
-	ErrRTMLoopClosed = errors.New("rtm loop is closed")
+	// Server closed the connection with a close frame (fatal).
+	ErrRTMLoopConnClosed = errors.New("rtm connection closed by server")
+	// Connection lost because of EOF, reset or other network failure (fatal).
+	ErrRTMLoopConnLost = errors.New("rtm connection lost")
+	// Received message exceeds max frame size, connection closed (fatal).
+	ErrRTMLoopFrameTooLarge = errors.New("rtm frame too large")
+	// A frame can't be decoded and is skipped (transient).
+	ErrRTMLoopMalformedMessage = errors.New("rtm message malformed")
+	// Missed messages can't be fetched after restarted (transient).
+	ErrRTMLoopBackfill = errors.New("rtm backfill failed")
+	// Session can't be loaded or saved (transient).
+	ErrRTMLoopSession = errors.New("rtm session store failed")
 )
 
+// RTMLoopStats contains counters of a loop.
+type RTMLoopStats struct {
+	// Messages discarded by overflow policy
+	DroppedMessages uint64
+	// Errors discarded by overflow policy
+	DroppedErrors uint64
+	// Messages written to disk by overflow policy
+	SpilledMessages uint64
+	// Messages queued, rejected or paused by rate limit
+	RateLimitedMessages uint64
+	// Messages dropped as duplicates, see WithRTMLoopDedup
+	DuplicateMessages uint64
+}
+
+// RTMLoopOverflowWarning is sent via error channel when the loop starts
+// dropping or spilling messages. It's not a fatal error.
+type RTMLoopOverflowWarning struct {
+	Policy RTMLoopOverflowPolicy
+	Stats  RTMLoopStats
+}
+
+func (w *RTMLoopOverflowWarning) Error() string {
+	return fmt.Sprintf(
+		"%s (policy: %s, dropped: %d, spilled: %d)",
+		ErrRTMLoopOverflow,
+		w.Policy,
+		w.Stats.DroppedMessages,
+		w.Stats.SpilledMessages,
+	)
+}
+
+// Is reports the warning as a transient ErrRTMLoopOverflow.
+func (w *RTMLoopOverflowWarning) Is(target error) bool {
+	return target == ErrRTMLoopOverflow || target == ErrRTMLoopTransient
+}
+
 // RTMLoop is used to interactive with BearyChat's RTM websocket message protocol.
 type RTMLoop interface {
 	// Connect to RTM, returns after connected
@@ -28,10 +135,16 @@ type RTMLoop interface {
 	Ping() error
 	// Keep connection alive. Closes ticker before return
 	Keepalive(interval *time.Ticker) error
-	// Send a message
+	// Queue a message for sending
 	Send(m RTMMessage) error
+	// Keep sending typing events for replying the message
+	Typing(ctx context.Context, m RTMMessage) error
 	// Get message receiving channel
 	ReadC() (chan RTMMessage, error)
 	// Get error channel
 	ErrC() chan error
+	// Get counters
+	Stats() RTMLoopStats
+	// Subscribe state changes, call the returned func to unsubscribe
+	Subscribe(backlog int) (<-chan RTMLoopStateChange, func())
 }
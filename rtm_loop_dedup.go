@@ -0,0 +1,134 @@
+package bearychat
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Drop received messages with seen keys, remembers at most size keys
+// for ttl. Reconnecting, backfill and server retransmitting may deliver
+// the same message more than once. Keys are remembered after messages
+// delivered, so messages dropped by overflow policy are kept when sent
+// again.
+//
+// Dropped messages are counted in RTMLoopStats.DuplicateMessages.
+func WithRTMLoopDedup(size int, ttl time.Duration) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if size <= 0 {
+			return errors.New("dedup size should be positive")
+		}
+		if ttl <= 0 {
+			return errors.New("dedup ttl should be positive")
+		}
+		r.dedup = newRTMLoopDedup(size, ttl)
+		return nil
+	}
+}
+
+// rtmLoopDedup is a LRU set of message keys with ttl.
+type rtmLoopDedup struct {
+	size int
+	ttl  time.Duration
+
+	lock  sync.Mutex // lock for properties below
+	keys  map[string]*list.Element
+	order *list.List // least recently seen first
+	now   func() time.Time
+}
+
+type rtmLoopDedupEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+func newRTMLoopDedup(size int, ttl time.Duration) *rtmLoopDedup {
+	return &rtmLoopDedup{
+		size:  size,
+		ttl:   ttl,
+		keys:  make(map[string]*list.Element),
+		order: list.New(),
+		now:   time.Now,
+	}
+}
+
+// Tell if the key was seen within ttl, a seen key is refreshed.
+func (d *rtmLoopDedup) seen(key string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.now()
+	d.expire(now)
+
+	e, present := d.keys[key]
+	if present {
+		e.Value.(*rtmLoopDedupEntry).seenAt = now
+		d.order.MoveToBack(e)
+	}
+	return present
+}
+
+// Remember the key as seen now.
+func (d *rtmLoopDedup) remember(key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.now()
+	d.expire(now)
+
+	if e, present := d.keys[key]; present {
+		e.Value.(*rtmLoopDedupEntry).seenAt = now
+		d.order.MoveToBack(e)
+		return
+	}
+
+	d.keys[key] = d.order.PushBack(&rtmLoopDedupEntry{key: key, seenAt: now})
+	if d.order.Len() > d.size {
+		d.remove(d.order.Front())
+	}
+}
+
+// Remove expired keys from the least recently seen one.
+func (d *rtmLoopDedup) expire(now time.Time) {
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		if now.Sub(e.Value.(*rtmLoopDedupEntry).seenAt) < d.ttl {
+			return
+		}
+		d.remove(e)
+	}
+}
+
+func (d *rtmLoopDedup) remove(e *list.Element) {
+	d.order.Remove(e)
+	delete(d.keys, e.Value.(*rtmLoopDedupEntry).key)
+}
+
+// Tell if the message should be dropped as a duplicate.
+func (l *rtmLoop) duplicated(m RTMMessage) bool {
+	if l.dedup == nil {
+		return false
+	}
+
+	key, _ := m["key"].(string)
+	if key == "" || !l.dedup.seen(key) {
+		return false
+	}
+
+	atomic.AddUint64(&l.counters.duplicateMessages, 1)
+	return true
+}
+
+// Remember the message delivered, so a dropped one can still be
+// delivered when it's sent again.
+func (l *rtmLoop) rememberMessage(m RTMMessage) {
+	if l.dedup == nil {
+		return
+	}
+
+	if key, _ := m["key"].(string); key != "" {
+		l.dedup.remember(key)
+	}
+}
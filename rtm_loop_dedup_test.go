@@ -0,0 +1,94 @@
+package bearychat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTMLoopDedup_Seen(t *testing.T) {
+	now := time.Now()
+	d := newRTMLoopDedup(2, time.Minute)
+	d.now = func() time.Time { return now }
+
+	if d.seen("a") {
+		t.Errorf("new keys should not be seen")
+	}
+	d.remember("a")
+	d.remember("b")
+	if !d.seen("a") {
+		t.Errorf("a should be seen")
+	}
+
+	// b is the least recently seen, evicted by c
+	d.remember("c")
+	if d.seen("b") {
+		t.Errorf("b should be evicted")
+	}
+
+	now = now.Add(time.Minute)
+	if d.seen("c") {
+		t.Errorf("c should be expired")
+	}
+	d.remember("c")
+	if len(d.keys) != 1 || d.order.Len() != 1 {
+		t.Errorf("expired keys should be removed: %d", len(d.keys))
+	}
+}
+
+func TestRTMLoop_Dedup(t *testing.T) {
+	l, err := NewRTMLoop(
+		"ws://localhost",
+		WithRTMLoopBacklog(4),
+		WithRTMLoopDedup(16, time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	closeC := make(chan struct{})
+
+	for _, key := range []string{"a", "b", "a", "", ""} {
+		l.deliverMessage(RTMMessage{"key": key}, closeC)
+	}
+
+	if len(l.rtmC) != 4 {
+		t.Errorf("unexpected delivered messages: %d", len(l.rtmC))
+	}
+	if stats := l.Stats(); stats.DuplicateMessages != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRTMLoop_Dedup_Dropped(t *testing.T) {
+	l, err := NewRTMLoop(
+		"ws://localhost",
+		WithRTMLoopBacklog(1),
+		WithRTMLoopOverflowPolicy(RTMLoopOverflowDropNewest),
+		WithRTMLoopDedup(16, time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	closeC := make(chan struct{})
+
+	l.deliverMessage(RTMMessage{"key": "a"}, closeC)
+	l.deliverMessage(RTMMessage{"key": "b"}, closeC)
+	<-l.rtmC
+
+	// b was dropped, it's delivered when sent again
+	l.deliverMessage(RTMMessage{"key": "b"}, closeC)
+	if len(l.rtmC) != 1 {
+		t.Errorf("dropped message should be delivered again")
+	}
+	if stats := l.Stats(); stats.DuplicateMessages != 0 || stats.DroppedMessages != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestWithRTMLoopDedup_Invalid(t *testing.T) {
+	if _, err := NewRTMLoop("ws://localhost", WithRTMLoopDedup(0, time.Minute)); err == nil {
+		t.Errorf("expected error for size")
+	}
+	if _, err := NewRTMLoop("ws://localhost", WithRTMLoopDedup(1, 0)); err == nil {
+		t.Errorf("expected error for ttl")
+	}
+}
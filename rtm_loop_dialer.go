@@ -0,0 +1,106 @@
+package bearychat
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// Set dialer for connecting to RTM server, defaults to
+// websocket.DefaultDialer.
+//
+// The dialer is copied, other dialer options are applied to the copy
+// wherever they are set.
+func WithRTMLoopDialer(dialer *websocket.Dialer) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if dialer == nil {
+			return errors.New("dialer should not be nil")
+		}
+		d := *dialer
+		r.dialer = &d
+		return nil
+	}
+}
+
+// Set request headers of handshake.
+func WithRTMLoopHeader(header http.Header) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		r.header = header
+		return nil
+	}
+}
+
+// Set TLS config for wss connections, e.g. pinning a CA with RootCAs.
+func WithRTMLoopTLSConfig(config *tls.Config) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		r.dialerSetters = append(r.dialerSetters, func(d *websocket.Dialer) {
+			d.TLSClientConfig = config
+		})
+		return nil
+	}
+}
+
+// Set proxy for connecting, defaults to http.ProxyFromEnvironment.
+//
+//      proxyURL, _ := url.Parse("http://proxy.example.com:3128")
+//      WithRTMLoopProxy(http.ProxyURL(proxyURL))
+func WithRTMLoopProxy(proxy func(*http.Request) (*url.URL, error)) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		r.dialerSetters = append(r.dialerSetters, func(d *websocket.Dialer) {
+			d.Proxy = proxy
+		})
+		return nil
+	}
+}
+
+// Set timeout for handshake, defaults to the one of
+// websocket.DefaultDialer (45 seconds in recent gorilla/websocket
+// releases, no timeout in older ones).
+func WithRTMLoopHandshakeTimeout(timeout time.Duration) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if timeout <= 0 {
+			return errors.New("handshake timeout should be positive")
+		}
+		r.dialerSetters = append(r.dialerSetters, func(d *websocket.Dialer) {
+			d.HandshakeTimeout = timeout
+		})
+		return nil
+	}
+}
+
+// Negotiate permessage-deflate compression with server, messages are
+// compressed only if server supports it.
+func WithRTMLoopCompression(enabled bool) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		r.dialerSetters = append(r.dialerSetters, func(d *websocket.Dialer) {
+			d.EnableCompression = enabled
+		})
+		return nil
+	}
+}
+
+// Set max size in bytes of a received message, no limit by default.
+//
+// The connection is closed when an oversized message received, and an
+// ErrRTMLoopFrameTooLarge error is sent via error channel.
+func WithRTMLoopMaxFrameSize(size int64) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if size <= 0 {
+			return errors.New("max frame size should be positive")
+		}
+		r.maxFrameSize = size
+		return nil
+	}
+}
+
+// Dialer options are collected by setters, and applied after all setters.
+type rtmLoopDialerSetter func(*websocket.Dialer)
+
+func newRTMLoopDialer() *websocket.Dialer {
+	d := *websocket.DefaultDialer
+	return &d
+}
@@ -0,0 +1,116 @@
+package bearychat
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWithRTMLoopDialer(t *testing.T) {
+	dialer := &websocket.Dialer{}
+	l, err := NewRTMLoop(
+		"ws://localhost",
+		WithRTMLoopDialer(dialer),
+		WithRTMLoopHandshakeTimeout(time.Second),
+		WithRTMLoopCompression(true),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if l.dialer.HandshakeTimeout != time.Second || !l.dialer.EnableCompression {
+		t.Errorf("unexpected dialer: %+v", l.dialer)
+	}
+	if dialer.HandshakeTimeout != 0 || dialer.EnableCompression {
+		t.Errorf("dialer should be copied: %+v", dialer)
+	}
+
+	// options set before the dialer are kept
+	l, err = NewRTMLoop(
+		"ws://localhost",
+		WithRTMLoopHandshakeTimeout(time.Second),
+		WithRTMLoopProxy(nil),
+		WithRTMLoopDialer(&websocket.Dialer{HandshakeTimeout: time.Minute}),
+		WithRTMLoopCompression(true),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if l.dialer.HandshakeTimeout != time.Second || !l.dialer.EnableCompression || l.dialer.Proxy != nil {
+		t.Errorf("unexpected dialer: %+v", l.dialer)
+	}
+
+	if _, err := NewRTMLoop("ws://localhost", WithRTMLoopDialer(nil)); err == nil {
+		t.Errorf("expected error for nil dialer")
+	}
+}
+
+func TestWithRTMLoopHeader(t *testing.T) {
+	headerC := make(chan http.Header, 1)
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headerC <- r.Header
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer s.Close()
+
+	header := http.Header{}
+	header.Set("X-Foo", "bar")
+	l, err := NewRTMLoop(
+		"ws"+strings.TrimPrefix(s.URL, "http"),
+		WithRTMLoopHeader(header),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	if received := <-headerC; received.Get("X-Foo") != "bar" {
+		t.Errorf("unexpected header: %+v", received)
+	}
+}
+
+func TestWithRTMLoopMaxFrameSize(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	l, err := NewRTMLoop(s.WSHost(), WithRTMLoopMaxFrameSize(64))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	conn := <-s.conns
+	conn.WriteMessage(
+		websocket.TextMessage,
+		[]byte(`{"text": "`+strings.Repeat("a", 64)+`"}`),
+	)
+
+	select {
+	case err := <-l.ErrC():
+		if !errors.Is(err, ErrRTMLoopFrameTooLarge) || !errors.Is(err, ErrRTMLoopFatal) {
+			t.Errorf("unexpected error: %+v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected error")
+	}
+
+	if l.State() != RTMLoopStateFailed {
+		t.Errorf("unexpected state: %s", l.State())
+	}
+}
@@ -0,0 +1,81 @@
+package bearychat
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// RTMLoopError wraps an error happened inside the loop with its kind.
+//
+//      if errors.Is(err, bearychat.ErrRTMLoopFatal) {
+//              // restart the loop
+//      }
+type RTMLoopError struct {
+	// One of ErrRTMLoop* kinds
+	Kind error
+	// Underlying error
+	Err error
+}
+
+func (e *RTMLoopError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+// Fatal tells if the loop stopped because of this error.
+func (e *RTMLoopError) Fatal() bool {
+	switch e.Kind {
+	case ErrRTMLoopConnClosed, ErrRTMLoopConnLost, ErrRTMLoopFrameTooLarge:
+		return true
+	default:
+		return false
+	}
+}
+
+// Is matches error kind and class.
+func (e *RTMLoopError) Is(target error) bool {
+	switch target {
+	case e.Kind:
+		return true
+	case ErrRTMLoopFatal:
+		return e.Fatal()
+	case ErrRTMLoopTransient:
+		return !e.Fatal()
+	default:
+		return false
+	}
+}
+
+// Cause implements `github.com/pkg/errors` causer.
+func (e *RTMLoopError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the underlying error.
+func (e *RTMLoopError) Unwrap() error {
+	return e.Err
+}
+
+// Classify a socket read/write error. All of them are fatal as the
+// connection can't be used after failure: EOF, reset and timeout
+// are reported as connection lost.
+func classifyRTMLoopConnError(err error, message string) *RTMLoopError {
+	if err == websocket.ErrReadLimit {
+		return &RTMLoopError{
+			Kind: ErrRTMLoopFrameTooLarge,
+			Err:  errors.Wrap(err, message),
+		}
+	}
+	if _, ok := err.(*websocket.CloseError); ok {
+		return &RTMLoopError{
+			Kind: ErrRTMLoopConnClosed,
+			Err:  errors.Wrap(err, message),
+		}
+	}
+
+	return &RTMLoopError{
+		Kind: ErrRTMLoopConnLost,
+		Err:  errors.Wrap(err, message),
+	}
+}
@@ -0,0 +1,100 @@
+package bearychat
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRTMLoopError_Is(t *testing.T) {
+	cases := []struct {
+		err       *RTMLoopError
+		fatal     bool
+		transient bool
+	}{
+		{&RTMLoopError{Kind: ErrRTMLoopConnClosed, Err: io.EOF}, true, false},
+		{&RTMLoopError{Kind: ErrRTMLoopConnLost, Err: io.EOF}, true, false},
+		{&RTMLoopError{Kind: ErrRTMLoopMalformedMessage, Err: io.EOF}, false, true},
+		{&RTMLoopError{Kind: ErrRTMLoopOverflow, Err: io.EOF}, false, true},
+	}
+
+	for _, c := range cases {
+		if !errors.Is(c.err, c.err.Kind) {
+			t.Errorf("expected kind: %+v", c.err)
+		}
+		if errors.Is(c.err, ErrRTMLoopFatal) != c.fatal {
+			t.Errorf("unexpected fatal: %+v", c.err)
+		}
+		if errors.Is(c.err, ErrRTMLoopTransient) != c.transient {
+			t.Errorf("unexpected transient: %+v", c.err)
+		}
+	}
+
+	if !errors.Is(&RTMLoopOverflowWarning{}, ErrRTMLoopTransient) {
+		t.Errorf("overflow warning should be transient")
+	}
+}
+
+func TestClassifyRTMLoopConnError(t *testing.T) {
+	err := classifyRTMLoopConnError(&websocket.CloseError{Code: 1000}, "foobar")
+	if err.Kind != ErrRTMLoopConnClosed {
+		t.Errorf("unexpected kind: %+v", err)
+	}
+
+	err = classifyRTMLoopConnError(io.ErrUnexpectedEOF, "foobar")
+	if err.Kind != ErrRTMLoopConnLost {
+		t.Errorf("unexpected kind: %+v", err)
+	}
+
+	err = classifyRTMLoopConnError(websocket.ErrReadLimit, "foobar")
+	if err.Kind != ErrRTMLoopFrameTooLarge || !err.Fatal() {
+		t.Errorf("unexpected kind: %+v", err)
+	}
+}
+
+func TestRTMLoop_readMessage_Errors(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	l, err := NewRTMLoop(s.WSHost())
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	conn := <-s.conns
+	conn.WriteMessage(websocket.TextMessage, []byte("{malformed"))
+	conn.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+	)
+
+	expectErr := func(kind error) {
+		select {
+		case err := <-l.ErrC():
+			if !errors.Is(err, kind) {
+				t.Errorf("expected %s, got: %+v", kind, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected error: %s", kind)
+		}
+	}
+	expectErr(ErrRTMLoopMalformedMessage)
+	expectErr(ErrRTMLoopConnClosed)
+
+	select {
+	case err := <-l.ErrC():
+		t.Errorf("unexpected error: %+v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if l.State() != RTMLoopStateFailed {
+		t.Errorf("unexpected state: %s", l.State())
+	}
+}
@@ -2,6 +2,7 @@ package bearychat
 
 import (
 	"encoding/json"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,16 +11,48 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	DEFAULT_RTM_LOOP_SEND_BACKLOG  = 128
+	DEFAULT_RTM_LOOP_WRITE_TIMEOUT = 10 * time.Second
+
+	// control messages are few, a small queue is enough
+	rtmLoopControlBacklog = 8
+)
+
 type rtmLoop struct {
 	wsHost string
 	conn   *websocket.Conn
 	state  RTMLoopState
 	callId uint64
+	closeC chan struct{} // closed when current connection stops
 	llock  *sync.RWMutex // lock for properties below
 
-	rtmCBacklog int
-	rtmC        chan RTMMessage
-	errC        chan error
+	subscribers *rtmLoopSubscribers
+
+	dialer        *websocket.Dialer
+	dialerSetters []rtmLoopDialerSetter // applied to dialer after setters
+	header        http.Header
+	maxFrameSize  int64
+
+	rtmCBacklog    int
+	rtmC           chan RTMMessage
+	errC           chan error
+	overflowPolicy RTMLoopOverflowPolicy
+	spill          *rtmLoopSpill
+	counters       *rtmLoopCounters
+
+	sendBacklog  int
+	writeTimeout time.Duration
+	sendC        chan []byte // outbound queue, drained by the writer
+	controlC     chan []byte // outbound queue for control messages, written first
+	limiter      *rtmLoopLimiter
+
+	typingInterval time.Duration
+	typings        *rtmLoopTypings
+
+	backfill *RTMBackfill
+	dedup    *rtmLoopDedup
+	session  *rtmLoopSession
 }
 
 type rtmLoopSetter func(*rtmLoop) error
@@ -32,6 +65,28 @@ func WithRTMLoopBacklog(backlog int) rtmLoopSetter {
 	}
 }
 
+// Set outbound message queue size, defaults to 128.
+func WithRTMLoopSendBacklog(backlog int) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if backlog <= 0 {
+			return errors.New("send backlog should be positive")
+		}
+		r.sendBacklog = backlog
+		return nil
+	}
+}
+
+// Set deadline for each socket write, defaults to 10 seconds.
+func WithRTMLoopWriteTimeout(timeout time.Duration) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if timeout <= 0 {
+			return errors.New("write timeout should be positive")
+		}
+		r.writeTimeout = timeout
+		return nil
+	}
+}
+
 func NewRTMLoop(wsHost string, setters ...rtmLoopSetter) (*rtmLoop, error) {
 	l := &rtmLoop{
 		wsHost: wsHost,
@@ -39,42 +94,168 @@ func NewRTMLoop(wsHost string, setters ...rtmLoopSetter) (*rtmLoop, error) {
 		callId: 0,
 		llock:  &sync.RWMutex{},
 
-		errC: make(chan error, 1024),
+		subscribers: newRTMLoopSubscribers(),
+
+		dialer: newRTMLoopDialer(),
+
+		errC:           make(chan error, 1024),
+		overflowPolicy: RTMLoopOverflowBlock,
+		spill:          newRTMLoopSpill(),
+		counters:       &rtmLoopCounters{},
+
+		sendBacklog:  DEFAULT_RTM_LOOP_SEND_BACKLOG,
+		writeTimeout: DEFAULT_RTM_LOOP_WRITE_TIMEOUT,
+
+		typingInterval: DEFAULT_RTM_LOOP_TYPING_INTERVAL,
+		typings:        newRTMLoopTypings(),
 	}
 	for _, setter := range setters {
 		if err := setter(l); err != nil {
 			return nil, err
 		}
 	}
+	for _, setter := range l.dialerSetters {
+		setter(l.dialer)
+	}
+
+	if l.rtmCBacklog <= 0 && l.overflowPolicy != RTMLoopOverflowBlock {
+		return nil, errors.Errorf(
+			"overflow policy %s requires a positive backlog",
+			l.overflowPolicy,
+		)
+	}
 
 	if l.rtmCBacklog <= 0 {
 		l.rtmC = make(chan RTMMessage)
 	} else {
 		l.rtmC = make(chan RTMMessage, l.rtmCBacklog)
 	}
+	l.sendC = make(chan []byte, l.sendBacklog)
+	if l.limiter != nil {
+		l.limiter.backlog = l.sendBacklog
+	}
+	l.controlC = make(chan []byte, rtmLoopControlBacklog)
 
 	return l, nil
 }
 
 func (l *rtmLoop) Start() error {
+	l.llock.Lock()
+	switch l.state {
+	case RTMLoopStateOpen:
+		l.llock.Unlock()
+		return nil
+	case RTMLoopStateConnecting, RTMLoopStateReconnecting, RTMLoopStateClosing:
+		state := l.state
+		l.llock.Unlock()
+		return errors.Errorf("rtm loop is %s", state)
+	case RTMLoopStateFailed:
+		l.setState(RTMLoopStateReconnecting, "restarting after failure", nil)
+	default:
+		l.setState(RTMLoopStateConnecting, "starting", nil)
+	}
+	dialingState := l.state
+	restoring := l.session != nil && !l.session.restored
+	l.llock.Unlock()
+
+	// load session before locking as well, as it may take a while
+	var (
+		session    *RTMSession
+		sessionErr error
+	)
+	if restoring {
+		session, sessionErr = l.session.store.Load()
+	}
+
+	// don't hold lock while dialing, so State & Stop won't be blocked
+	conn, _, err := l.dialer.Dial(l.wsHost, l.header)
+
 	l.llock.Lock()
 	defer l.llock.Unlock()
 
-	conn, _, err := websocket.DefaultDialer.Dial(l.wsHost, nil)
+	if l.state != dialingState {
+		// stopped while dialing
+		if conn != nil {
+			conn.Close()
+		}
+		return ErrRTMLoopClosed
+	}
 	if err != nil {
+		l.setState(RTMLoopStateFailed, "dial failed", err)
 		return err
 	}
+	if l.maxFrameSize > 0 {
+		conn.SetReadLimit(l.maxFrameSize)
+	}
 
 	l.conn = conn
-	l.state = RTMLoopStateOpen
+	l.closeC = make(chan struct{})
+	l.setState(RTMLoopStateOpen, "connected", nil)
+
+	if l.session != nil {
+		if err := l.restoreSession(session, sessionErr); err != nil {
+			go l.deliverError(
+				&RTMLoopError{Kind: ErrRTMLoopSession, Err: err},
+				l.closeC,
+			)
+		}
+		go l.keepSession(l.closeC)
+	}
 
-	go l.readMessage()
+	if l.limiter != nil {
+		// flush messages queued before last stop, limiter locks
+		// before loop on sending path so don't call it with lock held
+		go l.limiter.resume(l.pushSend)
+	}
+
+	go l.readMessage(conn, l.closeC)
+	go l.writeMessage(conn, l.closeC)
+	if l.overflowPolicy == RTMLoopOverflowSpillToDisk {
+		go l.drainSpill(l.closeC)
+	}
 
 	return nil
 }
 
 func (l *rtmLoop) Stop() error {
-	return nil
+	err := l.stop()
+	if l.overflowPolicy == RTMLoopOverflowSpillToDisk {
+		l.discardSpill()
+	}
+	if l.session != nil {
+		l.saveSession()
+	}
+	return err
+}
+
+func (l *rtmLoop) stop() error {
+	l.llock.Lock()
+	defer l.llock.Unlock()
+
+	switch l.state {
+	case RTMLoopStateClosed:
+		return nil
+	case RTMLoopStateOpen:
+	default:
+		// not connected, nothing to close
+		l.setState(RTMLoopStateClosed, "stopped", nil)
+		return nil
+	}
+
+	l.setState(RTMLoopStateClosing, "stopping", nil)
+	close(l.closeC)
+
+	// WriteControl is safe to call concurrently with the writer
+	l.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(l.writeTimeout),
+	)
+	err := l.conn.Close()
+
+	l.setState(RTMLoopStateClosed, "stopped", nil)
+
+	return err
 }
 
 func (l *rtmLoop) State() RTMLoopState {
@@ -85,7 +266,7 @@ func (l *rtmLoop) State() RTMLoopState {
 }
 
 func (l *rtmLoop) Ping() error {
-	return l.Send(RTMMessage{"type": RTMMessageTypePing})
+	return l.enqueue(l.controlC, RTMMessage{"type": RTMMessageTypePing})
 }
 
 func (l *rtmLoop) Keepalive(interval *time.Ticker) error {
@@ -100,25 +281,34 @@ func (l *rtmLoop) Keepalive(interval *time.Ticker) error {
 	}
 }
 
+// Send queues a message for writing. Write failures are reported via ErrC.
+// Chat messages are validated before queued, see RTMMessage.Validate.
 func (l *rtmLoop) Send(m RTMMessage) error {
-	if l.State() != RTMLoopStateOpen {
-		return ErrRTMLoopClosed
+	if err := m.Validate(); err != nil {
+		return err
 	}
 
-	if _, hasCallId := m["call_id"]; !hasCallId {
-		m["call_id"] = l.advanceCallId()
+	if m.IsChatMessage() {
+		if vchannelId, ok := m["vchannel_id"].(string); ok {
+			l.typings.replied(vchannelId)
+		}
 	}
 
-	rawMessage, err := json.Marshal(m)
-	if err != nil {
-		return errors.Wrap(err, "encode message failed")
+	if l.limiter == nil {
+		return l.enqueue(l.sendC, m)
 	}
 
-	if err := l.conn.WriteMessage(websocket.TextMessage, rawMessage); err != nil {
-		return errors.Wrap(err, "write socket failed")
+	if l.State() != RTMLoopStateOpen {
+		return ErrRTMLoopClosed
 	}
 
-	return nil
+	rawMessage, err := l.encode(m)
+	if err != nil {
+		return err
+	}
+
+	vchannelId, _ := m["vchannel_id"].(string)
+	return l.limiter.send(vchannelId, rawMessage, l.pushSend)
 }
 
 func (l *rtmLoop) ReadC() (chan RTMMessage, error) {
@@ -133,26 +323,146 @@ func (l *rtmLoop) ErrC() chan error {
 	return l.errC
 }
 
+func (l *rtmLoop) enqueue(queue chan []byte, m RTMMessage) error {
+	if l.State() != RTMLoopStateOpen {
+		return ErrRTMLoopClosed
+	}
+
+	rawMessage, err := l.encode(m)
+	if err != nil {
+		return err
+	}
+
+	return l.push(queue, rawMessage)
+}
+
+// Encode message with call id.
+func (l *rtmLoop) encode(m RTMMessage) ([]byte, error) {
+	if _, hasCallId := m["call_id"]; !hasCallId {
+		m["call_id"] = l.advanceCallId()
+	}
+
+	rawMessage, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode message failed")
+	}
+
+	return rawMessage, nil
+}
+
+func (l *rtmLoop) push(queue chan []byte, rawMessage []byte) error {
+	// hold read lock so the message won't be queued after loop stopped
+	l.llock.RLock()
+	defer l.llock.RUnlock()
+
+	if l.state != RTMLoopStateOpen {
+		return ErrRTMLoopClosed
+	}
+
+	select {
+	case queue <- rawMessage:
+		return nil
+	default:
+		return ErrRTMLoopSendQueueFull
+	}
+}
+
+func (l *rtmLoop) pushSend(rawMessage []byte) error {
+	return l.push(l.sendC, rawMessage)
+}
+
 // Listen & read message from BearyChat
-func (l *rtmLoop) readMessage() {
+func (l *rtmLoop) readMessage(conn *websocket.Conn, closeC chan struct{}) {
+	deliver := func(m RTMMessage) {
+		l.deliverMessage(m, closeC)
+	}
+	if l.backfill != nil {
+		deliver = l.startBackfill(closeC)
+	}
+
 	for {
-		if l.State() == RTMLoopStateClosed {
+		if l.State() != RTMLoopStateOpen {
 			return
 		}
 
-		_, rawMessage, err := l.conn.ReadMessage()
+		_, rawMessage, err := conn.ReadMessage()
 		if err != nil {
-			l.errC <- errors.Wrap(err, "read socket failed")
-			continue
+			l.fail(
+				classifyRTMLoopConnError(err, "read socket failed"),
+				closeC,
+			)
+			return
 		}
 
 		message := RTMMessage{}
 		if err = json.Unmarshal(rawMessage, &message); err != nil {
-			l.errC <- errors.Wrap(err, "decode message failed")
+			l.deliverError(
+				&RTMLoopError{
+					Kind: ErrRTMLoopMalformedMessage,
+					Err:  errors.Wrap(err, "decode message failed"),
+				},
+				closeC,
+			)
 			continue
 		}
 
-		l.rtmC <- message
+		if l.limiter != nil {
+			l.limiter.observe(message)
+		}
+		if l.backfill != nil {
+			l.backfill.Track(message)
+		}
+
+		deliver(message)
+	}
+}
+
+// Write queued messages to BearyChat. This is the only goroutine writes
+// data frames to the connection.
+func (l *rtmLoop) writeMessage(conn *websocket.Conn, closeC chan struct{}) {
+	for {
+		var rawMessage []byte
+
+		// control messages go first
+		select {
+		case rawMessage = <-l.controlC:
+		default:
+			select {
+			case rawMessage = <-l.controlC:
+			case rawMessage = <-l.sendC:
+			case <-closeC:
+				return
+			}
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(l.writeTimeout))
+		if err := conn.WriteMessage(websocket.TextMessage, rawMessage); err != nil {
+			l.fail(
+				classifyRTMLoopConnError(err, "write socket failed"),
+				closeC,
+			)
+			return
+		}
+	}
+}
+
+// Stop the connection because of a fatal error. The error is reported once,
+// and won't be reported if the connection has been stopped already.
+func (l *rtmLoop) fail(err *RTMLoopError, closeC chan struct{}) {
+	l.llock.Lock()
+	if l.state != RTMLoopStateOpen || l.closeC != closeC {
+		l.llock.Unlock()
+		return
+	}
+	close(l.closeC)
+	l.conn.Close()
+	l.setState(RTMLoopStateFailed, "connection failed", err)
+	l.llock.Unlock()
+
+	l.deliverTerminalError(err)
+
+	if l.session != nil {
+		l.saveSession()
 	}
 }
 
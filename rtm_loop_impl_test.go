@@ -1,8 +1,15 @@
 package bearychat
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 const (
@@ -90,3 +97,192 @@ func TestRTMLoop_advanceCallId_Race(t *testing.T) {
 		t.Errorf("unexepcted call id after data race: %d", l.callId)
 	}
 }
+
+// testRTMServer records every frame received from the loop.
+type testRTMServer struct {
+	*httptest.Server
+
+	received chan RTMMessage
+	// server side connections, for writing frames to the loop
+	conns chan *websocket.Conn
+}
+
+func newTestRTMServer(t *testing.T) *testRTMServer {
+	s := &testRTMServer{
+		received: make(chan RTMMessage, 1024),
+		conns:    make(chan *websocket.Conn, 1),
+	}
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %+v", err)
+			return
+		}
+		defer conn.Close()
+		s.conns <- conn
+
+		for {
+			_, rawMessage, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			m := RTMMessage{}
+			if err := json.Unmarshal(rawMessage, &m); err != nil {
+				t.Errorf("unexpected frame: %s", rawMessage)
+				return
+			}
+			s.received <- m
+		}
+	}))
+
+	return s
+}
+
+func (s *testRTMServer) WSHost() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func (s *testRTMServer) expectReceived(t *testing.T) RTMMessage {
+	select {
+	case m := <-s.received:
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("expected message")
+	}
+	return nil
+}
+
+func TestRTMLoop_Send_Closed(t *testing.T) {
+	l, err := NewRTMLoop(testRTMWSHost)
+	if err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	if err := l.Send(RTMMessage{}); err != ErrRTMLoopClosed {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := l.Ping(); err != ErrRTMLoopClosed {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestRTMLoop_Send_QueueFull(t *testing.T) {
+	l, err := NewRTMLoop(testRTMWSHost, WithRTMLoopSendBacklog(1))
+	if err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	// pretend opened without a writer draining the queue
+	l.state = RTMLoopStateOpen
+
+	if err := l.Send(RTMMessage{}); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := l.Send(RTMMessage{}); err != ErrRTMLoopSendQueueFull {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestRTMLoop_Send(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	l, err := NewRTMLoop(s.WSHost())
+	if err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	per := 10
+	times := 5
+
+	var wg sync.WaitGroup
+	send := func() {
+		for i := 0; i < per; i = i + 1 {
+			if err := l.Send(newRTMP2PMessage("=bw52O", "=bw52O", "hi")); err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+		}
+		if err := l.Ping(); err != nil {
+			t.Errorf("unexpected error: %+v", err)
+		}
+		wg.Done()
+	}
+	for i := 0; i < times; i = i + 1 {
+		wg.Add(1)
+		go send()
+	}
+	wg.Wait()
+
+	callIds := map[float64]bool{}
+	for i := 0; i < (per+1)*times; i = i + 1 {
+		m := s.expectReceived(t)
+		callId := m["call_id"].(float64)
+		if callIds[callId] {
+			t.Errorf("duplicated call id: %v", callId)
+		}
+		callIds[callId] = true
+	}
+}
+
+func TestRTMLoop_Send_PingFirst(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	l, err := NewRTMLoop(s.WSHost())
+	if err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	// queue messages before the writer starts
+	l.state = RTMLoopStateOpen
+	for i := 0; i < 3; i = i + 1 {
+		if err := l.Send(newRTMP2PMessage("=bw52O", "=bw52O", "hi")); err != nil {
+			t.Errorf("unexpected error: %+v", err)
+		}
+	}
+	if err := l.Ping(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(s.WSHost(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer conn.Close()
+	closeC := make(chan struct{})
+	defer close(closeC)
+	go l.writeMessage(conn, closeC)
+
+	if m := s.expectReceived(t); m.Type() != RTMMessageTypePing {
+		t.Errorf("expected ping first, got: %+v", m)
+	}
+}
+
+func TestRTMLoop_Stop(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	l, err := NewRTMLoop(s.WSHost())
+	if err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Stop(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	if l.State() != RTMLoopStateClosed {
+		t.Errorf("unexpected state: %s", l.State())
+	}
+	if err := l.Send(RTMMessage{}); err != ErrRTMLoopClosed {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := l.Stop(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
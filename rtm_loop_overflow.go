@@ -0,0 +1,393 @@
+package bearychat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+type rtmLoopCounters struct {
+	droppedMessages uint64
+	droppedErrors   uint64
+	spilledMessages uint64
+
+	rateLimitedMessages uint64
+	duplicateMessages   uint64
+
+	// set when messages start overflowing, reset after a message delivered
+	overflowing int32
+}
+
+func (c *rtmLoopCounters) stats() RTMLoopStats {
+	return RTMLoopStats{
+		DroppedMessages: atomic.LoadUint64(&c.droppedMessages),
+		DroppedErrors:   atomic.LoadUint64(&c.droppedErrors),
+		SpilledMessages: atomic.LoadUint64(&c.spilledMessages),
+
+		RateLimitedMessages: atomic.LoadUint64(&c.rateLimitedMessages),
+		DuplicateMessages:   atomic.LoadUint64(&c.duplicateMessages),
+	}
+}
+
+// Set receiving channel overflow policy, defaults to RTMLoopOverflowBlock.
+//
+// Policies other than RTMLoopOverflowBlock require a positive backlog
+// (see WithRTMLoopBacklog). The policy also applies to error channel,
+// which drops the oldest error when spilling to disk.
+//
+// Spilled messages are kept for restarting after the connection failed,
+// but discarded with the spill file when the loop is stopped.
+func WithRTMLoopOverflowPolicy(policy RTMLoopOverflowPolicy) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		switch policy {
+		case RTMLoopOverflowBlock,
+			RTMLoopOverflowDropOldest,
+			RTMLoopOverflowDropNewest,
+			RTMLoopOverflowSpillToDisk:
+			r.overflowPolicy = policy
+			return nil
+		default:
+			return errors.Errorf("unknown overflow policy: %s", policy)
+		}
+	}
+}
+
+// Set directory for spilled messages, defaults to os.TempDir().
+func WithRTMLoopSpillDir(dir string) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		r.spill.dir = dir
+		return nil
+	}
+}
+
+func (l *rtmLoop) Stats() RTMLoopStats {
+	return l.counters.stats()
+}
+
+// Deliver a message to receiving channel according to overflow policy.
+func (l *rtmLoop) deliverMessage(m RTMMessage, closeC chan struct{}) {
+	if l.duplicated(m) {
+		return
+	}
+
+	switch l.overflowPolicy {
+	case RTMLoopOverflowDropNewest:
+		select {
+		case l.rtmC <- m:
+			l.resetOverflow()
+		default:
+			l.dropMessage(closeC)
+			return
+		}
+	case RTMLoopOverflowDropOldest:
+		select {
+		case l.rtmC <- m:
+			l.resetOverflow()
+			l.rememberMessage(m)
+			l.trackSession(m)
+			return
+		default:
+		}
+		select {
+		case <-l.rtmC:
+			l.dropMessage(closeC)
+		default:
+		}
+		select {
+		case l.rtmC <- m:
+		default:
+			l.dropMessage(closeC)
+			return
+		}
+	case RTMLoopOverflowSpillToDisk:
+		if l.spillMessage(m, closeC) {
+			l.rememberMessage(m)
+		}
+		return
+	default:
+		select {
+		case l.rtmC <- m:
+		case <-closeC:
+			return
+		}
+	}
+
+	l.rememberMessage(m)
+	l.trackSession(m)
+}
+
+// Deliver an error to error channel according to overflow policy.
+func (l *rtmLoop) deliverError(err error, closeC chan struct{}) {
+	switch l.overflowPolicy {
+	case RTMLoopOverflowDropNewest:
+		select {
+		case l.errC <- err:
+		default:
+			atomic.AddUint64(&l.counters.droppedErrors, 1)
+		}
+	case RTMLoopOverflowDropOldest, RTMLoopOverflowSpillToDisk:
+		select {
+		case l.errC <- err:
+			return
+		default:
+		}
+		select {
+		case <-l.errC:
+			atomic.AddUint64(&l.counters.droppedErrors, 1)
+		default:
+		}
+		select {
+		case l.errC <- err:
+		default:
+			atomic.AddUint64(&l.counters.droppedErrors, 1)
+		}
+	default:
+		select {
+		case l.errC <- err:
+		case <-closeC:
+		}
+	}
+}
+
+// Deliver the error which stops the loop, it should never be dropped
+// so the oldest error is discarded when error channel is full.
+func (l *rtmLoop) deliverTerminalError(err error) {
+	select {
+	case l.errC <- err:
+		return
+	default:
+	}
+	select {
+	case <-l.errC:
+		atomic.AddUint64(&l.counters.droppedErrors, 1)
+	default:
+	}
+	l.errC <- err
+}
+
+func (l *rtmLoop) dropMessage(closeC chan struct{}) {
+	atomic.AddUint64(&l.counters.droppedMessages, 1)
+	l.warnOverflow(closeC)
+}
+
+// Warn once when messages start overflowing.
+func (l *rtmLoop) warnOverflow(closeC chan struct{}) {
+	if !atomic.CompareAndSwapInt32(&l.counters.overflowing, 0, 1) {
+		return
+	}
+
+	l.deliverError(
+		&RTMLoopOverflowWarning{
+			Policy: l.overflowPolicy,
+			Stats:  l.Stats(),
+		},
+		closeC,
+	)
+}
+
+func (l *rtmLoop) resetOverflow() {
+	atomic.StoreInt32(&l.counters.overflowing, 0)
+}
+
+// Deliver the message or spill it to disk, tells if it's not dropped.
+func (l *rtmLoop) spillMessage(m RTMMessage, closeC chan struct{}) bool {
+	l.spill.lock.Lock()
+
+	// don't create spill file again after discarded
+	select {
+	case <-closeC:
+		l.spill.lock.Unlock()
+		atomic.AddUint64(&l.counters.droppedMessages, 1)
+		return false
+	default:
+	}
+
+	// keep order: deliver directly only when nothing spilled
+	if l.spill.empty() {
+		select {
+		case l.rtmC <- m:
+			l.spill.lock.Unlock()
+			l.resetOverflow()
+			l.trackSession(m)
+			return true
+		default:
+		}
+	}
+
+	err := l.spill.push(m)
+	l.spill.lock.Unlock()
+
+	if err != nil {
+		l.deliverError(
+			&RTMLoopError{
+				Kind: ErrRTMLoopOverflow,
+				Err:  errors.Wrap(err, "spill message failed"),
+			},
+			closeC,
+		)
+		l.dropMessage(closeC)
+		return false
+	}
+
+	atomic.AddUint64(&l.counters.spilledMessages, 1)
+	l.warnOverflow(closeC)
+	l.spill.notify()
+	return true
+}
+
+// Deliver spilled messages in order until loop stopped.
+func (l *rtmLoop) drainSpill(closeC chan struct{}) {
+	for {
+		l.spill.lock.Lock()
+		m, err := l.spill.peek()
+		l.spill.lock.Unlock()
+
+		if err != nil {
+			l.deliverError(
+				&RTMLoopError{
+					Kind: ErrRTMLoopOverflow,
+					Err:  errors.Wrap(err, "read spilled message failed"),
+				},
+				closeC,
+			)
+			l.spill.lock.Lock()
+			l.spill.pop()
+			l.spill.lock.Unlock()
+			continue
+		}
+
+		if m == nil {
+			select {
+			case <-l.spill.notifyC:
+				continue
+			case <-closeC:
+				return
+			}
+		}
+
+		select {
+		case l.rtmC <- m:
+			l.spill.lock.Lock()
+			l.spill.pop()
+			l.spill.lock.Unlock()
+			l.trackSession(m)
+		case <-closeC:
+			return
+		}
+	}
+}
+
+// Discard spilled messages and remove the spill file, after the loop
+// stopped.
+func (l *rtmLoop) discardSpill() {
+	l.spill.lock.Lock()
+	discarded := l.spill.discard()
+	l.spill.lock.Unlock()
+
+	atomic.AddUint64(&l.counters.droppedMessages, uint64(discarded))
+}
+
+// rtmLoopSpill is a file backed message queue.
+type rtmLoopSpill struct {
+	dir     string
+	lock    sync.Mutex // lock for properties below
+	file    *os.File
+	offset  int64 // read offset of the head message
+	size    int64 // total written size
+	lengths []int // encoded length of queued messages
+
+	notifyC chan struct{}
+}
+
+func newRTMLoopSpill() *rtmLoopSpill {
+	return &rtmLoopSpill{
+		dir:     os.TempDir(),
+		notifyC: make(chan struct{}, 1),
+	}
+}
+
+func (s *rtmLoopSpill) empty() bool {
+	return len(s.lengths) == 0
+}
+
+func (s *rtmLoopSpill) push(m RTMMessage) error {
+	rawMessage, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if s.file == nil {
+		file, err := ioutil.TempFile(s.dir, "bearychat-rtm-spill-")
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+
+	if _, err := s.file.WriteAt(rawMessage, s.size); err != nil {
+		return err
+	}
+	s.size = s.size + int64(len(rawMessage))
+	s.lengths = append(s.lengths, len(rawMessage))
+
+	return nil
+}
+
+// Read the head message, returns nil if nothing spilled.
+func (s *rtmLoopSpill) peek() (RTMMessage, error) {
+	if s.empty() {
+		return nil, nil
+	}
+
+	rawMessage := make([]byte, s.lengths[0])
+	if _, err := s.file.ReadAt(rawMessage, s.offset); err != nil {
+		return nil, err
+	}
+
+	m := RTMMessage{}
+	if err := json.Unmarshal(rawMessage, &m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Remove the head message, spill file is removed after drained.
+func (s *rtmLoopSpill) pop() {
+	if s.empty() {
+		return
+	}
+
+	s.offset = s.offset + int64(s.lengths[0])
+	s.lengths = s.lengths[1:]
+
+	if s.empty() {
+		s.discard()
+	}
+}
+
+// Remove all messages and the spill file, returns count of removed
+// messages.
+func (s *rtmLoopSpill) discard() int {
+	discarded := len(s.lengths)
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+	s.file = nil
+	s.offset = 0
+	s.size = 0
+	s.lengths = nil
+	return discarded
+}
+
+func (s *rtmLoopSpill) notify() {
+	select {
+	case s.notifyC <- struct{}{}:
+	default:
+	}
+}
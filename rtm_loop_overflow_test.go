@@ -0,0 +1,219 @@
+package bearychat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewRTMLoop_OverflowPolicyRequiresBacklog(t *testing.T) {
+	_, err := NewRTMLoop(
+		testRTMWSHost,
+		WithRTMLoopOverflowPolicy(RTMLoopOverflowDropNewest),
+	)
+	if err == nil {
+		t.Errorf("expected error")
+	}
+
+	_, err = NewRTMLoop(
+		testRTMWSHost,
+		WithRTMLoopOverflowPolicy(RTMLoopOverflowPolicy("foobar")),
+	)
+	if err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestRTMLoop_deliverMessage_DropNewest(t *testing.T) {
+	l, err := NewRTMLoop(
+		testRTMWSHost,
+		WithRTMLoopBacklog(2),
+		WithRTMLoopOverflowPolicy(RTMLoopOverflowDropNewest),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	closeC := make(chan struct{})
+	for i := 0; i < 4; i = i + 1 {
+		l.deliverMessage(RTMMessage{"key": i}, closeC)
+	}
+
+	if m := <-l.rtmC; m["key"] != 0 {
+		t.Errorf("unexpected message: %+v", m)
+	}
+	if m := <-l.rtmC; m["key"] != 1 {
+		t.Errorf("unexpected message: %+v", m)
+	}
+	if stats := l.Stats(); stats.DroppedMessages != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	// warns only once
+	if len(l.errC) != 1 {
+		t.Fatalf("expected one warning, got: %d", len(l.errC))
+	}
+	if _, ok := (<-l.errC).(*RTMLoopOverflowWarning); !ok {
+		t.Errorf("expected overflow warning")
+	}
+}
+
+func TestRTMLoop_deliverMessage_DropOldest(t *testing.T) {
+	l, err := NewRTMLoop(
+		testRTMWSHost,
+		WithRTMLoopBacklog(2),
+		WithRTMLoopOverflowPolicy(RTMLoopOverflowDropOldest),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	closeC := make(chan struct{})
+	for i := 0; i < 4; i = i + 1 {
+		l.deliverMessage(RTMMessage{"key": i}, closeC)
+	}
+
+	if m := <-l.rtmC; m["key"] != 2 {
+		t.Errorf("unexpected message: %+v", m)
+	}
+	if m := <-l.rtmC; m["key"] != 3 {
+		t.Errorf("unexpected message: %+v", m)
+	}
+	if stats := l.Stats(); stats.DroppedMessages != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRTMLoop_deliverError_DropNewest(t *testing.T) {
+	l, err := NewRTMLoop(
+		testRTMWSHost,
+		WithRTMLoopBacklog(1),
+		WithRTMLoopOverflowPolicy(RTMLoopOverflowDropNewest),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	closeC := make(chan struct{})
+	for i := 0; i < cap(l.errC)+1; i = i + 1 {
+		l.deliverError(ErrRTMLoopClosed, closeC)
+	}
+
+	if stats := l.Stats(); stats.DroppedErrors != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRTMLoop_deliverMessage_SpillToDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bearychat-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewRTMLoop(
+		testRTMWSHost,
+		WithRTMLoopBacklog(1),
+		WithRTMLoopOverflowPolicy(RTMLoopOverflowSpillToDisk),
+		WithRTMLoopSpillDir(dir),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	closeC := make(chan struct{})
+	defer close(closeC)
+
+	count := 10
+	for i := 0; i < count; i = i + 1 {
+		l.deliverMessage(RTMMessage{"text": fmt.Sprintf("#%d", i)}, closeC)
+	}
+
+	if stats := l.Stats(); stats.SpilledMessages != uint64(count-1) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected spill file")
+	}
+
+	go l.drainSpill(closeC)
+
+	for i := 0; i < count; i = i + 1 {
+		select {
+		case m := <-l.rtmC:
+			if m.Text() != fmt.Sprintf("#%d", i) {
+				t.Errorf("unexpected message #%d: %+v", i, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected message #%d", i)
+		}
+	}
+
+	// drainer pops after the message is received
+	for i := 0; ; i = i + 1 {
+		files, _ := ioutil.ReadDir(dir)
+		if len(files) == 0 {
+			break
+		}
+		if i > 100 {
+			t.Errorf("spill file should be removed after drained")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRTMLoop_Stop_DiscardsSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bearychat-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	l, err := NewRTMLoop(
+		s.WSHost(),
+		WithRTMLoopBacklog(1),
+		WithRTMLoopOverflowPolicy(RTMLoopOverflowSpillToDisk),
+		WithRTMLoopSpillDir(dir),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	conn := <-s.conns
+	count := 5
+	for i := 0; i < count; i = i + 1 {
+		conn.WriteJSON(RTMMessage{"type": "update_user", "text": fmt.Sprintf("#%d", i)})
+	}
+
+	for i := 0; ; i = i + 1 {
+		if l.Stats().SpilledMessages == uint64(count-1) {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("unexpected stats: %+v", l.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected spill file")
+	}
+
+	if err := l.Stop(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spill file should be removed after stopped")
+	}
+	if stats := l.Stats(); stats.DroppedMessages != uint64(count-1) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
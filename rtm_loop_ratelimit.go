@@ -0,0 +1,384 @@
+package bearychat
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RTMRateLimit configures a token bucket.
+type RTMRateLimit struct {
+	// Messages allowed per second
+	Rate float64
+	// Messages allowed in a burst
+	Burst int
+}
+
+func (r RTMRateLimit) validate() error {
+	if r.Rate <= 0 {
+		return errors.New("rate limit rate should be positive")
+	}
+	if r.Burst <= 0 {
+		return errors.New("rate limit burst should be positive")
+	}
+	return nil
+}
+
+// RTMRateLimitPolicy decides what to do with over limit messages.
+type RTMRateLimitPolicy string
+
+const (
+	// Queue the message and send it when allowed.
+	RTMRateLimitQueue RTMRateLimitPolicy = "queue"
+	// Reject the message with ErrRTMLoopRateLimited.
+	RTMRateLimitReject RTMRateLimitPolicy = "reject"
+)
+
+const (
+	// Retry interval when flushing queued messages into a full send queue.
+	rtmLoopLimiterRetryInterval = 100 * time.Millisecond
+	// Idle vchannels are removed when tracked more than this.
+	rtmLoopLimiterMaxVChannels = 1024
+)
+
+// Set global send rate limit.
+func WithRTMLoopRateLimit(limit RTMRateLimit) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if err := limit.validate(); err != nil {
+			return err
+		}
+		r.ensureLimiter().global = newRTMTokenBucket(limit)
+		return nil
+	}
+}
+
+// Set send rate limit for each vchannel.
+func WithRTMLoopVChannelRateLimit(limit RTMRateLimit) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if err := limit.validate(); err != nil {
+			return err
+		}
+		r.ensureLimiter().vchannelLimit = &limit
+		return nil
+	}
+}
+
+// Set over limit policy, defaults to RTMRateLimitQueue.
+func WithRTMLoopRateLimitPolicy(policy RTMRateLimitPolicy) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if policy != RTMRateLimitQueue && policy != RTMRateLimitReject {
+			return errors.Errorf("unknown rate limit policy: %s", policy)
+		}
+		r.ensureLimiter().policy = policy
+		return nil
+	}
+}
+
+// Pause sending to a vchannel for cooldown when the bot (uid) sent more
+// than threshold messages within window there without anyone else talking,
+// which usually means the bot is talking to itself.
+// Sending to a paused vchannel returns ErrRTMLoopVChannelPaused.
+func WithRTMLoopCircuitBreaker(uid string, threshold int, window, cooldown time.Duration) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if threshold <= 0 || window <= 0 || cooldown <= 0 {
+			return errors.New("circuit breaker settings should be positive")
+		}
+		limiter := r.ensureLimiter()
+		limiter.breakerUID = uid
+		limiter.breakerThreshold = threshold
+		limiter.breakerWindow = window
+		limiter.breakerCooldown = cooldown
+		return nil
+	}
+}
+
+func (l *rtmLoop) ensureLimiter() *rtmLoopLimiter {
+	if l.limiter == nil {
+		l.limiter = newRTMLoopLimiter(l.counters)
+	}
+	return l.limiter
+}
+
+// rtmTokenBucket refills tokens by elapsed time.
+type rtmTokenBucket struct {
+	limit  RTMRateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newRTMTokenBucket(limit RTMRateLimit) *rtmTokenBucket {
+	return &rtmTokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+	}
+}
+
+// Duration to wait before a token is available.
+func (b *rtmTokenBucket) wait(now time.Time) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens = b.tokens + now.Sub(b.last).Seconds()*b.limit.Rate
+		if b.tokens > float64(b.limit.Burst) {
+			b.tokens = float64(b.limit.Burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+func (b *rtmTokenBucket) take() {
+	b.tokens = b.tokens - 1
+}
+
+func (b *rtmTokenBucket) full() bool {
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+type rtmVChannelLimiter struct {
+	bucket *rtmTokenBucket
+	queue  [][]byte    // over limit messages
+	timer  *time.Timer // flushes queue
+
+	selfSends   []time.Time // sends since someone else talked
+	pausedUntil time.Time
+}
+
+// rtmLoopLimiter limits messages on the sending path.
+type rtmLoopLimiter struct {
+	lock sync.Mutex // lock for properties below
+
+	global        *rtmTokenBucket
+	vchannelLimit *RTMRateLimit
+	vchannels     map[string]*rtmVChannelLimiter
+	policy        RTMRateLimitPolicy
+	backlog       int // queue size of each vchannel
+
+	breakerUID       string
+	breakerThreshold int
+	breakerWindow    time.Duration
+	breakerCooldown  time.Duration
+
+	counters *rtmLoopCounters
+	now      func() time.Time
+}
+
+func newRTMLoopLimiter(counters *rtmLoopCounters) *rtmLoopLimiter {
+	return &rtmLoopLimiter{
+		vchannels: make(map[string]*rtmVChannelLimiter),
+		policy:    RTMRateLimitQueue,
+		backlog:   DEFAULT_RTM_LOOP_SEND_BACKLOG,
+		counters:  counters,
+		now:       time.Now,
+	}
+}
+
+func (r *rtmLoopLimiter) vchannel(vchannelId string) *rtmVChannelLimiter {
+	v, present := r.vchannels[vchannelId]
+	if !present {
+		v = &rtmVChannelLimiter{}
+		if r.vchannelLimit != nil {
+			v.bucket = newRTMTokenBucket(*r.vchannelLimit)
+		}
+		r.vchannels[vchannelId] = v
+	}
+	return v
+}
+
+// Wait duration before a message can be sent to the vchannel.
+func (r *rtmLoopLimiter) wait(v *rtmVChannelLimiter, now time.Time) time.Duration {
+	var wait time.Duration
+	if r.global != nil {
+		wait = r.global.wait(now)
+	}
+	if v.bucket != nil {
+		if vwait := v.bucket.wait(now); vwait > wait {
+			wait = vwait
+		}
+	}
+	return wait
+}
+
+func (r *rtmLoopLimiter) take(v *rtmVChannelLimiter) {
+	if r.global != nil {
+		r.global.take()
+	}
+	if v.bucket != nil {
+		v.bucket.take()
+	}
+}
+
+// Check circuit breaker, returns error if vchannel paused.
+func (r *rtmLoopLimiter) checkBreaker(v *rtmVChannelLimiter, now time.Time) error {
+	if r.breakerThreshold <= 0 {
+		return nil
+	}
+
+	if now.Before(v.pausedUntil) {
+		return ErrRTMLoopVChannelPaused
+	}
+
+	recent := v.selfSends[:0]
+	for _, sentAt := range v.selfSends {
+		if now.Sub(sentAt) < r.breakerWindow {
+			recent = append(recent, sentAt)
+		}
+	}
+	v.selfSends = recent
+
+	if len(v.selfSends) >= r.breakerThreshold {
+		v.pausedUntil = now.Add(r.breakerCooldown)
+		v.selfSends = nil
+		return ErrRTMLoopVChannelPaused
+	}
+
+	v.selfSends = append(v.selfSends, now)
+	return nil
+}
+
+// Send a message to vchannel, push is called when the message is allowed.
+func (r *rtmLoopLimiter) send(vchannelId string, rawMessage []byte, push func([]byte) error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	if len(r.vchannels) > rtmLoopLimiterMaxVChannels {
+		r.cleanup(now)
+	}
+	v := r.vchannel(vchannelId)
+
+	if err := r.checkBreaker(v, now); err != nil {
+		atomic.AddUint64(&r.counters.rateLimitedMessages, 1)
+		return err
+	}
+
+	// keep order: queued messages go first
+	if len(v.queue) == 0 {
+		if wait := r.wait(v, now); wait == 0 {
+			if err := push(rawMessage); err != nil {
+				return err
+			}
+			r.take(v)
+			return nil
+		}
+	}
+
+	atomic.AddUint64(&r.counters.rateLimitedMessages, 1)
+
+	if r.policy == RTMRateLimitReject {
+		return ErrRTMLoopRateLimited
+	}
+	if len(v.queue) >= r.backlog {
+		return ErrRTMLoopSendQueueFull
+	}
+
+	v.queue = append(v.queue, rawMessage)
+	r.schedule(vchannelId, v, r.wait(v, now), push)
+
+	return nil
+}
+
+func (r *rtmLoopLimiter) schedule(vchannelId string, v *rtmVChannelLimiter, wait time.Duration, push func([]byte) error) {
+	if v.timer != nil {
+		return
+	}
+
+	v.timer = time.AfterFunc(wait, func() {
+		r.flush(vchannelId, push)
+	})
+}
+
+// Push queued messages of a vchannel as many as allowed.
+func (r *rtmLoopLimiter) flush(vchannelId string, push func([]byte) error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	v := r.vchannel(vchannelId)
+	v.timer = nil
+
+	for len(v.queue) > 0 {
+		wait := r.wait(v, r.now())
+		if wait > 0 {
+			r.schedule(vchannelId, v, wait, push)
+			return
+		}
+
+		switch err := push(v.queue[0]); err {
+		case nil:
+			r.take(v)
+			v.queue = v.queue[1:]
+		case ErrRTMLoopSendQueueFull:
+			r.schedule(vchannelId, v, rtmLoopLimiterRetryInterval, push)
+			return
+		default:
+			// loop closed, flush again after restarted
+			return
+		}
+	}
+}
+
+// Schedule flushing for all queued messages.
+func (r *rtmLoopLimiter) resume(push func([]byte) error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for vchannelId, v := range r.vchannels {
+		if len(v.queue) > 0 {
+			r.schedule(vchannelId, v, 0, push)
+		}
+	}
+}
+
+// Queued messages of all vchannels, ordered in each vchannel.
+func (r *rtmLoopLimiter) pending() []json.RawMessage {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var pending []json.RawMessage
+	for _, v := range r.vchannels {
+		for _, rawMessage := range v.queue {
+			pending = append(pending, rawMessage)
+		}
+	}
+	return pending
+}
+
+// Observe received messages for circuit breaker.
+func (r *rtmLoopLimiter) observe(m RTMMessage) {
+	if r.breakerThreshold <= 0 || !m.IsChatMessage() || m.IsFromUID(r.breakerUID) {
+		return
+	}
+
+	vchannelId, _ := m["vchannel_id"].(string)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if v, present := r.vchannels[vchannelId]; present {
+		v.selfSends = nil
+	}
+}
+
+// Remove idle vchannels to keep memory bounded.
+func (r *rtmLoopLimiter) cleanup(now time.Time) {
+	for vchannelId, v := range r.vchannels {
+		if len(v.queue) > 0 || v.timer != nil {
+			continue
+		}
+		if v.bucket != nil {
+			v.bucket.wait(now)
+			if !v.bucket.full() {
+				continue
+			}
+		}
+		if len(v.selfSends) > 0 || now.Before(v.pausedUntil) {
+			continue
+		}
+		delete(r.vchannels, vchannelId)
+	}
+}
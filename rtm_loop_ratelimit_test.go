@@ -0,0 +1,187 @@
+package bearychat
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRTMTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newRTMTokenBucket(RTMRateLimit{Rate: 2, Burst: 2})
+
+	for i := 0; i < 2; i = i + 1 {
+		if wait := b.wait(now); wait != 0 {
+			t.Errorf("unexpected wait: %s", wait)
+		}
+		b.take()
+	}
+
+	if wait := b.wait(now); wait != 500*time.Millisecond {
+		t.Errorf("unexpected wait: %s", wait)
+	}
+	if wait := b.wait(now.Add(500 * time.Millisecond)); wait != 0 {
+		t.Errorf("unexpected wait: %s", wait)
+	}
+	if wait := b.wait(now.Add(time.Hour)); wait != 0 || !b.full() {
+		t.Errorf("unexpected wait: %s", wait)
+	}
+}
+
+func TestNewRTMLoop_RateLimitSettings(t *testing.T) {
+	setters := []rtmLoopSetter{
+		WithRTMLoopRateLimit(RTMRateLimit{}),
+		WithRTMLoopVChannelRateLimit(RTMRateLimit{Rate: 1}),
+		WithRTMLoopRateLimitPolicy(RTMRateLimitPolicy("foobar")),
+		WithRTMLoopCircuitBreaker("=bot", 0, time.Second, time.Second),
+	}
+
+	for _, setter := range setters {
+		if _, err := NewRTMLoop(testRTMWSHost, setter); err == nil {
+			t.Errorf("expected error")
+		}
+	}
+}
+
+type testRTMPusher struct {
+	lock   sync.Mutex
+	pushed []string
+	err    error
+}
+
+func (p *testRTMPusher) push(rawMessage []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	p.pushed = append(p.pushed, string(rawMessage))
+	return nil
+}
+
+func (p *testRTMPusher) count() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.pushed)
+}
+
+func TestRTMLoopLimiter_Reject(t *testing.T) {
+	l, err := NewRTMLoop(
+		testRTMWSHost,
+		WithRTMLoopVChannelRateLimit(RTMRateLimit{Rate: 1, Burst: 1}),
+		WithRTMLoopRateLimitPolicy(RTMRateLimitReject),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	p := &testRTMPusher{}
+	if err := l.limiter.send("a", []byte("1"), p.push); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := l.limiter.send("a", []byte("2"), p.push); err != ErrRTMLoopRateLimited {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	// limited per vchannel
+	if err := l.limiter.send("b", []byte("3"), p.push); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	if p.count() != 2 {
+		t.Errorf("unexpected pushed: %+v", p.pushed)
+	}
+	if stats := l.Stats(); stats.RateLimitedMessages != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRTMLoopLimiter_Queue(t *testing.T) {
+	l, err := NewRTMLoop(
+		testRTMWSHost,
+		WithRTMLoopRateLimit(RTMRateLimit{Rate: 100, Burst: 1}),
+		WithRTMLoopSendBacklog(3),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	p := &testRTMPusher{}
+	for _, m := range []string{"1", "2", "3", "4"} {
+		if err := l.limiter.send("a", []byte(m), p.push); err != nil {
+			t.Errorf("unexpected error: %+v", err)
+		}
+	}
+	if err := l.limiter.send("a", []byte("5"), p.push); err != ErrRTMLoopSendQueueFull {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	for i := 0; p.count() < 4; i = i + 1 {
+		if i > 100 {
+			t.Fatalf("queued messages should be flushed: %+v", p.pushed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, m := range []string{"1", "2", "3", "4"} {
+		if p.pushed[i] != m {
+			t.Errorf("unexpected order: %+v", p.pushed)
+		}
+	}
+}
+
+func TestRTMLoopLimiter_CircuitBreaker(t *testing.T) {
+	l, err := NewRTMLoop(
+		testRTMWSHost,
+		WithRTMLoopCircuitBreaker("=bot", 2, time.Minute, time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	now := time.Now()
+	l.limiter.now = func() time.Time { return now }
+
+	p := &testRTMPusher{}
+	send := func() error {
+		return l.limiter.send("a", []byte("foobar"), p.push)
+	}
+
+	send()
+	send()
+	// someone else talked
+	l.limiter.observe(RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"uid":         "=user",
+		"vchannel_id": "a",
+	})
+	// bot's own message doesn't reset
+	l.limiter.observe(RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"uid":         "=bot",
+		"vchannel_id": "a",
+	})
+
+	if err := send(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := send(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := send(); err != ErrRTMLoopVChannelPaused {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	now = now.Add(30 * time.Second)
+	if err := send(); err != ErrRTMLoopVChannelPaused {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := send(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
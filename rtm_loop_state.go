@@ -0,0 +1,88 @@
+package bearychat
+
+import (
+	"sync"
+	"time"
+)
+
+// rtmLoopSubscribers receives state changes of a loop.
+type rtmLoopSubscribers struct {
+	lock        sync.Mutex // lock for subscribers
+	subscribers map[chan RTMLoopStateChange]struct{}
+}
+
+func newRTMLoopSubscribers() *rtmLoopSubscribers {
+	return &rtmLoopSubscribers{
+		subscribers: make(map[chan RTMLoopStateChange]struct{}),
+	}
+}
+
+// Publish a change without blocking, dropped if a subscriber is full.
+func (s *rtmLoopSubscribers) publish(change RTMLoopStateChange) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for c := range s.subscribers {
+		select {
+		case c <- change:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving state changes in order, and a func
+// for unsubscribing which closes the channel.
+//
+//      changes, unsubscribe := loop.Subscribe(16)
+//      defer unsubscribe()
+//      for change := range changes {
+//              log.Printf("%s -> %s at %s: %s", change.From, change.To, change.At, change.Reason)
+//      }
+//
+// Changes are dropped when the channel is full, so the loop is never
+// blocked by slow subscribers.
+func (l *rtmLoop) Subscribe(backlog int) (<-chan RTMLoopStateChange, func()) {
+	return l.subscribers.subscribe(backlog)
+}
+
+func (s *rtmLoopSubscribers) subscribe(backlog int) (<-chan RTMLoopStateChange, func()) {
+	if backlog < 0 {
+		backlog = 0
+	}
+	c := make(chan RTMLoopStateChange, backlog)
+
+	s.lock.Lock()
+	s.subscribers[c] = struct{}{}
+	s.lock.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+
+			delete(s.subscribers, c)
+			close(c)
+		})
+	}
+
+	return c, unsubscribe
+}
+
+// Transit to a new state and notify subscribers, llock should be held.
+func (l *rtmLoop) setState(state RTMLoopState, reason string, err error) {
+	if l.state == state {
+		return
+	}
+
+	change := RTMLoopStateChange{
+		From:   l.state,
+		To:     state,
+		Reason: reason,
+		Err:    err,
+		At:     time.Now(),
+	}
+	l.state = state
+
+	l.subscribers.publish(change)
+}
@@ -0,0 +1,94 @@
+package bearychat
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func expectRTMLoopStateChanges(t *testing.T, changes <-chan RTMLoopStateChange, states ...RTMLoopState) []RTMLoopStateChange {
+	var received []RTMLoopStateChange
+	for _, state := range states {
+		select {
+		case change := <-changes:
+			if change.To != state {
+				t.Errorf("expected %s, got: %+v", state, change)
+			}
+			if change.At.IsZero() || change.Reason == "" {
+				t.Errorf("unexpected change: %+v", change)
+			}
+			received = append(received, change)
+		case <-time.After(time.Second):
+			t.Fatalf("expected state change to %s", state)
+		}
+	}
+	return received
+}
+
+func TestRTMLoop_Subscribe(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	l, err := NewRTMLoop(s.WSHost())
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	changes, unsubscribe := l.Subscribe(16)
+
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expectRTMLoopStateChanges(t, changes, RTMLoopStateConnecting, RTMLoopStateOpen)
+
+	// server goes away
+	conn := <-s.conns
+	conn.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+	)
+	failed := expectRTMLoopStateChanges(t, changes, RTMLoopStateFailed)
+	if !errors.Is(failed[0].Err, ErrRTMLoopConnClosed) {
+		t.Errorf("unexpected error: %+v", failed[0].Err)
+	}
+
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	<-s.conns
+	expectRTMLoopStateChanges(t, changes, RTMLoopStateReconnecting, RTMLoopStateOpen)
+
+	if err := l.Stop(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	expectRTMLoopStateChanges(t, changes, RTMLoopStateClosing, RTMLoopStateClosed)
+
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-changes; ok {
+		t.Errorf("channel should be closed after unsubscribed")
+	}
+}
+
+func TestRTMLoop_Start_DialFailed(t *testing.T) {
+	l, err := NewRTMLoop("ws://127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	changes, unsubscribe := l.Subscribe(16)
+	defer unsubscribe()
+
+	if err := l.Start(); err == nil {
+		t.Fatalf("expected error")
+	}
+	failed := expectRTMLoopStateChanges(t, changes, RTMLoopStateConnecting, RTMLoopStateFailed)
+	if failed[1].Err == nil {
+		t.Errorf("expected error: %+v", failed[1])
+	}
+
+	if err := l.Stop(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	expectRTMLoopStateChanges(t, changes, RTMLoopStateClosed)
+}
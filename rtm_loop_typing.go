@@ -0,0 +1,153 @@
+package bearychat
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DEFAULT_RTM_LOOP_TYPING_INTERVAL = 3 * time.Second
+
+// Set interval of sending typing events, defaults to 3 seconds.
+func WithRTMLoopTypingInterval(interval time.Duration) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if interval <= 0 {
+			return errors.New("typing interval should be positive")
+		}
+		r.typingInterval = interval
+		return nil
+	}
+}
+
+// rtmLoopTypings tracks typing indicators by vchannel.
+type rtmLoopTypings struct {
+	lock     sync.Mutex
+	watching map[string]*rtmLoopTyping
+}
+
+// rtmLoopTyping is shared by Typing calls of a vchannel.
+type rtmLoopTyping struct {
+	repliedC chan struct{} // closed after replied to vchannel
+	watchers int
+}
+
+func newRTMLoopTypings() *rtmLoopTypings {
+	return &rtmLoopTypings{watching: make(map[string]*rtmLoopTyping)}
+}
+
+func (t *rtmLoopTypings) watch(vchannelId string) chan struct{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	typing, present := t.watching[vchannelId]
+	if !present {
+		typing = &rtmLoopTyping{repliedC: make(chan struct{})}
+		t.watching[vchannelId] = typing
+	}
+	typing.watchers = typing.watchers + 1
+	return typing.repliedC
+}
+
+// Stop watching with repliedC returned by watch, the vchannel is
+// forgotten after all watchers stopped.
+func (t *rtmLoopTypings) unwatch(vchannelId string, repliedC chan struct{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	typing, present := t.watching[vchannelId]
+	if !present || typing.repliedC != repliedC {
+		// replied already
+		return
+	}
+	typing.watchers = typing.watchers - 1
+	if typing.watchers <= 0 {
+		delete(t.watching, vchannelId)
+	}
+}
+
+func (t *rtmLoopTypings) replied(vchannelId string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if typing, present := t.watching[vchannelId]; present {
+		close(typing.repliedC)
+		delete(t.watching, vchannelId)
+	}
+}
+
+// Typing keeps sending typing events to the message's vchannel until ctx is
+// done or a message is sent to the vchannel. It returns after the first
+// typing event queued.
+//
+//      loop.Typing(ctx, message)
+//      output := runSlowBuild()
+//      loop.Send(message.Refer(output))
+//
+// Typing events are queued with messages without rate limiting, the
+// control queue is kept for pings.
+func (l *rtmLoop) Typing(ctx context.Context, m RTMMessage) error {
+	typing, err := newRTMTyping(m)
+	if err != nil {
+		return err
+	}
+	vchannelId := typing["vchannel_id"].(string)
+
+	repliedC := l.typings.watch(vchannelId)
+	if err := l.sendTyping(typing); err != nil {
+		l.typings.unwatch(vchannelId, repliedC)
+		return err
+	}
+
+	go func() {
+		defer l.typings.unwatch(vchannelId, repliedC)
+
+		ticker := time.NewTicker(l.typingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-repliedC:
+				return
+			case <-ticker.C:
+				// typing is best effort, only stops after loop closed
+				if err := l.sendTyping(typing); err == ErrRTMLoopClosed {
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (l *rtmLoop) sendTyping(typing RTMMessage) error {
+	m := RTMMessage{}
+	for k, v := range typing {
+		m[k] = v
+	}
+
+	return l.enqueue(l.sendC, m)
+}
+
+// Build typing event for replying the message.
+func newRTMTyping(m RTMMessage) (RTMMessage, error) {
+	vchannelId, _ := m["vchannel_id"].(string)
+	if vchannelId == "" {
+		return nil, errors.New("`vchannel_id` is required for typing")
+	}
+
+	typing := RTMMessage{"vchannel_id": vchannelId}
+	if m.IsP2P() {
+		typing["type"] = RTMMessageTypeP2PTyping
+		typing["to_uid"] = m["uid"]
+	} else {
+		typing["type"] = RTMMessageTypeChannelTyping
+		typing["channel_id"] = m["channel_id"]
+	}
+
+	return typing, nil
+}
@@ -0,0 +1,158 @@
+package bearychat
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNewRTMTyping(t *testing.T) {
+	typing, err := newRTMTyping(RTMMessage{
+		"type":        RTMMessageTypeP2PMessage,
+		"uid":         "=bw52O",
+		"vchannel_id": "foobar",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if typing.Type() != RTMMessageTypeP2PTyping || typing["to_uid"] != "=bw52O" {
+		t.Errorf("unexpected typing: %+v", typing)
+	}
+
+	typing, err = newRTMTyping(RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"channel_id":  "=bw52Q",
+		"vchannel_id": "foobar",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if typing.Type() != RTMMessageTypeChannelTyping || typing["channel_id"] != "=bw52Q" {
+		t.Errorf("unexpected typing: %+v", typing)
+	}
+
+	if _, err := newRTMTyping(RTMMessage{}); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestRTMLoop_Typing(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	l, err := NewRTMLoop(s.WSHost(), WithRTMLoopTypingInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	m := RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"channel_id":  "foobar",
+		"vchannel_id": "foobar",
+	}
+	if err := l.Typing(context.Background(), m); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	for i := 0; i < 3; i = i + 1 {
+		if typing := s.expectReceived(t); typing.Type() != RTMMessageTypeChannelTyping {
+			t.Errorf("unexpected typing: %+v", typing)
+		}
+	}
+
+	if err := l.Send(m.Reply("done")); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	// typing stops after replied
+	time.Sleep(30 * time.Millisecond)
+	for len(s.received) > 0 {
+		<-s.received
+	}
+	select {
+	case received := <-s.received:
+		t.Errorf("unexpected typing after replied: %+v", received)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRTMLoop_Typing_Cancel(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	l, err := NewRTMLoop(s.WSHost(), WithRTMLoopTypingInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := RTMMessage{
+		"type":        RTMMessageTypeP2PMessage,
+		"uid":         "foobar",
+		"vchannel_id": "foobar",
+	}
+	if err := l.Typing(ctx, m); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	s.expectReceived(t)
+	cancel()
+
+	time.Sleep(30 * time.Millisecond)
+	for len(s.received) > 0 {
+		<-s.received
+	}
+	select {
+	case received := <-s.received:
+		t.Errorf("unexpected typing after canceled: %+v", received)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRTMLoop_Typing_KeepsPingQueue(t *testing.T) {
+	l, err := NewRTMLoop(testRTMWSHost, WithRTMLoopTypingInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	// pretend opened without a writer draining the queues
+	l.state = RTMLoopStateOpen
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < rtmLoopControlBacklog*2; i = i + 1 {
+		m := RTMMessage{
+			"type":        RTMMessageTypeChannelMessage,
+			"channel_id":  "foobar",
+			"vchannel_id": fmt.Sprintf("foobar%d", i),
+		}
+		if err := l.Typing(ctx, m); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+	}
+	if err := l.Ping(); err != nil {
+		t.Errorf("ping should not be blocked by typing: %+v", err)
+	}
+
+	// watchers are forgotten after canceled
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		l.typings.lock.Lock()
+		watching := len(l.typings.watching)
+		l.typings.lock.Unlock()
+		if watching == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected watching vchannels: %d", watching)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
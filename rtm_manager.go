@@ -0,0 +1,369 @@
+package bearychat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DEFAULT_RTM_MANAGER_BACKLOG = 1024
+
+// RTMManagerEvent is a message or an error from a managed bot.
+type RTMManagerEvent struct {
+	// Name of the bot
+	Bot    string
+	TeamId string
+	UID    string
+
+	// Received message, nil for errors
+	Message RTMMessage
+	// Error from the bot's loop, nil for messages
+	Err error
+}
+
+// RTMBotHealth reports status of a managed bot.
+type RTMBotHealth struct {
+	Bot    string
+	TeamId string
+	UID    string
+
+	State RTMLoopState
+	Stats RTMLoopStats
+
+	// Times the bot restarted by RTMManager.Restart
+	Restarts      int
+	LastMessageAt time.Time
+	LastError     error
+	LastErrorAt   time.Time
+}
+
+// Healthy tells if the bot is connected.
+func (h RTMBotHealth) Healthy() bool {
+	return h.State == RTMLoopStateOpen
+}
+
+// RTMManager runs many bots, possibly in different teams, and fans their
+// messages & errors into one channel.
+//
+//      manager, _ := NewRTMManager()
+//      manager.Add("deploy", deployToken)
+//      manager.Add("oncall", oncallToken, WithRTMLoopBacklog(64))
+//      manager.Start()
+//      defer manager.Stop()
+//
+//      for event := range manager.EventC() {
+//              if event.Err != nil && errors.Is(event.Err, ErrRTMLoopFatal) {
+//                      go manager.Restart(event.Bot)
+//              }
+//      }
+type RTMManager struct {
+	eventC chan RTMManagerEvent
+
+	bots  map[string]*rtmManagedBot
+	lock  *sync.Mutex // lock for bots and their health
+	clock func() time.Time
+
+	// build context for a bot, calls rtm.start
+	newContext func(token string, setters ...rtmLoopSetter) (*RTMContext, error)
+}
+
+type rtmManagedBot struct {
+	name    string
+	token   string
+	setters []rtmLoopSetter
+
+	lifecycle sync.Mutex    // serializes start & stop
+	context   *RTMContext   // nil before started
+	stopC     chan struct{} // closed for stopping the pump, nil if stopped
+	doneC     chan struct{} // closed after the pump exited
+
+	restarts      int
+	lastMessageAt time.Time
+	lastError     error
+	lastErrorAt   time.Time
+}
+
+type rtmManagerSetter func(*RTMManager) error
+
+// Set event channel backlog, defaults to 1024.
+func WithRTMManagerBacklog(backlog int) rtmManagerSetter {
+	return func(m *RTMManager) error {
+		if backlog < 0 {
+			return errors.New("backlog should not be negative")
+		}
+		m.eventC = make(chan RTMManagerEvent, backlog)
+		return nil
+	}
+}
+
+func NewRTMManager(setters ...rtmManagerSetter) (*RTMManager, error) {
+	m := &RTMManager{
+		eventC: make(chan RTMManagerEvent, DEFAULT_RTM_MANAGER_BACKLOG),
+
+		bots:  make(map[string]*rtmManagedBot),
+		lock:  &sync.Mutex{},
+		clock: time.Now,
+
+		newContext: NewRTMContext,
+	}
+
+	for _, setter := range setters {
+		if err := setter(m); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Add registers a bot by name, loop setters are used for every (re)start.
+// The bot won't connect until Start or Restart is called.
+func (m *RTMManager) Add(name, token string, setters ...rtmLoopSetter) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, present := m.bots[name]; present {
+		return errors.Errorf("bot %s already added", name)
+	}
+
+	m.bots[name] = &rtmManagedBot{
+		name:    name,
+		token:   token,
+		setters: setters,
+	}
+	return nil
+}
+
+// Remove stops the bot and unregisters it.
+func (m *RTMManager) Remove(name string) error {
+	bot, err := m.bot(name)
+	if err != nil {
+		return err
+	}
+
+	err = m.stopBot(bot)
+
+	m.lock.Lock()
+	delete(m.bots, name)
+	m.lock.Unlock()
+
+	return err
+}
+
+// Bots returns names of registered bots.
+func (m *RTMManager) Bots() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	names := make([]string, 0, len(m.bots))
+	for name := range m.bots {
+		names = append(names, name)
+	}
+	return names
+}
+
+// EventC returns the channel receiving messages & errors of all bots.
+// It's never closed, so the manager can be started again after stopped.
+func (m *RTMManager) EventC() chan RTMManagerEvent {
+	return m.eventC
+}
+
+// Start connects all bots which are not running. Failed bots are skipped
+// and the first error is returned.
+func (m *RTMManager) Start() error {
+	var firstErr error
+	for _, bot := range m.snapshot() {
+		if err := m.startBot(bot); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Stop disconnects all bots, the first error is returned.
+func (m *RTMManager) Stop() error {
+	var firstErr error
+	for _, bot := range m.snapshot() {
+		if err := m.stopBot(bot); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Restart reconnects a bot with a new context, other bots are not affected.
+func (m *RTMManager) Restart(name string) error {
+	bot, err := m.bot(name)
+	if err != nil {
+		return err
+	}
+
+	bot.lifecycle.Lock()
+	defer bot.lifecycle.Unlock()
+
+	// the old loop may be broken already, stopping errors don't matter
+	m.stopBotLocked(bot)
+
+	m.lock.Lock()
+	bot.restarts = bot.restarts + 1
+	m.lock.Unlock()
+
+	return m.startBotLocked(bot)
+}
+
+// Health reports status of all bots by name.
+func (m *RTMManager) Health() map[string]RTMBotHealth {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	health := make(map[string]RTMBotHealth, len(m.bots))
+	for name, bot := range m.bots {
+		h := RTMBotHealth{
+			Bot:           name,
+			State:         RTMLoopStateClosed,
+			Restarts:      bot.restarts,
+			LastMessageAt: bot.lastMessageAt,
+			LastError:     bot.lastError,
+			LastErrorAt:   bot.lastErrorAt,
+		}
+		if bot.context != nil {
+			h.TeamId = bot.context.TeamId()
+			h.UID = bot.context.UID()
+			h.State = bot.context.Loop.State()
+			h.Stats = bot.context.Loop.Stats()
+		}
+		health[name] = h
+	}
+	return health
+}
+
+func (m *RTMManager) bot(name string) (*rtmManagedBot, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bot, present := m.bots[name]
+	if !present {
+		return nil, errors.Errorf("bot %s not found", name)
+	}
+	return bot, nil
+}
+
+func (m *RTMManager) snapshot() []*rtmManagedBot {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bots := make([]*rtmManagedBot, 0, len(m.bots))
+	for _, bot := range m.bots {
+		bots = append(bots, bot)
+	}
+	return bots
+}
+
+func (m *RTMManager) startBot(bot *rtmManagedBot) error {
+	bot.lifecycle.Lock()
+	defer bot.lifecycle.Unlock()
+
+	return m.startBotLocked(bot)
+}
+
+func (m *RTMManager) startBotLocked(bot *rtmManagedBot) error {
+	if bot.stopC != nil {
+		return nil
+	}
+
+	rtmContext, err := m.newContext(bot.token, bot.setters...)
+	if err != nil {
+		err = errors.Wrapf(err, "create context for bot %s failed", bot.name)
+		m.recordError(bot, err)
+		return err
+	}
+
+	err, messageC, errC := rtmContext.Run()
+	if err != nil {
+		err = errors.Wrapf(err, "start bot %s failed", bot.name)
+		m.recordError(bot, err)
+		return err
+	}
+
+	stopC := make(chan struct{})
+	doneC := make(chan struct{})
+
+	m.lock.Lock()
+	bot.context = rtmContext
+	m.lock.Unlock()
+	bot.stopC = stopC
+	bot.doneC = doneC
+
+	go m.pump(bot, rtmContext, messageC, errC, stopC, doneC)
+
+	return nil
+}
+
+func (m *RTMManager) stopBot(bot *rtmManagedBot) error {
+	bot.lifecycle.Lock()
+	defer bot.lifecycle.Unlock()
+
+	return m.stopBotLocked(bot)
+}
+
+func (m *RTMManager) stopBotLocked(bot *rtmManagedBot) error {
+	if bot.stopC == nil {
+		return nil
+	}
+
+	close(bot.stopC)
+	err := bot.context.Loop.Stop()
+	<-bot.doneC
+
+	bot.stopC = nil
+	bot.doneC = nil
+
+	return err
+}
+
+// Forward messages & errors of a bot with tags until stopped.
+func (m *RTMManager) pump(
+	bot *rtmManagedBot,
+	rtmContext *RTMContext,
+	messageC chan RTMMessage,
+	errC chan error,
+	stopC, doneC chan struct{},
+) {
+	defer close(doneC)
+
+	for {
+		event := RTMManagerEvent{
+			Bot:    bot.name,
+			TeamId: rtmContext.TeamId(),
+			UID:    rtmContext.UID(),
+		}
+
+		select {
+		case <-stopC:
+			return
+		case message := <-messageC:
+			m.lock.Lock()
+			bot.lastMessageAt = m.clock()
+			m.lock.Unlock()
+			event.Message = message
+		case err := <-errC:
+			m.recordError(bot, err)
+			event.Err = err
+		}
+
+		select {
+		case <-stopC:
+			return
+		case m.eventC <- event:
+		}
+	}
+}
+
+func (m *RTMManager) recordError(bot *rtmManagedBot, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bot.lastError = err
+	bot.lastErrorAt = m.clock()
+}
@@ -0,0 +1,158 @@
+package bearychat
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestRTMManager(t *testing.T, servers map[string]*testRTMServer) *RTMManager {
+	m, err := NewRTMManager()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	m.newContext = func(token string, setters ...rtmLoopSetter) (*RTMContext, error) {
+		s, present := servers[token]
+		if !present {
+			return nil, errors.New("invalid token")
+		}
+		loop, err := NewRTMLoop(s.WSHost(), setters...)
+		if err != nil {
+			return nil, err
+		}
+		return &RTMContext{Loop: loop, uid: "uid-" + token, teamId: "team-" + token}, nil
+	}
+	return m
+}
+
+func expectRTMManagerEvent(t *testing.T, m *RTMManager) RTMManagerEvent {
+	select {
+	case event := <-m.EventC():
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("expected event")
+	}
+	return RTMManagerEvent{}
+}
+
+func TestRTMManager_FanIn(t *testing.T) {
+	a, b := newTestRTMServer(t), newTestRTMServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	m := newTestRTMManager(t, map[string]*testRTMServer{"a": a, "b": b})
+	if err := m.Add("alice", "a"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := m.Add("bob", "b"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := m.Add("bob", "b"); err == nil {
+		t.Errorf("expected error for duplicated bot")
+	}
+
+	if err := m.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer m.Stop()
+
+	(<-a.conns).WriteJSON(RTMMessage{"type": RTMMessageTypeChannelMessage, "text": "from a"})
+	event := expectRTMManagerEvent(t, m)
+	if event.Bot != "alice" || event.UID != "uid-a" || event.TeamId != "team-a" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	if event.Message.Text() != "from a" || event.Err != nil {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	(<-b.conns).WriteJSON(RTMMessage{"type": RTMMessageTypeChannelMessage, "text": "from b"})
+	event = expectRTMManagerEvent(t, m)
+	if event.Bot != "bob" || event.Message.Text() != "from b" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	health := m.Health()
+	if !health["alice"].Healthy() || !health["bob"].Healthy() {
+		t.Errorf("unexpected health: %+v", health)
+	}
+	if health["alice"].LastMessageAt.IsZero() {
+		t.Errorf("unexpected health: %+v", health["alice"])
+	}
+}
+
+func TestRTMManager_Restart(t *testing.T) {
+	a, b := newTestRTMServer(t), newTestRTMServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	m := newTestRTMManager(t, map[string]*testRTMServer{"a": a, "b": b})
+	m.Add("alice", "a")
+	m.Add("bob", "b")
+	if err := m.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer m.Stop()
+
+	connA := <-a.conns
+	<-b.conns
+	connA.Close()
+
+	event := expectRTMManagerEvent(t, m)
+	if event.Bot != "alice" || !errors.Is(event.Err, ErrRTMLoopFatal) {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	health := m.Health()
+	if health["alice"].Healthy() || health["alice"].LastError == nil {
+		t.Errorf("unexpected health: %+v", health["alice"])
+	}
+	if !health["bob"].Healthy() {
+		t.Errorf("unexpected health: %+v", health["bob"])
+	}
+
+	if err := m.Restart("alice"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	(<-a.conns).WriteJSON(RTMMessage{"type": RTMMessageTypeChannelMessage, "text": "back"})
+	event = expectRTMManagerEvent(t, m)
+	if event.Bot != "alice" || event.Message.Text() != "back" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	health = m.Health()
+	if !health["alice"].Healthy() || health["alice"].Restarts != 1 {
+		t.Errorf("unexpected health: %+v", health["alice"])
+	}
+
+	if err := m.Restart("carol"); err == nil {
+		t.Errorf("expected error for unknown bot")
+	}
+}
+
+func TestRTMManager_StartFailed(t *testing.T) {
+	a := newTestRTMServer(t)
+	defer a.Close()
+
+	m := newTestRTMManager(t, map[string]*testRTMServer{"a": a})
+	m.Add("alice", "a")
+	m.Add("mallory", "invalid")
+
+	if err := m.Start(); err == nil {
+		t.Errorf("expected error")
+	}
+	defer m.Stop()
+
+	health := m.Health()
+	if !health["alice"].Healthy() {
+		t.Errorf("unexpected health: %+v", health["alice"])
+	}
+	if health["mallory"].State != RTMLoopStateClosed || health["mallory"].LastError == nil {
+		t.Errorf("unexpected health: %+v", health["mallory"])
+	}
+
+	if err := m.Remove("mallory"); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if bots := m.Bots(); len(bots) != 1 || bots[0] != "alice" {
+		t.Errorf("unexpected bots: %+v", bots)
+	}
+}
@@ -35,20 +35,15 @@ func (m RTMMessage) Type() RTMMessageType {
 
 // Reply a message (with copying type, vchannel_id)
 func (m RTMMessage) Reply(text string) RTMMessage {
-	reply := RTMMessage{
-		"text":        text,
-		"vchannel_id": m["vchannel_id"],
-	}
+	vchannelId, _ := m["vchannel_id"].(string)
 
 	if m.IsP2P() {
-		reply["type"] = RTMMessageTypeP2PMessage
-		reply["to_uid"] = m["uid"]
-	} else {
-		reply["type"] = RTMMessageTypeChannelMessage
-		reply["channel_id"] = m["channel_id"]
+		uid, _ := m["uid"].(string)
+		return newRTMP2PMessage(uid, vchannelId, text)
 	}
 
-	return reply
+	channelId, _ := m["channel_id"].(string)
+	return newRTMChannelMessage(channelId, vchannelId, text)
 }
 
 // Refer a message
@@ -93,6 +88,27 @@ func (m RTMMessage) Text() string {
 	return ""
 }
 
+// CreatedTS returns message created timestamp in milliseconds.
+func (m RTMMessage) CreatedTS() int64 {
+	switch ts := m["created_ts"].(type) {
+	case float64:
+		return int64(ts)
+	case int64:
+		return ts
+	case int:
+		return int64(ts)
+	}
+
+	return 0
+}
+
+// IsBackfilled tells if this message is fetched from history
+// after reconnected, see RTMBackfill.
+func (m RTMMessage) IsBackfilled() bool {
+	backfilled, _ := m["backfilled"].(bool)
+	return backfilled
+}
+
 func (m RTMMessage) ParseMentionUser(u User) (bool, string) {
 	return m.ParseMentionUID(u.Id)
 }
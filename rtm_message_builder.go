@@ -0,0 +1,132 @@
+package bearychat
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+type rtmMessageSetter func(RTMMessage) error
+
+// Render message text as markdown.
+func WithRTMMessageMarkdown(enabled bool) rtmMessageSetter {
+	return func(m RTMMessage) error {
+		m["markdown"] = enabled
+		return nil
+	}
+}
+
+// Append attachments to message.
+func WithRTMMessageAttachments(attachments ...IncomingAttachment) rtmMessageSetter {
+	return func(m RTMMessage) error {
+		existing, _ := m["attachments"].([]IncomingAttachment)
+		m["attachments"] = append(existing, attachments...)
+		return nil
+	}
+}
+
+// Refer a message by its key.
+func WithRTMMessageRefer(key string) rtmMessageSetter {
+	return func(m RTMMessage) error {
+		if key == "" {
+			return fmt.Errorf("`refer_key` should not be empty")
+		}
+		m["refer_key"] = key
+		return nil
+	}
+}
+
+// NewP2PMessage builds a p2p message to the user.
+//
+//      m, err := NewP2PMessage(user, "hello", WithRTMMessageMarkdown(true))
+//      loop.Send(m)
+func NewP2PMessage(user *User, text string, setters ...rtmMessageSetter) (RTMMessage, error) {
+	if user == nil {
+		return nil, fmt.Errorf("user is required for p2p message")
+	}
+
+	return buildRTMMessage(
+		newRTMP2PMessage(user.Id, user.VChannelId, text),
+		setters,
+	)
+}
+
+// NewChannelMessage builds a message to the channel.
+func NewChannelMessage(channel *Channel, text string, setters ...rtmMessageSetter) (RTMMessage, error) {
+	if channel == nil {
+		return nil, fmt.Errorf("channel is required for channel message")
+	}
+
+	return buildRTMMessage(
+		newRTMChannelMessage(channel.Id, channel.VChannelId, text),
+		setters,
+	)
+}
+
+func buildRTMMessage(m RTMMessage, setters []rtmMessageSetter) (RTMMessage, error) {
+	for _, setter := range setters {
+		if err := setter(m); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func newRTMP2PMessage(uid, vchannelId, text string) RTMMessage {
+	return RTMMessage{
+		"type":        RTMMessageTypeP2PMessage,
+		"to_uid":      uid,
+		"vchannel_id": vchannelId,
+		"text":        text,
+	}
+}
+
+func newRTMChannelMessage(channelId, vchannelId, text string) RTMMessage {
+	return RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"channel_id":  channelId,
+		"vchannel_id": vchannelId,
+		"text":        text,
+	}
+}
+
+// Validate required fields of chat messages, other messages are not
+// validated.
+func (m RTMMessage) Validate() error {
+	if !m.IsChatMessage() {
+		return nil
+	}
+
+	if vchannelId, _ := m["vchannel_id"].(string); vchannelId == "" {
+		return fmt.Errorf("`vchannel_id` is required for chat message")
+	}
+
+	if m.Type() == RTMMessageTypeP2PMessage {
+		if uid, _ := m["to_uid"].(string); uid == "" {
+			return fmt.Errorf("`to_uid` is required for p2p message")
+		}
+	} else {
+		if channelId, _ := m["channel_id"].(string); channelId == "" {
+			return fmt.Errorf("`channel_id` is required for channel message")
+		}
+	}
+
+	attachments, _ := m["attachments"].([]IncomingAttachment)
+	// attachments are decoded as []interface{} after JSON round trip
+	decoded, _ := m["attachments"].([]interface{})
+	if m.Text() == "" && len(attachments) == 0 && len(decoded) == 0 {
+		return fmt.Errorf("`text`/`attachments` is required for chat message")
+	}
+	for i, a := range attachments {
+		if err := a.Validate(); err != nil {
+			return errors.Wrapf(err, "#%d attachment validate failed", i)
+		}
+	}
+
+	return nil
+}
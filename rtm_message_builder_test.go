@@ -0,0 +1,104 @@
+package bearychat
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewP2PMessage(t *testing.T) {
+	user := &User{Id: "=bw52O", VChannelId: "=bw52O=bw52P"}
+	m, err := NewP2PMessage(
+		user,
+		"hello",
+		WithRTMMessageMarkdown(true),
+		WithRTMMessageRefer("foobar"),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if m.Type() != RTMMessageTypeP2PMessage || m["to_uid"] != user.Id || m["vchannel_id"] != user.VChannelId {
+		t.Errorf("unexpected message: %+v", m)
+	}
+	if m.Text() != "hello" || m["markdown"] != true || m["refer_key"] != "foobar" {
+		t.Errorf("unexpected message: %+v", m)
+	}
+}
+
+func TestNewChannelMessage(t *testing.T) {
+	channel := &Channel{Id: "=bw52Q", VChannelId: "=bw52Q"}
+	attachment := IncomingAttachment{Title: "foo"}
+	m, err := NewChannelMessage(channel, "", WithRTMMessageAttachments(attachment))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if m.Type() != RTMMessageTypeChannelMessage || m["channel_id"] != channel.Id {
+		t.Errorf("unexpected message: %+v", m)
+	}
+	if attachments := m["attachments"].([]IncomingAttachment); len(attachments) != 1 {
+		t.Errorf("unexpected attachments: %+v", attachments)
+	}
+}
+
+func TestRTMMessage_Validate_DecodedAttachments(t *testing.T) {
+	channel := &Channel{Id: "=bw52Q", VChannelId: "=bw52Q"}
+	built, err := NewChannelMessage(channel, "", WithRTMMessageAttachments(IncomingAttachment{Title: "foo"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	buf, _ := json.Marshal(built)
+	m := RTMMessage{}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	m["attachments"] = []interface{}{}
+	if err := m.Validate(); err == nil {
+		t.Errorf("expected error for empty attachments")
+	}
+}
+
+func TestNewRTMMessage_Invalid(t *testing.T) {
+	cases := []struct {
+		name  string
+		build func() (RTMMessage, error)
+	}{
+		{"nil user", func() (RTMMessage, error) { return NewP2PMessage(nil, "hi") }},
+		{"nil channel", func() (RTMMessage, error) { return NewChannelMessage(nil, "hi") }},
+		{"no uid", func() (RTMMessage, error) { return NewP2PMessage(&User{VChannelId: "a"}, "hi") }},
+		{"no vchannel", func() (RTMMessage, error) { return NewChannelMessage(&Channel{Id: "a"}, "hi") }},
+		{"no text", func() (RTMMessage, error) { return NewChannelMessage(&Channel{Id: "a", VChannelId: "a"}, "") }},
+		{"empty refer", func() (RTMMessage, error) {
+			return NewP2PMessage(&User{Id: "a", VChannelId: "a"}, "hi", WithRTMMessageRefer(""))
+		}},
+		{"invalid attachment", func() (RTMMessage, error) {
+			return NewP2PMessage(&User{Id: "a", VChannelId: "a"}, "hi", WithRTMMessageAttachments(IncomingAttachment{}))
+		}},
+	}
+
+	for _, c := range cases {
+		if m, err := c.build(); err == nil {
+			t.Errorf("%s: expected error, got: %+v", c.name, m)
+		}
+	}
+}
+
+func TestRTMLoop_Send_Invalid(t *testing.T) {
+	l, err := NewRTMLoop("ws://localhost")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	l.state = RTMLoopStateOpen
+
+	if err := l.Send(RTMMessage{"type": RTMMessageTypeP2PMessage, "text": "hi"}); err == nil {
+		t.Errorf("expected error for invalid message")
+	}
+	if len(l.sendC) != 0 {
+		t.Errorf("invalid message should not be queued")
+	}
+}
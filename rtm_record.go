@@ -0,0 +1,194 @@
+package bearychat
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RTMRecordDirection tells if a recorded frame is received or sent.
+type RTMRecordDirection string
+
+const (
+	RTMRecordInbound  RTMRecordDirection = "in"
+	RTMRecordOutbound RTMRecordDirection = "out"
+)
+
+// RTMRecord is a recorded frame, written as a JSON line.
+type RTMRecord struct {
+	At        time.Time          `json:"at"`
+	Direction RTMRecordDirection `json:"direction"`
+	Message   RTMMessage         `json:"message"`
+}
+
+// ReadRTMRecords reads records written by RTMRecorder.
+func ReadRTMRecords(r io.Reader) ([]RTMRecord, error) {
+	var records []RTMRecord
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var record RTMRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode record #%d failed", len(records)+1)
+		}
+		records = append(records, record)
+	}
+}
+
+// RTMRecorder wraps a loop and records received & sent messages as JSON
+// lines. It can be used in place of the wrapped loop.
+//
+//      f, _ := os.Create("rtm.jsonl")
+//      recorder := NewRTMRecorder(loop, f)
+//      defer f.Close()
+//      defer recorder.Close()
+//
+//      messageC, _ := recorder.ReadC()
+//
+// Recorded file can be played back with ReplayLoop.
+type RTMRecorder struct {
+	RTMLoop
+
+	writer io.Writer
+	wlock  *sync.Mutex // lock for writer & writeErr
+	// first write error
+	writeErr error
+
+	rtmC   chan RTMMessage
+	once   *sync.Once // starts forwarding on first ReadC
+	closeC chan struct{}
+	clock  func() time.Time
+}
+
+func NewRTMRecorder(loop RTMLoop, w io.Writer) *RTMRecorder {
+	return &RTMRecorder{
+		RTMLoop: loop,
+
+		writer: w,
+		wlock:  &sync.Mutex{},
+
+		rtmC:   make(chan RTMMessage),
+		once:   &sync.Once{},
+		closeC: make(chan struct{}),
+		clock:  time.Now,
+	}
+}
+
+// ReadC returns a channel receiving messages from the wrapped loop, which
+// are recorded before delivered.
+func (r *RTMRecorder) ReadC() (chan RTMMessage, error) {
+	messageC, err := r.RTMLoop.ReadC()
+	if err != nil {
+		return nil, err
+	}
+
+	r.once.Do(func() {
+		go r.forward(messageC)
+	})
+
+	return r.rtmC, nil
+}
+
+func (r *RTMRecorder) forward(messageC chan RTMMessage) {
+	for {
+		select {
+		case <-r.closeC:
+			return
+		case m := <-messageC:
+			r.record(RTMRecordInbound, m)
+
+			select {
+			case <-r.closeC:
+				return
+			case r.rtmC <- m:
+			}
+		}
+	}
+}
+
+// Send records the message after it's queued by the wrapped loop.
+func (r *RTMRecorder) Send(m RTMMessage) error {
+	if err := r.RTMLoop.Send(m); err != nil {
+		return err
+	}
+
+	r.record(RTMRecordOutbound, m)
+	return nil
+}
+
+// Typing records the typing event after it's queued by the wrapped loop.
+// Repeated typing events are sent by the wrapped loop, which aren't
+// recorded.
+func (r *RTMRecorder) Typing(ctx context.Context, m RTMMessage) error {
+	if err := r.RTMLoop.Typing(ctx, m); err != nil {
+		return err
+	}
+
+	if typing, err := newRTMTyping(m); err == nil {
+		r.record(RTMRecordOutbound, typing)
+	}
+	return nil
+}
+
+func (r *RTMRecorder) Ping() error {
+	if err := r.RTMLoop.Ping(); err != nil {
+		return err
+	}
+
+	r.record(RTMRecordOutbound, RTMMessage{"type": RTMMessageTypePing})
+	return nil
+}
+
+func (r *RTMRecorder) Keepalive(interval *time.Ticker) error {
+	defer interval.Stop()
+	for {
+		select {
+		case <-interval.C:
+			if err := r.Ping(); err != nil {
+				return errors.Wrap(err, "keepalive closed")
+			}
+		}
+	}
+}
+
+// Close stops recording, returns the first write error.
+// The wrapped loop and writer are not closed.
+func (r *RTMRecorder) Close() error {
+	r.wlock.Lock()
+	defer r.wlock.Unlock()
+
+	select {
+	case <-r.closeC:
+	default:
+		close(r.closeC)
+	}
+
+	return r.writeErr
+}
+
+func (r *RTMRecorder) record(direction RTMRecordDirection, m RTMMessage) {
+	line, err := json.Marshal(RTMRecord{
+		At:        r.clock(),
+		Direction: direction,
+		Message:   m,
+	})
+
+	r.wlock.Lock()
+	defer r.wlock.Unlock()
+
+	if err == nil {
+		_, err = r.writer.Write(append(line, '\n'))
+	}
+	if err != nil && r.writeErr == nil {
+		r.writeErr = errors.Wrap(err, "write record failed")
+	}
+}
@@ -0,0 +1,116 @@
+package bearychat
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRTMRecorder(t *testing.T) {
+	loop := newTestRTMLoop()
+	buf := &bytes.Buffer{}
+	r := NewRTMRecorder(loop, buf)
+
+	messageC, err := r.ReadC()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	loop.rtmC <- RTMMessage{"type": RTMMessageTypeP2PMessage, "text": "hi"}
+	select {
+	case m := <-messageC:
+		if m.Text() != "hi" {
+			t.Errorf("unexpected message: %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected message")
+	}
+
+	if err := r.Send(RTMMessage{"type": RTMMessageTypeP2PMessage, "text": "hello"}); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if len(loop.sent) != 1 {
+		t.Errorf("message should be sent by wrapped loop: %+v", loop.sent)
+	}
+
+	records, err := ReadRTMRecords(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if records[0].Direction != RTMRecordInbound || records[0].Message.Text() != "hi" {
+		t.Errorf("unexpected record: %+v", records[0])
+	}
+	if records[1].Direction != RTMRecordOutbound || records[1].Message.Text() != "hello" {
+		t.Errorf("unexpected record: %+v", records[1])
+	}
+	if records[0].At.IsZero() || records[1].At.Before(records[0].At) {
+		t.Errorf("unexpected timestamps: %+v", records)
+	}
+}
+
+func TestRTMRecorder_Typing(t *testing.T) {
+	loop := newTestRTMLoop()
+	buf := &bytes.Buffer{}
+	r := NewRTMRecorder(loop, buf)
+
+	m := RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"vchannel_id": "a",
+		"channel_id":  "a",
+	}
+	if err := r.Typing(context.Background(), m); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := r.Ping(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := r.Send(m.Refer("done")); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	r.Close()
+
+	records, err := ReadRTMRecords(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	typing := records[0].Message
+	if typing.Type() != RTMMessageTypeChannelTyping || typing["vchannel_id"] != "a" {
+		t.Errorf("unexpected record: %+v", records[0])
+	}
+
+	// pings and typing events are left out when replaying
+	l, err := NewReplayLoop(records, WithReplayLoopSpeed(0))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	l.Start()
+	defer l.Stop()
+	l.Typing(context.Background(), m)
+	l.Send(RTMMessage{"type": RTMMessageTypePing})
+	l.Send(m.Refer("done"))
+
+	expected, sent := l.Expected(), l.Sent()
+	if len(expected) != 1 || expected[0].Text() != "done" {
+		t.Errorf("unexpected expected: %+v", expected)
+	}
+	if len(sent) != 1 || sent[0].Text() != "done" {
+		t.Errorf("unexpected sent: %+v", sent)
+	}
+}
+
+func TestReadRTMRecords_Malformed(t *testing.T) {
+	_, err := ReadRTMRecords(bytes.NewBufferString("{\"direction\": \"in\"}\n{malformed\n"))
+	if err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -0,0 +1,274 @@
+package bearychat
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReplayLoop is a RTMLoop playing recorded messages back via ReadC, and
+// captures sent messages for assertions.
+//
+//      records, _ := ReadRTMRecords(f)
+//      loop := NewReplayLoop(records, WithReplayLoopSpeed(0))
+//      loop.Start()
+//      go runBot(loop)
+//      <-loop.Done()
+//      assertSent(loop.Sent(), loop.Expected())
+type ReplayLoop struct {
+	records []RTMRecord
+	speed   float64
+
+	state   RTMLoopState
+	next    int           // index of the next record to play
+	stopC   chan struct{} // closed when stopped
+	doneC   chan struct{} // closed after all records played
+	callId  uint64
+	sent    []RTMMessage
+	llock   *sync.Mutex // lock for properties above
+	playing *sync.WaitGroup
+
+	rtmC        chan RTMMessage
+	errC        chan error
+	subscribers *rtmLoopSubscribers
+}
+
+type replayLoopSetter func(*ReplayLoop) error
+
+// Set playback speed, 1 is real time, 2 is twice as fast, and 0 plays
+// without waiting. Defaults to 1.
+func WithReplayLoopSpeed(speed float64) replayLoopSetter {
+	return func(l *ReplayLoop) error {
+		if speed < 0 {
+			return errors.New("replay speed should not be negative")
+		}
+		l.speed = speed
+		return nil
+	}
+}
+
+func NewReplayLoop(records []RTMRecord, setters ...replayLoopSetter) (*ReplayLoop, error) {
+	l := &ReplayLoop{
+		records: records,
+		speed:   1,
+
+		state:   RTMLoopStateClosed,
+		doneC:   make(chan struct{}),
+		llock:   &sync.Mutex{},
+		playing: &sync.WaitGroup{},
+
+		rtmC:        make(chan RTMMessage),
+		errC:        make(chan error, 1),
+		subscribers: newRTMLoopSubscribers(),
+	}
+
+	for _, setter := range setters {
+		if err := setter(l); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Start plays inbound records, continues from where it stopped.
+func (l *ReplayLoop) Start() error {
+	l.llock.Lock()
+	defer l.llock.Unlock()
+
+	if l.state == RTMLoopStateOpen {
+		return nil
+	}
+
+	l.setState(RTMLoopStateOpen, "replaying")
+	l.stopC = make(chan struct{})
+	l.playing.Add(1)
+	go l.play(l.stopC)
+
+	return nil
+}
+
+func (l *ReplayLoop) Stop() error {
+	l.llock.Lock()
+	if l.state != RTMLoopStateOpen {
+		l.llock.Unlock()
+		return nil
+	}
+	l.setState(RTMLoopStateClosed, "stopped")
+	close(l.stopC)
+	l.llock.Unlock()
+
+	l.playing.Wait()
+	return nil
+}
+
+func (l *ReplayLoop) State() RTMLoopState {
+	l.llock.Lock()
+	defer l.llock.Unlock()
+
+	return l.state
+}
+
+func (l *ReplayLoop) Ping() error {
+	if l.State() != RTMLoopStateOpen {
+		return ErrRTMLoopClosed
+	}
+	return nil
+}
+
+func (l *ReplayLoop) Keepalive(interval *time.Ticker) error {
+	defer interval.Stop()
+	for {
+		select {
+		case <-interval.C:
+			if err := l.Ping(); err != nil {
+				return errors.Wrap(err, "keepalive closed")
+			}
+		}
+	}
+}
+
+// Send captures the message, call id is assigned like RTMLoop. Pings and
+// typing events are not captured, see Expected.
+func (l *ReplayLoop) Send(m RTMMessage) error {
+	l.llock.Lock()
+	defer l.llock.Unlock()
+
+	if l.state != RTMLoopStateOpen {
+		return ErrRTMLoopClosed
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+
+	if _, hasCallId := m["call_id"]; !hasCallId {
+		l.callId = l.callId + 1
+		m["call_id"] = l.callId
+	}
+	if !isRTMControlFrame(m) {
+		l.sent = append(l.sent, m)
+	}
+
+	return nil
+}
+
+func (l *ReplayLoop) Typing(ctx context.Context, m RTMMessage) error {
+	if l.State() != RTMLoopStateOpen {
+		return ErrRTMLoopClosed
+	}
+	return nil
+}
+
+func (l *ReplayLoop) ReadC() (chan RTMMessage, error) {
+	if l.State() != RTMLoopStateOpen {
+		return nil, ErrRTMLoopClosed
+	}
+	return l.rtmC, nil
+}
+
+func (l *ReplayLoop) ErrC() chan error {
+	return l.errC
+}
+
+func (l *ReplayLoop) Stats() RTMLoopStats {
+	return RTMLoopStats{}
+}
+
+func (l *ReplayLoop) Subscribe(backlog int) (<-chan RTMLoopStateChange, func()) {
+	return l.subscribers.subscribe(backlog)
+}
+
+// Sent returns captured messages.
+func (l *ReplayLoop) Sent() []RTMMessage {
+	l.llock.Lock()
+	defer l.llock.Unlock()
+
+	sent := make([]RTMMessage, len(l.sent))
+	copy(sent, l.sent)
+	return sent
+}
+
+// Expected returns outbound messages in the recording. Pings and typing
+// events are left out, as they are sent by timers rather than handlers.
+func (l *ReplayLoop) Expected() []RTMMessage {
+	var expected []RTMMessage
+	for _, record := range l.records {
+		if record.Direction == RTMRecordOutbound && !isRTMControlFrame(record.Message) {
+			expected = append(expected, record.Message)
+		}
+	}
+	return expected
+}
+
+// Tell if the frame is a ping or typing event.
+func isRTMControlFrame(m RTMMessage) bool {
+	switch m.Type() {
+	case RTMMessageTypePing, RTMMessageTypeP2PTyping, RTMMessageTypeChannelTyping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done is closed after all inbound records received.
+func (l *ReplayLoop) Done() <-chan struct{} {
+	return l.doneC
+}
+
+// Deliver inbound records with recorded intervals until stopped.
+func (l *ReplayLoop) play(stopC chan struct{}) {
+	defer l.playing.Done()
+
+	var last time.Time
+	for {
+		l.llock.Lock()
+		if l.next >= len(l.records) {
+			select {
+			case <-l.doneC:
+			default:
+				close(l.doneC)
+			}
+			l.llock.Unlock()
+			return
+		}
+		record := l.records[l.next]
+		l.llock.Unlock()
+
+		if record.Direction == RTMRecordInbound {
+			if l.speed > 0 && !last.IsZero() && record.At.After(last) {
+				wait := time.Duration(float64(record.At.Sub(last)) / l.speed)
+				select {
+				case <-stopC:
+					return
+				case <-time.After(wait):
+				}
+			}
+			last = record.At
+
+			select {
+			case <-stopC:
+				return
+			case l.rtmC <- record.Message:
+			}
+		}
+
+		l.llock.Lock()
+		l.next = l.next + 1
+		l.llock.Unlock()
+	}
+}
+
+// Transit to a new state, llock should be held.
+func (l *ReplayLoop) setState(state RTMLoopState, reason string) {
+	change := RTMLoopStateChange{
+		From:   l.state,
+		To:     state,
+		Reason: reason,
+		At:     time.Now(),
+	}
+	l.state = state
+
+	l.subscribers.publish(change)
+}
@@ -0,0 +1,116 @@
+package bearychat
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRTMRecords(interval time.Duration) []RTMRecord {
+	at := time.Now()
+	return []RTMRecord{
+		{At: at, Direction: RTMRecordInbound, Message: RTMMessage{"text": "one"}},
+		{At: at.Add(interval), Direction: RTMRecordOutbound, Message: RTMMessage{"text": "reply"}},
+		{At: at.Add(2 * interval), Direction: RTMRecordInbound, Message: RTMMessage{"text": "two"}},
+	}
+}
+
+func TestReplayLoop(t *testing.T) {
+	l, err := NewReplayLoop(newTestRTMRecords(time.Hour), WithReplayLoopSpeed(0))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if _, err := l.ReadC(); err != ErrRTMLoopClosed {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	messageC, err := l.ReadC()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	for _, text := range []string{"one", "two"} {
+		select {
+		case m := <-messageC:
+			if m.Text() != text {
+				t.Errorf("unexpected message: %+v", m)
+			}
+			l.Send(RTMMessage{"text": "re: " + m.Text()})
+		case <-time.After(time.Second):
+			t.Fatalf("expected message: %s", text)
+		}
+	}
+
+	select {
+	case <-l.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("replay should be done")
+	}
+
+	sent := l.Sent()
+	if len(sent) != 2 || sent[0].Text() != "re: one" || sent[1]["call_id"] != uint64(2) {
+		t.Errorf("unexpected sent: %+v", sent)
+	}
+	if expected := l.Expected(); len(expected) != 1 || expected[0].Text() != "reply" {
+		t.Errorf("unexpected expected: %+v", expected)
+	}
+}
+
+func TestReplayLoop_Speed(t *testing.T) {
+	l, err := NewReplayLoop(newTestRTMRecords(100*time.Millisecond), WithReplayLoopSpeed(2))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	messageC, _ := l.ReadC()
+	<-messageC
+	start := time.Now()
+	<-messageC
+	elapsed := time.Since(start)
+
+	// two records are 200ms apart, played in 100ms
+	if elapsed < 80*time.Millisecond || elapsed > 190*time.Millisecond {
+		t.Errorf("unexpected interval: %v", elapsed)
+	}
+
+	if _, err := NewReplayLoop(nil, WithReplayLoopSpeed(-1)); err == nil {
+		t.Errorf("expected error for negative speed")
+	}
+}
+
+func TestReplayLoop_Resume(t *testing.T) {
+	l, err := NewReplayLoop(newTestRTMRecords(time.Hour), WithReplayLoopSpeed(0))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	changes, unsubscribe := l.Subscribe(4)
+	defer unsubscribe()
+
+	l.Start()
+	messageC, _ := l.ReadC()
+	<-messageC
+	l.Stop()
+
+	if err := l.Send(RTMMessage{}); err != ErrRTMLoopClosed {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	l.Start()
+	defer l.Stop()
+	if m := <-messageC; m.Text() != "two" {
+		t.Errorf("replay should resume, got: %+v", m)
+	}
+
+	for _, state := range []RTMLoopState{RTMLoopStateOpen, RTMLoopStateClosed, RTMLoopStateOpen} {
+		if change := <-changes; change.To != state {
+			t.Errorf("unexpected change: %+v", change)
+		}
+	}
+}
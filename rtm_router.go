@@ -0,0 +1,427 @@
+package bearychat
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_RTM_ROUTER_BACKLOG      = 64
+	DEFAULT_RTM_ROUTER_IDLE_TIMEOUT = time.Minute
+)
+
+// RTMHandler handles a routed message.
+type RTMHandler func(ctx context.Context, m RTMMessage) error
+
+// RTMMiddleware wraps a handler.
+type RTMMiddleware func(next RTMHandler) RTMHandler
+
+// RTMPredicate tells if a message should be handled.
+type RTMPredicate func(m RTMMessage) bool
+
+// RTMInterceptor takes a message before queued to its vchannel worker,
+// returns true if the message is consumed. It should not block.
+type RTMInterceptor func(m RTMMessage) bool
+
+// RTMRouter dispatches messages from RTMLoop to registered handlers.
+//
+// Messages in the same vchannel are handled in order, messages in
+// different vchannels are handled concurrently.
+//
+//      router, _ := NewRTMRouter(context.Loop)
+//      router.Use(RTMRecoverMiddleware)
+//      router.Handle(
+//              RTMPredicateAll(
+//                      RTMPredicateChatMessage,
+//                      RTMPredicateNot(RTMPredicateFromUID(context.UID())),
+//                      RTMPredicateMentionsUID(context.UID()),
+//              ),
+//              func(ctx context.Context, m RTMMessage) error {
+//                      return context.Loop.Send(m.Refer("hi"))
+//              },
+//      )
+//      router.Run(ctx)
+type RTMRouter struct {
+	loop RTMLoop
+
+	routes       []rtmRoute
+	middlewares  []RTMMiddleware
+	interceptors []RTMInterceptor
+	rlock        *sync.RWMutex // lock for routes, middlewares & interceptors
+
+	backlog      int
+	idleTimeout  time.Duration
+	errorHandler func(error)
+
+	workers map[string]*rtmRouterWorker
+	stopC   chan struct{} // closed when Run returns
+	wlock   *sync.Mutex   // lock for workers & stopC
+	wg      *sync.WaitGroup
+}
+
+type rtmRoute struct {
+	predicate RTMPredicate
+	regexp    *regexp.Regexp
+	handler   RTMHandler
+}
+
+type rtmRouterWorker struct {
+	queue   chan rtmRouterJob
+	pending int // queued by dispatcher but not received by worker
+}
+
+type rtmRouterJob struct {
+	ctx     context.Context
+	message RTMMessage
+}
+
+type rtmRouterSetter func(*RTMRouter) error
+
+// Set message queue size of each vchannel, defaults to 64.
+func WithRTMRouterBacklog(backlog int) rtmRouterSetter {
+	return func(r *RTMRouter) error {
+		if backlog <= 0 {
+			return errors.New("backlog should be positive")
+		}
+		r.backlog = backlog
+		return nil
+	}
+}
+
+// Set handler for handler & transient loop errors, defaults to log.Printf.
+func WithRTMRouterErrorHandler(handler func(error)) rtmRouterSetter {
+	return func(r *RTMRouter) error {
+		r.errorHandler = handler
+		return nil
+	}
+}
+
+func NewRTMRouter(loop RTMLoop, setters ...rtmRouterSetter) (*RTMRouter, error) {
+	r := &RTMRouter{
+		loop:  loop,
+		rlock: &sync.RWMutex{},
+
+		backlog:     DEFAULT_RTM_ROUTER_BACKLOG,
+		idleTimeout: DEFAULT_RTM_ROUTER_IDLE_TIMEOUT,
+		errorHandler: func(err error) {
+			log.Printf("rtm router: %+v", err)
+		},
+
+		workers: make(map[string]*rtmRouterWorker),
+		wlock:   &sync.Mutex{},
+		wg:      &sync.WaitGroup{},
+	}
+
+	for _, setter := range setters {
+		if err := setter(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Use appends middlewares, the first one is the outermost.
+func (r *RTMRouter) Use(middlewares ...RTMMiddleware) {
+	r.rlock.Lock()
+	defer r.rlock.Unlock()
+
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// Intercept appends interceptors, which see messages in received order
+// even if workers of the vchannel are busy.
+func (r *RTMRouter) Intercept(interceptors ...RTMInterceptor) {
+	r.rlock.Lock()
+	defer r.rlock.Unlock()
+
+	r.interceptors = append(r.interceptors, interceptors...)
+}
+
+// Handle registers handler for messages matching predicate.
+// Routes are matched in registered order, only the first one is used.
+func (r *RTMRouter) Handle(predicate RTMPredicate, handler RTMHandler) {
+	r.rlock.Lock()
+	defer r.rlock.Unlock()
+
+	r.routes = append(r.routes, rtmRoute{predicate: predicate, handler: handler})
+}
+
+// HandleType registers handler for messages with given type.
+func (r *RTMRouter) HandleType(t RTMMessageType, handler RTMHandler) {
+	r.Handle(RTMPredicateType(t), handler)
+}
+
+// HandleRegexp registers handler for chat messages which text matches re.
+// Submatches can be read with RTMRouteMatches.
+func (r *RTMRouter) HandleRegexp(re *regexp.Regexp, handler RTMHandler) {
+	r.rlock.Lock()
+	defer r.rlock.Unlock()
+
+	r.routes = append(r.routes, rtmRoute{
+		predicate: RTMPredicateChatMessage,
+		regexp:    re,
+		handler:   handler,
+	})
+}
+
+type rtmRouteMatchesKey struct{}
+
+// RTMRouteMatches returns submatches of the regexp route.
+func RTMRouteMatches(ctx context.Context) []string {
+	matches, _ := ctx.Value(rtmRouteMatchesKey{}).([]string)
+	return matches
+}
+
+// Run reads messages from loop until ctx is done or the loop failed.
+// Fatal loop error is returned after all queued messages handled.
+func (r *RTMRouter) Run(ctx context.Context) error {
+	messageC, err := r.loop.ReadC()
+	if err != nil {
+		return err
+	}
+	errC := r.loop.ErrC()
+
+	r.wlock.Lock()
+	stopC := make(chan struct{})
+	r.stopC = stopC
+	r.wlock.Unlock()
+
+	defer r.wg.Wait()
+	defer close(stopC)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errC:
+			if isRTMLoopFatal(err) {
+				return err
+			}
+			r.errorHandler(err)
+		case m := <-messageC:
+			r.Dispatch(ctx, m)
+		}
+	}
+}
+
+// Dispatch queues a message to its vchannel worker, unless consumed by
+// interceptors.
+func (r *RTMRouter) Dispatch(ctx context.Context, m RTMMessage) {
+	r.rlock.RLock()
+	interceptors := r.interceptors
+	r.rlock.RUnlock()
+
+	for _, intercept := range interceptors {
+		if intercept(m) {
+			return
+		}
+	}
+
+	vchannelId, _ := m["vchannel_id"].(string)
+
+	r.wlock.Lock()
+	w, present := r.workers[vchannelId]
+	if !present {
+		w = &rtmRouterWorker{queue: make(chan rtmRouterJob, r.backlog)}
+		r.workers[vchannelId] = w
+		r.wg.Add(1)
+		go r.work(vchannelId, w, r.stopC)
+	}
+	w.pending = w.pending + 1
+	r.wlock.Unlock()
+
+	w.queue <- rtmRouterJob{ctx: ctx, message: m}
+}
+
+// Handle queued messages of a vchannel in order, exits after idle
+// or router stopped.
+func (r *RTMRouter) work(vchannelId string, w *rtmRouterWorker, stopC chan struct{}) {
+	defer r.wg.Done()
+
+	for {
+		select {
+		case job := <-w.queue:
+			r.wlock.Lock()
+			w.pending = w.pending - 1
+			r.wlock.Unlock()
+
+			if err := r.serve(job.ctx, job.message); err != nil {
+				r.errorHandler(err)
+			}
+		case <-stopC:
+			if r.exitWorker(vchannelId, w) {
+				return
+			}
+		case <-time.After(r.idleTimeout):
+			if r.exitWorker(vchannelId, w) {
+				return
+			}
+		}
+	}
+}
+
+// Remove the worker if no more messages queued.
+func (r *RTMRouter) exitWorker(vchannelId string, w *rtmRouterWorker) bool {
+	r.wlock.Lock()
+	defer r.wlock.Unlock()
+
+	if w.pending > 0 {
+		return false
+	}
+	delete(r.workers, vchannelId)
+	return true
+}
+
+// Find the route and call its handler wrapped with middlewares.
+func (r *RTMRouter) serve(ctx context.Context, m RTMMessage) error {
+	r.rlock.RLock()
+	routes := r.routes
+	middlewares := r.middlewares
+	r.rlock.RUnlock()
+
+	for _, route := range routes {
+		if route.predicate != nil && !route.predicate(m) {
+			continue
+		}
+
+		routeCtx := ctx
+		if route.regexp != nil {
+			matches := route.regexp.FindStringSubmatch(m.Text())
+			if matches == nil {
+				continue
+			}
+			routeCtx = context.WithValue(ctx, rtmRouteMatchesKey{}, matches)
+		}
+
+		handler := route.handler
+		for i := len(middlewares) - 1; i >= 0; i = i - 1 {
+			handler = middlewares[i](handler)
+		}
+
+		return handler(routeCtx, m)
+	}
+
+	return nil
+}
+
+// RTMPredicateAll matches if all predicates matched.
+func RTMPredicateAll(predicates ...RTMPredicate) RTMPredicate {
+	return func(m RTMMessage) bool {
+		for _, p := range predicates {
+			if !p(m) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// RTMPredicateAny matches if any predicate matched.
+func RTMPredicateAny(predicates ...RTMPredicate) RTMPredicate {
+	return func(m RTMMessage) bool {
+		for _, p := range predicates {
+			if p(m) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RTMPredicateNot negates a predicate.
+func RTMPredicateNot(predicate RTMPredicate) RTMPredicate {
+	return func(m RTMMessage) bool {
+		return !predicate(m)
+	}
+}
+
+// RTMPredicateType matches messages with given type.
+func RTMPredicateType(t RTMMessageType) RTMPredicate {
+	return func(m RTMMessage) bool {
+		return m.Type() == t
+	}
+}
+
+// RTMPredicateChatMessage matches p2p & channel messages.
+func RTMPredicateChatMessage(m RTMMessage) bool {
+	return m.IsChatMessage()
+}
+
+// RTMPredicateP2P matches p2p messages.
+func RTMPredicateP2P(m RTMMessage) bool {
+	return m.IsChatMessage() && m.IsP2P()
+}
+
+// RTMPredicateMentionsUID matches p2p messages and channel messages
+// mentioned the user.
+func RTMPredicateMentionsUID(uid string) RTMPredicate {
+	return func(m RTMMessage) bool {
+		mentioned, _ := m.ParseMentionUID(uid)
+		return mentioned
+	}
+}
+
+// RTMPredicateFromUID matches messages sent by the user.
+func RTMPredicateFromUID(uid string) RTMPredicate {
+	return func(m RTMMessage) bool {
+		return m.IsFromUID(uid)
+	}
+}
+
+// RTMPredicateInVChannel matches messages in the vchannel.
+func RTMPredicateInVChannel(vchannelId string) RTMPredicate {
+	return func(m RTMMessage) bool {
+		return m["vchannel_id"] == vchannelId
+	}
+}
+
+// RTMRecoverMiddleware turns handler panics into errors.
+func RTMRecoverMiddleware(next RTMHandler) RTMHandler {
+	return func(ctx context.Context, m RTMMessage) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.Errorf("handler panicked: %v", r)
+			}
+		}()
+
+		return next(ctx, m)
+	}
+}
+
+// RTMLoggingMiddleware logs handled messages and the time spent.
+func RTMLoggingMiddleware(logger *log.Logger) RTMMiddleware {
+	return func(next RTMHandler) RTMHandler {
+		return func(ctx context.Context, m RTMMessage) error {
+			start := time.Now()
+			err := next(ctx, m)
+			logger.Printf(
+				"%s from %v in %v: %s (error: %v)",
+				m.Type(),
+				m["uid"],
+				m["vchannel_id"],
+				time.Since(start),
+				err,
+			)
+			return err
+		}
+	}
+}
+
+// RTMAuthMiddleware only passes messages allowed by predicate,
+// others are dropped silently.
+func RTMAuthMiddleware(allow RTMPredicate) RTMMiddleware {
+	return func(next RTMHandler) RTMHandler {
+		return func(ctx context.Context, m RTMMessage) error {
+			if !allow(m) {
+				return nil
+			}
+			return next(ctx, m)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package bearychat
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRTMLoop is a RTMLoop without connection.
+type testRTMLoop struct {
+	rtmC chan RTMMessage
+	errC chan error
+
+	lock *sync.Mutex
+	sent []RTMMessage
+}
+
+func newTestRTMLoop() *testRTMLoop {
+	return &testRTMLoop{
+		rtmC: make(chan RTMMessage),
+		errC: make(chan error, 1),
+		lock: &sync.Mutex{},
+	}
+}
+
+func (l *testRTMLoop) Start() error                          { return nil }
+func (l *testRTMLoop) Stop() error                           { return nil }
+func (l *testRTMLoop) State() RTMLoopState                   { return RTMLoopStateOpen }
+func (l *testRTMLoop) Ping() error                           { return nil }
+func (l *testRTMLoop) Keepalive(interval *time.Ticker) error { return nil }
+func (l *testRTMLoop) ReadC() (chan RTMMessage, error)       { return l.rtmC, nil }
+func (l *testRTMLoop) ErrC() chan error                      { return l.errC }
+func (l *testRTMLoop) Stats() RTMLoopStats                   { return RTMLoopStats{} }
+
+func (l *testRTMLoop) Subscribe(backlog int) (<-chan RTMLoopStateChange, func()) {
+	return make(chan RTMLoopStateChange), func() {}
+}
+
+func (l *testRTMLoop) Typing(ctx context.Context, m RTMMessage) error {
+	return nil
+}
+
+func (l *testRTMLoop) Send(m RTMMessage) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.sent = append(l.sent, m)
+	return nil
+}
+
+func runTestRTMRouter(t *testing.T, r *RTMRouter, loop *testRTMLoop, messages ...RTMMessage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	for _, m := range messages {
+		loop.rtmC <- m
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("router should stop")
+	}
+}
+
+func TestRTMRouter_Routes(t *testing.T) {
+	loop := newTestRTMLoop()
+	r, err := NewRTMRouter(loop)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	var lock sync.Mutex
+	handled := map[string][]string{}
+	record := func(route string) RTMHandler {
+		return func(ctx context.Context, m RTMMessage) error {
+			lock.Lock()
+			defer lock.Unlock()
+			handled[route] = append(handled[route], m.Text())
+			if matches := RTMRouteMatches(ctx); matches != nil {
+				handled[route] = append(handled[route], matches[1])
+			}
+			return nil
+		}
+	}
+
+	r.Handle(RTMPredicateFromUID("=bot"), record("self"))
+	r.HandleRegexp(regexp.MustCompile(`^deploy (\w+)$`), record("deploy"))
+	r.Handle(RTMPredicateP2P, record("p2p"))
+	r.HandleType(RTMMessageTypeUpdateUserConnection, record("conn"))
+
+	runTestRTMRouter(
+		t, r, loop,
+		RTMMessage{"type": RTMMessageTypeP2PMessage, "uid": "=bot", "text": "1"},
+		RTMMessage{"type": RTMMessageTypeChannelMessage, "text": "deploy api"},
+		RTMMessage{"type": RTMMessageTypeP2PMessage, "text": "2"},
+		RTMMessage{"type": RTMMessageTypeChannelMessage, "text": "3"},
+		RTMMessage{"type": RTMMessageTypeUpdateUserConnection},
+	)
+
+	expected := map[string][]string{
+		"self":   {"1"},
+		"deploy": {"deploy api", "api"},
+		"p2p":    {"2"},
+		"conn":   {""},
+	}
+	if fmt.Sprint(handled) != fmt.Sprint(expected) {
+		t.Errorf("unexpected handled: %+v", handled)
+	}
+}
+
+func TestRTMRouter_Middleware(t *testing.T) {
+	var errs []error
+	loop := newTestRTMLoop()
+	r, err := NewRTMRouter(loop, WithRTMRouterErrorHandler(func(err error) {
+		errs = append(errs, err)
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	var calls []string
+	trace := func(name string) RTMMiddleware {
+		return func(next RTMHandler) RTMHandler {
+			return func(ctx context.Context, m RTMMessage) error {
+				calls = append(calls, name)
+				return next(ctx, m)
+			}
+		}
+	}
+	r.Use(trace("outer"), RTMRecoverMiddleware, trace("inner"))
+	r.Use(RTMAuthMiddleware(RTMPredicateNot(RTMPredicateFromUID("=evil"))))
+	r.Handle(nil, func(ctx context.Context, m RTMMessage) error {
+		calls = append(calls, "handler")
+		panic("oops")
+	})
+
+	runTestRTMRouter(
+		t, r, loop,
+		RTMMessage{"type": RTMMessageTypeP2PMessage, "uid": "=evil"},
+		RTMMessage{"type": RTMMessageTypeP2PMessage, "uid": "=good"},
+	)
+
+	expected := []string{"outer", "inner", "outer", "inner", "handler"}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("unexpected calls: %+v", calls)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected recovered error: %+v", errs)
+	}
+}
+
+func TestRTMRouter_OrderedPerVChannel(t *testing.T) {
+	loop := newTestRTMLoop()
+	r, err := NewRTMRouter(loop, WithRTMRouterBacklog(1))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	var lock sync.Mutex
+	handled := map[string][]int{}
+	r.Handle(nil, func(ctx context.Context, m RTMMessage) error {
+		lock.Lock()
+		defer lock.Unlock()
+		vchannelId := m["vchannel_id"].(string)
+		handled[vchannelId] = append(handled[vchannelId], m["seq"].(int))
+		return nil
+	})
+
+	var messages []RTMMessage
+	count := 50
+	for i := 0; i < count; i = i + 1 {
+		messages = append(
+			messages,
+			RTMMessage{"vchannel_id": "a", "seq": i},
+			RTMMessage{"vchannel_id": "b", "seq": i},
+		)
+	}
+	runTestRTMRouter(t, r, loop, messages...)
+
+	for _, vchannelId := range []string{"a", "b"} {
+		seqs := handled[vchannelId]
+		if len(seqs) != count {
+			t.Errorf("unexpected handled count: %d", len(seqs))
+		}
+		for i, seq := range seqs {
+			if seq != i {
+				t.Errorf("unexpected order in %s: %+v", vchannelId, seqs)
+				break
+			}
+		}
+	}
+}
+
+func TestRTMRouter_Run_Fatal(t *testing.T) {
+	loop := newTestRTMLoop()
+	r, err := NewRTMRouter(loop)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	fatal := &RTMLoopError{Kind: ErrRTMLoopConnLost, Err: ErrRTMLoopClosed}
+	loop.errC <- fatal
+	if err := r.Run(context.Background()); err != fatal {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	// wrapped fatal errors stop the router as well
+	wrapped := fmt.Errorf("bot alice: %w", fatal)
+	loop.errC <- wrapped
+	if err := r.Run(context.Background()); err != wrapped {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestRTMRouter_Intercept(t *testing.T) {
+	loop := newTestRTMLoop()
+	r, err := NewRTMRouter(loop)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	block := make(chan struct{})
+	r.Handle(nil, func(ctx context.Context, m RTMMessage) error {
+		<-block
+		return nil
+	})
+
+	intercepted := make(chan RTMMessage, 2)
+	r.Intercept(func(m RTMMessage) bool {
+		if m["text"] != "intercept" {
+			return false
+		}
+		intercepted <- m
+		return true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	loop.rtmC <- RTMMessage{"vchannel_id": "=bw52O", "text": "block"}
+	loop.rtmC <- RTMMessage{"vchannel_id": "=bw52O", "text": "intercept"}
+
+	// intercepted while the worker is busy
+	select {
+	case m := <-intercepted:
+		if m["text"] != "intercept" {
+			t.Errorf("unexpected message: %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("message should be intercepted")
+	}
+
+	close(block)
+	cancel()
+	<-done
+}
@@ -0,0 +1,339 @@
+package bearychat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DEFAULT_RTM_LOOP_SESSION_SAVE_INTERVAL = 5 * time.Second
+
+// RTMSession is the state of a loop kept across process restarts.
+type RTMSession struct {
+	// Last received chat message by vchannel id
+	Cursors map[string]RTMVChannelCursor `json:"cursors"`
+	// Last used call id
+	CallId uint64 `json:"call_id"`
+	// Encoded messages queued but not sent yet
+	Pending []json.RawMessage `json:"pending"`
+}
+
+// SessionStore persists RTMSession.
+type SessionStore interface {
+	// Load the saved session, returns nil session if nothing saved.
+	Load() (*RTMSession, error)
+	// Save the session, replaces the saved one.
+	Save(session *RTMSession) error
+}
+
+// MemorySessionStore keeps session in memory, it's useful for restarting
+// loops in the same process and testing.
+type MemorySessionStore struct {
+	lock    sync.Mutex
+	session []byte
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{}
+}
+
+func (s *MemorySessionStore) Load() (*RTMSession, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.session == nil {
+		return nil, nil
+	}
+
+	session := new(RTMSession)
+	if err := json.Unmarshal(s.session, session); err != nil {
+		return nil, errors.Wrap(err, "decode session failed")
+	}
+	return session, nil
+}
+
+func (s *MemorySessionStore) Save(session *RTMSession) error {
+	// saved as JSON so later changes to session won't leak in
+	buf, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrap(err, "encode session failed")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.session = buf
+	return nil
+}
+
+// FileSessionStore saves session as a JSON file.
+type FileSessionStore struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewFileSessionStore(path string) *FileSessionStore {
+	return &FileSessionStore{path: path}
+}
+
+func (s *FileSessionStore) Load() (*RTMSession, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read session file failed")
+	}
+
+	session := new(RTMSession)
+	if err := json.Unmarshal(buf, session); err != nil {
+		return nil, errors.Wrap(err, "decode session failed")
+	}
+	return session, nil
+}
+
+// Save writes session to a temporary file then renames it, so the saved
+// session won't be corrupted by crashing.
+func (s *FileSessionStore) Save(session *RTMSession) error {
+	buf, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrap(err, "encode session failed")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".")
+	if err != nil {
+		return errors.Wrap(err, "create session file failed")
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return errors.Wrap(err, "write session file failed")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "write session file failed")
+	}
+
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return errors.Wrap(err, "replace session file failed")
+	}
+	return nil
+}
+
+// rtmLoopSession tracks session state of a loop.
+type rtmLoopSession struct {
+	store    SessionStore
+	interval time.Duration
+	restored bool // restored on first start
+
+	lock    sync.Mutex // lock for cursors
+	cursors map[string]RTMVChannelCursor
+}
+
+// Set store for resuming the loop after process restarted.
+//
+// Session is restored on the first Start, and saved on Stop, on failure and
+// periodically while the loop is open. Restored pending messages are sent
+// before others, vchannel cursors are restored to backfill
+// (see WithRTMLoopBackfill) so missed messages can be fetched. Cursors
+// advance only when messages are handed to the receiving channel, so
+// dropped or still spilled messages are fetched after restarted.
+//
+// Errors of loading or saving are sent via error channel as
+// ErrRTMLoopSession.
+func WithRTMLoopSessionStore(store SessionStore) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if store == nil {
+			return errors.New("session store should not be nil")
+		}
+		r.session = &rtmLoopSession{
+			store:    store,
+			interval: DEFAULT_RTM_LOOP_SESSION_SAVE_INTERVAL,
+			cursors:  make(map[string]RTMVChannelCursor),
+		}
+		return nil
+	}
+}
+
+// Set interval of saving session while the loop is open, defaults to
+// 5 seconds. It should be set after WithRTMLoopSessionStore.
+func WithRTMLoopSessionSaveInterval(interval time.Duration) rtmLoopSetter {
+	return func(r *rtmLoop) error {
+		if r.session == nil {
+			return errors.New("session store is not set")
+		}
+		if interval <= 0 {
+			return errors.New("session save interval should be positive")
+		}
+		r.session.interval = interval
+		return nil
+	}
+}
+
+func (s *rtmLoopSession) track(m RTMMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	advanceRTMVChannelCursor(s.cursors, m)
+}
+
+// Track the message handed off to receiving channel, dropped or spilled
+// messages are not tracked.
+func (l *rtmLoop) trackSession(m RTMMessage) {
+	if l.session != nil {
+		l.session.track(m)
+	}
+}
+
+// Restore the loaded session on the first start, llock should be held.
+// Errors are returned rather than delivered, which may block.
+func (l *rtmLoop) restoreSession(session *RTMSession, loadErr error) error {
+	if l.session.restored {
+		return nil
+	}
+	l.session.restored = true
+
+	if loadErr != nil {
+		return loadErr
+	}
+	if session == nil {
+		return nil
+	}
+
+	if atomic.LoadUint64(&l.callId) < session.CallId {
+		atomic.StoreUint64(&l.callId, session.CallId)
+	}
+
+	l.session.lock.Lock()
+	for vchannelId, cursor := range session.Cursors {
+		l.session.cursors[vchannelId] = cursor
+	}
+	l.session.lock.Unlock()
+	if l.backfill != nil && len(session.Cursors) > 0 {
+		l.backfill.Restore(session.Cursors)
+	}
+
+	if len(session.Pending) == 0 {
+		return nil
+	}
+	if l.limiter != nil {
+		// limiter locks before loop, see Start
+		go l.restorePending(session.Pending, l.closeC)
+		return nil
+	}
+	for i, rawMessage := range session.Pending {
+		select {
+		case l.sendC <- rawMessage:
+		default:
+			return errors.Errorf("send queue is full, %d pending messages dropped", len(session.Pending)-i)
+		}
+	}
+	return nil
+}
+
+// Send restored messages through rate limiter.
+func (l *rtmLoop) restorePending(pending []json.RawMessage, closeC chan struct{}) {
+	for _, rawMessage := range pending {
+		m := RTMMessage{}
+		if err := json.Unmarshal(rawMessage, &m); err != nil {
+			l.deliverError(
+				&RTMLoopError{
+					Kind: ErrRTMLoopSession,
+					Err:  errors.Wrap(err, "decode pending message failed"),
+				},
+				closeC,
+			)
+			continue
+		}
+		vchannelId, _ := m["vchannel_id"].(string)
+
+		if err := l.limiter.send(vchannelId, rawMessage, l.pushSend); err != nil {
+			l.deliverError(
+				&RTMLoopError{
+					Kind: ErrRTMLoopSession,
+					Err:  errors.Wrap(err, "send pending message failed"),
+				},
+				closeC,
+			)
+		}
+	}
+}
+
+// Save session periodically until the connection stops.
+func (l *rtmLoop) keepSession(closeC chan struct{}) {
+	ticker := time.NewTicker(l.session.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closeC:
+			return
+		case <-ticker.C:
+			l.saveSession()
+		}
+	}
+}
+
+// Save current session. Queued messages are saved only after the loop
+// stopped, as they are being sent while open.
+func (l *rtmLoop) saveSession() {
+	session := &RTMSession{}
+
+	if l.limiter != nil {
+		// limiter locks before loop
+		session.Pending = l.limiter.pending()
+	}
+
+	l.llock.Lock()
+	if !l.session.restored {
+		// never started, don't overwrite the saved session
+		l.llock.Unlock()
+		return
+	}
+	closeC := l.closeC
+	session.CallId = atomic.LoadUint64(&l.callId)
+	if l.state != RTMLoopStateOpen {
+		// take out and put back, nothing can be queued while locked
+		var queued []json.RawMessage
+	drain:
+		for {
+			select {
+			case rawMessage := <-l.sendC:
+				queued = append(queued, rawMessage)
+			default:
+				break drain
+			}
+		}
+		for _, rawMessage := range queued {
+			l.sendC <- rawMessage
+		}
+		session.Pending = append(queued, session.Pending...)
+	}
+	l.llock.Unlock()
+
+	l.session.lock.Lock()
+	session.Cursors = make(map[string]RTMVChannelCursor, len(l.session.cursors))
+	for vchannelId, cursor := range l.session.cursors {
+		session.Cursors[vchannelId] = cursor
+	}
+	l.session.lock.Unlock()
+
+	if err := l.session.store.Save(session); err != nil {
+		l.deliverError(
+			&RTMLoopError{Kind: ErrRTMLoopSession, Err: err},
+			closeC,
+		)
+	}
+}
@@ -0,0 +1,196 @@
+package bearychat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bearychat-session-")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewFileSessionStore(filepath.Join(dir, "session.json"))
+
+	session, err := s.Load()
+	if err != nil || session != nil {
+		t.Errorf("expected nothing loaded, got: %+v, %+v", session, err)
+	}
+
+	saved := &RTMSession{
+		Cursors: map[string]RTMVChannelCursor{
+			"a": {Key: "1", CreatedTS: 1, Type: RTMMessageTypeP2PMessage},
+		},
+		CallId:  42,
+		Pending: []json.RawMessage{json.RawMessage(`{"call_id":42}`)},
+	}
+	if err := s.Save(saved); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	session, err = s.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if session.CallId != 42 || session.Cursors["a"] != saved.Cursors["a"] {
+		t.Errorf("unexpected session: %+v", session)
+	}
+	if len(session.Pending) != 1 || string(session.Pending[0]) != `{"call_id":42}` {
+		t.Errorf("unexpected pending: %s", session.Pending)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("temporary files should be removed: %d files", len(files))
+	}
+}
+
+func TestRTMLoop_SessionStore(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	store := NewMemorySessionStore()
+	store.Save(&RTMSession{
+		CallId:  100,
+		Pending: []json.RawMessage{json.RawMessage(`{"type":"ping","call_id":99}`)},
+	})
+
+	l, err := NewRTMLoop(s.WSHost(), WithRTMLoopSessionStore(store))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if m := s.expectReceived(t); m["call_id"] != float64(99) {
+		t.Errorf("expected pending message first, got: %+v", m)
+	}
+
+	if err := l.Send(RTMMessage{"type": RTMMessageTypePing}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if m := s.expectReceived(t); m["call_id"] != float64(101) {
+		t.Errorf("call id should be resumed, got: %+v", m)
+	}
+
+	conn := <-s.conns
+	conn.WriteJSON(RTMMessage{
+		"type":        RTMMessageTypeP2PMessage,
+		"vchannel_id": "a",
+		"key":         "1",
+		"created_ts":  1,
+	})
+	messageC, _ := l.ReadC()
+	<-messageC
+
+	if err := l.Stop(); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+
+	// queued after stopped, saved as pending
+	l.sendC <- []byte(`{"type":"ping","call_id":102}`)
+	l.saveSession()
+
+	session, err := store.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if session.CallId != 101 {
+		t.Errorf("unexpected call id: %d", session.CallId)
+	}
+	if cursor := session.Cursors["a"]; cursor.Key != "1" || cursor.CreatedTS != 1 {
+		t.Errorf("unexpected cursors: %+v", session.Cursors)
+	}
+	if len(session.Pending) != 1 || len(l.sendC) != 1 {
+		t.Errorf("unexpected pending: %s", session.Pending)
+	}
+}
+
+func TestRTMLoop_SessionStore_NotStarted(t *testing.T) {
+	store := NewMemorySessionStore()
+	store.Save(&RTMSession{CallId: 100})
+
+	l, err := NewRTMLoop("ws://localhost", WithRTMLoopSessionStore(store))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	l.Stop()
+
+	if session, _ := store.Load(); session.CallId != 100 {
+		t.Errorf("session should not be overwritten: %+v", session)
+	}
+}
+
+func TestRTMLoop_SessionStore_TracksDelivered(t *testing.T) {
+	l, err := NewRTMLoop(
+		"ws://localhost",
+		WithRTMLoopBacklog(1),
+		WithRTMLoopOverflowPolicy(RTMLoopOverflowDropNewest),
+		WithRTMLoopSessionStore(NewMemorySessionStore()),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	closeC := make(chan struct{})
+
+	for i, key := range []string{"1", "2"} {
+		l.deliverMessage(RTMMessage{
+			"type":        RTMMessageTypeP2PMessage,
+			"vchannel_id": "a",
+			"key":         key,
+			"created_ts":  float64(i + 1),
+		}, closeC)
+	}
+
+	// 2 is dropped, fetched by backfill after restarted
+	if cursor := l.session.cursors["a"]; cursor.Key != "1" {
+		t.Errorf("unexpected cursor: %+v", cursor)
+	}
+}
+
+func TestRTMLoop_SessionStore_InvalidPending(t *testing.T) {
+	s := newTestRTMServer(t)
+	defer s.Close()
+
+	store := NewMemorySessionStore()
+	store.Save(&RTMSession{
+		Pending: []json.RawMessage{
+			json.RawMessage(`"invalid"`),
+			json.RawMessage(`{"type":"ping","call_id":1}`),
+		},
+	})
+
+	l, err := NewRTMLoop(
+		s.WSHost(),
+		WithRTMLoopSessionStore(store),
+		WithRTMLoopRateLimit(RTMRateLimit{Rate: 100, Burst: 10}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer l.Stop()
+
+	errC := l.ErrC()
+	select {
+	case err := <-errC:
+		if loopErr, ok := err.(*RTMLoopError); !ok || loopErr.Kind != ErrRTMLoopSession {
+			t.Errorf("unexpected error: %+v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected session error")
+	}
+
+	if m := s.expectReceived(t); m["call_id"] != float64(1) {
+		t.Errorf("unexpected message: %+v", m)
+	}
+}
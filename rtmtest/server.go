@@ -0,0 +1,308 @@
+// Package rtmtest provides a fake BearyChat RTM server for testing bots
+// without network.
+//
+//      server := rtmtest.NewServer()
+//      defer server.Close()
+//
+//      client, _ := server.Client()
+//      context, _ := bearychat.NewRTMContextWithClient(client)
+//      go runBot(context)
+//
+//      server.WaitConnected(time.Second)
+//      server.InjectP2P(server.NewUser("alice"), "hello")
+//      reply, _ := server.ExpectSent(time.Second, rtmtest.SentChatMessage)
+package rtmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bearychat "github.com/bearyinnovative/bearychat-go"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_TOKEN   = "rtmtest-token"
+	DEFAULT_TEAM_ID = "=rtmtest"
+)
+
+// Server is a fake RTM server implementing `/start` and the websocket
+// message protocol:
+//
+// - ping is answered with pong
+// - chat messages are answered with reply, which carries the message key
+// - other messages are answered with ok
+//
+// All answers echo the `call_id` of received messages.
+type Server struct {
+	*httptest.Server
+
+	// Token accepted by `/start`
+	Token string
+	// Bot user returned by `/start`
+	Bot *bearychat.User
+
+	lock     sync.Mutex // lock for conns & sent
+	conns    []*websocket.Conn
+	sent     []bearychat.RTMMessage
+	connC    chan struct{} // receives when a bot connected
+	sentC    chan bearychat.RTMMessage
+	sequence uint64 // for generating ids & keys
+}
+
+// NewServer starts a server, which should be closed after used.
+func NewServer() *Server {
+	s := &Server{
+		Token: DEFAULT_TOKEN,
+
+		connC: make(chan struct{}, 16),
+		sentC: make(chan bearychat.RTMMessage, 1024),
+	}
+	s.Bot = s.NewUser("bot")
+	s.Bot.Type = bearychat.UserTypeHubot
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", s.handleStart)
+	mux.HandleFunc("/ws", s.handleWS)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Client creates a rtm client connecting to the server.
+func (s *Server) Client() (*bearychat.RTMClient, error) {
+	return bearychat.NewRTMClient(s.Token, bearychat.WithRTMAPIBase(s.URL))
+}
+
+// WSHost returns websocket url of the server.
+func (s *Server) WSHost() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+}
+
+// NewUser creates a user in the server's team.
+func (s *Server) NewUser(name string) *bearychat.User {
+	id := s.nextId()
+	return &bearychat.User{
+		Id:         id,
+		TeamId:     DEFAULT_TEAM_ID,
+		VChannelId: id,
+		Name:       name,
+		Role:       bearychat.UserRoleNormal,
+		Type:       bearychat.UserTypeNormal,
+		Conn:       "connected",
+	}
+}
+
+// NewChannel creates a channel in the server's team.
+func (s *Server) NewChannel(name string) *bearychat.Channel {
+	id := s.nextId()
+	return &bearychat.Channel{
+		Id:         id,
+		TeamId:     DEFAULT_TEAM_ID,
+		VChannelId: id,
+		Name:       name,
+	}
+}
+
+// WaitConnected waits for a bot connecting to the websocket endpoint.
+func (s *Server) WaitConnected(timeout time.Duration) error {
+	select {
+	case <-s.connC:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("no bot connected")
+	}
+}
+
+// Inject sends a message to all connected bots.
+func (s *Server) Inject(m bearychat.RTMMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.conns) == 0 {
+		return errors.New("no bot connected")
+	}
+	for _, conn := range s.conns {
+		if err := conn.WriteJSON(m); err != nil {
+			return errors.Wrap(err, "inject message failed")
+		}
+	}
+	return nil
+}
+
+// InjectP2P sends a p2p message from the user to the bot.
+func (s *Server) InjectP2P(from *bearychat.User, text string) (bearychat.RTMMessage, error) {
+	m := s.newChatMessage(bearychat.RTMMessageTypeP2PMessage, from, text)
+	m["to_uid"] = s.Bot.Id
+	m["vchannel_id"] = p2pVChannelId(from.Id, s.Bot.Id)
+
+	return m, s.Inject(m)
+}
+
+// InjectChannel sends a channel message from the user.
+func (s *Server) InjectChannel(from *bearychat.User, channel *bearychat.Channel, text string) (bearychat.RTMMessage, error) {
+	m := s.newChatMessage(bearychat.RTMMessageTypeChannelMessage, from, text)
+	m["channel_id"] = channel.Id
+	m["vchannel_id"] = channel.VChannelId
+
+	return m, s.Inject(m)
+}
+
+// Sent returns messages sent by bots, in received order.
+func (s *Server) Sent() []bearychat.RTMMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sent := make([]bearychat.RTMMessage, len(s.sent))
+	copy(sent, s.sent)
+	return sent
+}
+
+// ExpectSent waits for the next sent message matching predicate, messages
+// not matched are skipped.
+func (s *Server) ExpectSent(timeout time.Duration, predicate bearychat.RTMPredicate) (bearychat.RTMMessage, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-s.sentC:
+			if predicate == nil || predicate(m) {
+				return m, nil
+			}
+		case <-deadline:
+			return nil, errors.New("expected message not sent")
+		}
+	}
+}
+
+// SentChatMessage matches chat messages, for ExpectSent.
+func SentChatMessage(m bearychat.RTMMessage) bool {
+	return m.IsChatMessage()
+}
+
+func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(bearychat.RTMAPIResponse{Code: 1, ErrorReason: "method not allowed"})
+		return
+	}
+	if r.URL.Query().Get("token") != s.Token {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(bearychat.RTMAPIResponse{Code: 1, ErrorReason: "invalid token"})
+		return
+	}
+
+	result, _ := json.Marshal(map[string]interface{}{
+		"user":    s.Bot,
+		"ws_host": s.WSHost(),
+	})
+	json.NewEncoder(w).Encode(bearychat.RTMAPIResponse{Result: result})
+}
+
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer s.removeConn(conn)
+
+	s.lock.Lock()
+	s.conns = append(s.conns, conn)
+	s.lock.Unlock()
+
+	select {
+	case s.connC <- struct{}{}:
+	default:
+	}
+
+	for {
+		_, rawMessage, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		m := bearychat.RTMMessage{}
+		if err := json.Unmarshal(rawMessage, &m); err != nil {
+			continue
+		}
+
+		s.receive(conn, m)
+	}
+}
+
+// Record the message and answer it.
+func (s *Server) receive(conn *websocket.Conn, m bearychat.RTMMessage) {
+	answer := bearychat.RTMMessage{"call_id": m["call_id"]}
+	switch {
+	case m.Type() == bearychat.RTMMessageTypePing:
+		answer["type"] = bearychat.RTMMessageTypePong
+	case m.IsChatMessage():
+		key := s.nextId()
+		m["key"] = key
+		m["uid"] = s.Bot.Id
+		m["created_ts"] = time.Now().UnixNano() / int64(time.Millisecond)
+
+		answer["type"] = bearychat.RTMMessageTypeReply
+		answer["code"] = 0
+		answer["data"] = map[string]interface{}{
+			"key":        key,
+			"created_ts": m["created_ts"],
+		}
+	default:
+		answer["type"] = bearychat.RTMMessageTypeOk
+	}
+
+	s.lock.Lock()
+	s.sent = append(s.sent, m)
+	conn.WriteJSON(answer)
+	s.lock.Unlock()
+
+	select {
+	case s.sentC <- m:
+	default:
+	}
+}
+
+func (s *Server) removeConn(conn *websocket.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	conn.Close()
+	for i, c := range s.conns {
+		if c == conn {
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Server) newChatMessage(t bearychat.RTMMessageType, from *bearychat.User, text string) bearychat.RTMMessage {
+	return bearychat.RTMMessage{
+		"type":       t,
+		"key":        s.nextId(),
+		"uid":        from.Id,
+		"text":       text,
+		"created_ts": time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (s *Server) nextId() string {
+	return fmt.Sprintf("=rtmtest%d", atomic.AddUint64(&s.sequence, 1))
+}
+
+// Build a stable vchannel id for p2p between two users.
+func p2pVChannelId(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + b
+}
@@ -0,0 +1,141 @@
+package rtmtest
+
+import (
+	"testing"
+	"time"
+
+	bearychat "github.com/bearyinnovative/bearychat-go"
+)
+
+func startTestBot(t *testing.T, s *Server) *bearychat.RTMContext {
+	client, err := s.Client()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	context, err := bearychat.NewRTMContextWithClient(client)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err, _, _ := context.Run(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := s.WaitConnected(time.Second); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	return context
+}
+
+func TestServer_Start(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	context := startTestBot(t, s)
+	defer context.Loop.Stop()
+
+	if context.UID() != s.Bot.Id || context.TeamId() != DEFAULT_TEAM_ID {
+		t.Errorf("unexpected context: %s %s", context.UID(), context.TeamId())
+	}
+
+	client, _ := bearychat.NewRTMClient("invalid", bearychat.WithRTMAPIBase(s.URL))
+	if _, _, err := client.Start(); err == nil {
+		t.Errorf("expected error for invalid token")
+	}
+}
+
+func TestServer_Conversation(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	context := startTestBot(t, s)
+	defer context.Loop.Stop()
+
+	alice := s.NewUser("alice")
+	if _, err := s.InjectP2P(alice, "hello"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	messageC, _ := context.Loop.ReadC()
+	var m bearychat.RTMMessage
+	select {
+	case m = <-messageC:
+	case <-time.After(time.Second):
+		t.Fatalf("expected message")
+	}
+	if !m.IsP2P() || !m.IsFromUID(alice.Id) || m.Text() != "hello" {
+		t.Errorf("unexpected message: %+v", m)
+	}
+
+	if err := context.Loop.Send(m.Reply("hi")); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	sent, err := s.ExpectSent(time.Second, SentChatMessage)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if sent.Text() != "hi" || sent["vchannel_id"] != m["vchannel_id"] {
+		t.Errorf("unexpected sent: %+v", sent)
+	}
+
+	// reply echoes call_id
+	select {
+	case reply := <-messageC:
+		if reply.Type() != bearychat.RTMMessageTypeReply || reply["call_id"] != sent["call_id"] {
+			t.Errorf("unexpected reply: %+v", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected reply")
+	}
+}
+
+func TestServer_Ping(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	context := startTestBot(t, s)
+	defer context.Loop.Stop()
+
+	if err := context.Loop.Ping(); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	messageC, _ := context.Loop.ReadC()
+	select {
+	case pong := <-messageC:
+		if pong.Type() != bearychat.RTMMessageTypePong || pong["call_id"] == nil {
+			t.Errorf("unexpected pong: %+v", pong)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected pong")
+	}
+
+	if sent := s.Sent(); len(sent) != 1 || sent[0].Type() != bearychat.RTMMessageTypePing {
+		t.Errorf("unexpected sent: %+v", sent)
+	}
+}
+
+func TestServer_InjectChannel(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	if _, err := s.InjectChannel(s.NewUser("alice"), s.NewChannel("general"), "hi"); err == nil {
+		t.Errorf("expected error without connected bot")
+	}
+
+	context := startTestBot(t, s)
+	defer context.Loop.Stop()
+
+	channel := s.NewChannel("general")
+	if _, err := s.InjectChannel(s.NewUser("alice"), channel, "hi"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	messageC, _ := context.Loop.ReadC()
+	select {
+	case m := <-messageC:
+		if m.Type() != bearychat.RTMMessageTypeChannelMessage || m["channel_id"] != channel.Id {
+			t.Errorf("unexpected message: %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected message")
+	}
+}
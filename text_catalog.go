@@ -0,0 +1,243 @@
+package bearychat
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bearyinnovative/bearychat-go/openapi"
+	"github.com/pkg/errors"
+)
+
+// LocalizedText returns `text_i18n` of the message in the best matched
+// locale of preferred ones, or text if none matched, see
+// openapi.MatchLocale.
+func (m RTMMessage) LocalizedText(preferred ...string) string {
+	texts := m.TextI18n()
+	locales := make([]string, 0, len(texts))
+	for locale := range texts {
+		locales = append(locales, locale)
+	}
+	if locale := openapi.MatchLocale(locales, preferred...); locale != "" {
+		return texts[locale]
+	}
+	return m.Text()
+}
+
+// TextI18n returns texts by locale of the message, if any.
+func (m RTMMessage) TextI18n() map[string]string {
+	texts := make(map[string]string)
+	switch i18n := m["text_i18n"].(type) {
+	case map[string]string:
+		for locale, text := range i18n {
+			texts[locale] = text
+		}
+	case map[string]interface{}:
+		for locale, text := range i18n {
+			if s, ok := text.(string); ok {
+				texts[locale] = s
+			}
+		}
+	}
+	return texts
+}
+
+// TextCatalog keeps message templates by locale. Templates use `{name}`
+// placeholders, `{{` and `}}` for literal braces.
+//
+//      catalog := NewTextCatalog("en")
+//      catalog.Add("en", map[string]string{"deploy.done": "{service} deployed to {env}"})
+//      catalog.Add("zh-CN", map[string]string{"deploy.done": "{service} 已部署到 {env}"})
+//
+//      text, _ := catalog.Render("deploy.done", TextArgs{"service": "api", "env": "prod"}, "zh-TW")
+//      // "api 已部署到 prod"
+type TextCatalog struct {
+	fallback string
+	bundles  map[string]map[string]textTemplate // templates by locale & key
+	lock     *sync.RWMutex                      // lock for bundles
+}
+
+// TextArgs are values of template placeholders.
+type TextArgs map[string]interface{}
+
+// textTemplate is a parsed template, parts at odd indexes are
+// placeholder names.
+type textTemplate []string
+
+// NewTextCatalog creates a catalog, templates in fallback locale are used
+// if none of preferred locales matched.
+func NewTextCatalog(fallback string) *TextCatalog {
+	return &TextCatalog{
+		fallback: fallback,
+		bundles:  make(map[string]map[string]textTemplate),
+		lock:     &sync.RWMutex{},
+	}
+}
+
+// Add templates of the locale, replaces existing ones with same keys.
+func (c *TextCatalog) Add(locale string, templates map[string]string) error {
+	parsed := make(map[string]textTemplate, len(templates))
+	for key, template := range templates {
+		t, err := parseTextTemplate(template)
+		if err != nil {
+			return errors.Wrapf(err, "invalid template %s of %s", key, locale)
+		}
+		parsed[key] = t
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	bundle, present := c.bundles[locale]
+	if !present {
+		bundle = make(map[string]textTemplate)
+		c.bundles[locale] = bundle
+	}
+	for key, t := range parsed {
+		bundle[key] = t
+	}
+	return nil
+}
+
+// Locale returns the best locale having the key for preferred ones,
+// falls back to the fallback locale.
+func (c *TextCatalog) Locale(key string, preferred ...string) (string, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var locales []string
+	for locale, bundle := range c.bundles {
+		if _, present := bundle[key]; present {
+			locales = append(locales, locale)
+		}
+	}
+
+	candidates := make([]string, 0, len(preferred)+1)
+	candidates = append(candidates, preferred...)
+	locale := openapi.MatchLocale(locales, append(candidates, c.fallback)...)
+	return locale, locale != ""
+}
+
+// Render the template of key in the best locale for preferred ones.
+func (c *TextCatalog) Render(key string, args TextArgs, preferred ...string) (string, error) {
+	locale, found := c.Locale(key, preferred...)
+	if !found {
+		return "", fmt.Errorf("no template for %s", key)
+	}
+
+	c.lock.RLock()
+	template := c.bundles[locale][key]
+	c.lock.RUnlock()
+
+	return template.render(args)
+}
+
+// RenderI18n renders the template of key in all locales having it,
+// returns texts by locale.
+func (c *TextCatalog) RenderI18n(key string, args TextArgs) (map[string]string, error) {
+	c.lock.RLock()
+	templates := make(map[string]textTemplate)
+	for locale, bundle := range c.bundles {
+		if template, present := bundle[key]; present {
+			templates[locale] = template
+		}
+	}
+	c.lock.RUnlock()
+
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("no template for %s", key)
+	}
+
+	texts := make(map[string]string, len(templates))
+	for locale, template := range templates {
+		text, err := template.render(args)
+		if err != nil {
+			return nil, errors.Wrapf(err, "render %s of %s failed", key, locale)
+		}
+		texts[locale] = text
+	}
+	return texts, nil
+}
+
+// Incoming renders the template of key as an incoming message.
+func (c *TextCatalog) Incoming(key string, args TextArgs, preferred ...string) (Incoming, error) {
+	text, err := c.Render(key, args, preferred...)
+	if err != nil {
+		return Incoming{}, err
+	}
+	return Incoming{Text: text}, nil
+}
+
+// Refer renders the template of key as a message referring m.
+func (c *TextCatalog) Refer(m RTMMessage, key string, args TextArgs, preferred ...string) (RTMMessage, error) {
+	text, err := c.Render(key, args, preferred...)
+	if err != nil {
+		return nil, err
+	}
+	return m.Refer(text), nil
+}
+
+// Locales returns locales in the catalog, sorted.
+func (c *TextCatalog) Locales() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	locales := make([]string, 0, len(c.bundles))
+	for locale := range c.bundles {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+func parseTextTemplate(template string) (textTemplate, error) {
+	var (
+		parts textTemplate
+		text  bytes.Buffer
+	)
+
+	for i := 0; i < len(template); i++ {
+		switch c := template[i]; {
+		case strings.HasPrefix(template[i:], "{{"), strings.HasPrefix(template[i:], "}}"):
+			text.WriteByte(c)
+			i = i + 1
+		case c == '{':
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed placeholder at %d", i)
+			}
+			name := strings.TrimSpace(template[i+1 : i+end])
+			if name == "" || strings.ContainsAny(name, "{") {
+				return nil, fmt.Errorf("invalid placeholder at %d", i)
+			}
+			parts = append(parts, text.String(), name)
+			text.Reset()
+			i = i + end
+		case c == '}':
+			return nil, fmt.Errorf("unexpected `}` at %d", i)
+		default:
+			text.WriteByte(c)
+		}
+	}
+
+	return append(parts, text.String()), nil
+}
+
+func (t textTemplate) render(args TextArgs) (string, error) {
+	var buf bytes.Buffer
+	for i, part := range t {
+		if i%2 == 0 {
+			buf.WriteString(part)
+			continue
+		}
+
+		value, present := args[part]
+		if !present {
+			return "", fmt.Errorf("missing value of {%s}", part)
+		}
+		fmt.Fprint(&buf, value)
+	}
+	return buf.String(), nil
+}
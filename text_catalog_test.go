@@ -0,0 +1,134 @@
+package bearychat
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func newTestTextCatalog(t *testing.T) *TextCatalog {
+	c := NewTextCatalog("en")
+	err := c.Add("en", map[string]string{
+		"deploy.done": "{service} deployed to {env} in {seconds}s",
+		"braces":      "{{literal}} {name}",
+		"only.en":     "english only",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	err = c.Add("zh-CN", map[string]string{
+		"deploy.done": "{service} 已部署到 { env }，耗时 {seconds} 秒",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	return c
+}
+
+func TestTextCatalog_Render(t *testing.T) {
+	c := newTestTextCatalog(t)
+	args := TextArgs{"service": "api", "env": "prod", "seconds": 12}
+
+	cases := []struct {
+		key       string
+		preferred []string
+		text      string
+	}{
+		{"deploy.done", []string{"zh-TW"}, "api 已部署到 prod，耗时 12 秒"},
+		{"deploy.done", []string{"fr", "zh"}, "api 已部署到 prod，耗时 12 秒"},
+		{"deploy.done", []string{"fr"}, "api deployed to prod in 12s"},
+		{"deploy.done", nil, "api deployed to prod in 12s"},
+		{"only.en", []string{"zh-CN"}, "english only"},
+		{"braces", nil, "{literal} {name}"},
+	}
+	args["name"] = "{name}"
+	for _, c2 := range cases {
+		text, err := c.Render(c2.key, args, c2.preferred...)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", c2.key, err)
+			continue
+		}
+		if text != c2.text {
+			t.Errorf("%s %q: expected %q, got %q", c2.key, c2.preferred, c2.text, text)
+		}
+	}
+
+	if _, err := c.Render("unknown", args); err == nil {
+		t.Errorf("expected error for unknown key")
+	}
+	if _, err := c.Render("deploy.done", TextArgs{"service": "api"}); err == nil {
+		t.Errorf("expected error for missing value")
+	}
+
+	texts, err := c.RenderI18n("deploy.done", args)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expected := map[string]string{
+		"en":    "api deployed to prod in 12s",
+		"zh-CN": "api 已部署到 prod，耗时 12 秒",
+	}
+	if !reflect.DeepEqual(texts, expected) {
+		t.Errorf("unexpected texts: %+v", texts)
+	}
+
+	if locales := c.Locales(); !reflect.DeepEqual(locales, []string{"en", "zh-CN"}) {
+		t.Errorf("unexpected locales: %+v", locales)
+	}
+}
+
+func TestTextCatalog_Messages(t *testing.T) {
+	c := newTestTextCatalog(t)
+	args := TextArgs{"service": "api", "env": "prod", "seconds": 1}
+
+	incoming, err := c.Incoming("deploy.done", args, "en")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if incoming.Text != "api deployed to prod in 1s" || incoming.Validate() != nil {
+		t.Errorf("unexpected incoming: %+v", incoming)
+	}
+
+	m := RTMMessage{
+		"type":        RTMMessageTypeP2PMessage,
+		"key":         "1",
+		"uid":         "=bw52O",
+		"vchannel_id": "=bw52O",
+	}
+	refer, err := c.Refer(m, "deploy.done", args, "zh-CN")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if refer.Text() != "api 已部署到 prod，耗时 1 秒" || refer["refer_key"] != "1" || refer.Validate() != nil {
+		t.Errorf("unexpected refer: %+v", refer)
+	}
+}
+
+func TestTextCatalog_Add_Invalid(t *testing.T) {
+	c := NewTextCatalog("en")
+	for _, template := range []string{"{unclosed", "{}", "stray }", "{a{b}"} {
+		if err := c.Add("en", map[string]string{"key": template}); err == nil {
+			t.Errorf("%q: expected error", template)
+		}
+	}
+	if len(c.Locales()) != 0 {
+		t.Errorf("invalid templates should not be added")
+	}
+}
+
+func TestRTMMessage_LocalizedText(t *testing.T) {
+	m := RTMMessage{}
+	if err := json.Unmarshal([]byte(`{"text":"hello","text_i18n":{"en":"hello","zh-CN":"你好"}}`), &m); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if text := m.LocalizedText("zh"); text != "你好" {
+		t.Errorf("unexpected text: %s", text)
+	}
+	if text := m.LocalizedText("ja"); text != "hello" {
+		t.Errorf("unexpected text: %s", text)
+	}
+	if texts := m.TextI18n(); len(texts) != 2 {
+		t.Errorf("unexpected texts: %+v", texts)
+	}
+}
@@ -0,0 +1,216 @@
+package bearychat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bearyinnovative/bearychat-go/openapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_THREAD_RESOLVER_DEPTH      = 5
+	DEFAULT_THREAD_RESOLVER_CACHE_TTL  = 10 * time.Minute
+	DEFAULT_THREAD_RESOLVER_CACHE_SIZE = 1000
+)
+
+// ThreadMessageFetcher fetches a message by key, implemented by
+// openapi.MessageService.
+type ThreadMessageFetcher interface {
+	Info(ctx context.Context, opt *openapi.MessageInfoOptions) (*openapi.Message, *http.Response, error)
+}
+
+// ThreadResolver fetches messages referred by replies through
+// `message.info`, and caches them.
+//
+//      client := openapi.NewClient(token)
+//      resolver, _ := NewThreadResolver(client.Message, WithThreadResolverDepth(3))
+//      referred, err := resolver.Referred(ctx, m) // "@bot translate this"
+//      thread, err := resolver.Thread(ctx, m)     // referred first, root last
+type ThreadResolver struct {
+	fetcher   ThreadMessageFetcher
+	depth     int
+	cacheTTL  time.Duration
+	cacheSize int
+
+	messages map[string]threadCachedMessage
+	lock     *sync.Mutex // lock for messages
+}
+
+type threadCachedMessage struct {
+	// saved as JSON so changes to returned messages won't leak in
+	message   []byte
+	expiresAt time.Time
+}
+
+type threadResolverSetter func(*ThreadResolver) error
+
+// Set how many messages Thread walks up the reply chain, defaults to 5.
+func WithThreadResolverDepth(depth int) threadResolverSetter {
+	return func(r *ThreadResolver) error {
+		if depth < 1 {
+			return errors.New("depth should be positive")
+		}
+		r.depth = depth
+		return nil
+	}
+}
+
+// Set how long fetched messages are cached, defaults to 10 minutes.
+// Zero disables caching.
+func WithThreadResolverCacheTTL(ttl time.Duration) threadResolverSetter {
+	return func(r *ThreadResolver) error {
+		if ttl < 0 {
+			return errors.New("cache ttl should not be negative")
+		}
+		r.cacheTTL = ttl
+		return nil
+	}
+}
+
+// Set how many messages are cached at most, defaults to 1000.
+func WithThreadResolverCacheSize(size int) threadResolverSetter {
+	return func(r *ThreadResolver) error {
+		if size < 1 {
+			return errors.New("cache size should be positive")
+		}
+		r.cacheSize = size
+		return nil
+	}
+}
+
+func NewThreadResolver(fetcher ThreadMessageFetcher, setters ...threadResolverSetter) (*ThreadResolver, error) {
+	if fetcher == nil {
+		return nil, errors.New("fetcher should not be nil")
+	}
+
+	r := &ThreadResolver{
+		fetcher:   fetcher,
+		depth:     DEFAULT_THREAD_RESOLVER_DEPTH,
+		cacheTTL:  DEFAULT_THREAD_RESOLVER_CACHE_TTL,
+		cacheSize: DEFAULT_THREAD_RESOLVER_CACHE_SIZE,
+		messages:  make(map[string]threadCachedMessage),
+		lock:      &sync.Mutex{},
+	}
+
+	for _, setter := range setters {
+		if err := setter(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Referred returns the message m replies to, or nil if m isn't a reply.
+func (r *ThreadResolver) Referred(ctx context.Context, m RTMMessage) (*openapi.Message, error) {
+	referKey, _ := m["refer_key"].(string)
+	if referKey == "" {
+		return nil, nil
+	}
+	vchannelId, _ := m["vchannel_id"].(string)
+	return r.Message(ctx, vchannelId, openapi.MessageKey(referKey))
+}
+
+// Thread walks the reply chain of m up to the configured depth, returns
+// referred messages nearest first. Messages fetched before an error are
+// returned with it.
+func (r *ThreadResolver) Thread(ctx context.Context, m RTMMessage) ([]*openapi.Message, error) {
+	referKey, _ := m["refer_key"].(string)
+	vchannelId, _ := m["vchannel_id"].(string)
+
+	var thread []*openapi.Message
+	seen := map[string]bool{}
+	if key, _ := m["key"].(string); key != "" {
+		seen[key] = true
+	}
+	for referKey != "" && !seen[referKey] && len(thread) < r.depth {
+		seen[referKey] = true
+
+		message, err := r.Message(ctx, vchannelId, openapi.MessageKey(referKey))
+		if err != nil {
+			return thread, err
+		}
+		thread = append(thread, message)
+
+		referKey = ""
+		if message.ReferKey != nil {
+			referKey = *message.ReferKey
+		}
+	}
+	return thread, nil
+}
+
+// Message fetches the message in vchannel, copies of cached ones are
+// returned if not expired.
+func (r *ThreadResolver) Message(ctx context.Context, vchannelId string, key openapi.MessageKey) (*openapi.Message, error) {
+	cacheKey := vchannelId + "/" + string(key)
+
+	r.lock.Lock()
+	cached, present := r.messages[cacheKey]
+	r.lock.Unlock()
+	if present && time.Now().Before(cached.expiresAt) {
+		message := new(openapi.Message)
+		if err := json.Unmarshal(cached.message, message); err == nil {
+			return message, nil
+		}
+	}
+
+	message, _, err := r.fetcher.Info(ctx, &openapi.MessageInfoOptions{
+		VChannelID: vchannelId,
+		Key:        key,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetch message %s failed", key)
+	}
+
+	if r.cacheTTL > 0 {
+		if buf, err := json.Marshal(message); err == nil {
+			r.lock.Lock()
+			r.evict(time.Now())
+			r.messages[cacheKey] = threadCachedMessage{
+				message:   buf,
+				expiresAt: time.Now().Add(r.cacheTTL),
+			}
+			r.lock.Unlock()
+		}
+	}
+
+	return message, nil
+}
+
+// Forget drops the cached message, e.g. after it's updated or deleted.
+func (r *ThreadResolver) Forget(vchannelId string, key openapi.MessageKey) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.messages, vchannelId+"/"+string(key))
+}
+
+// Make room for a message, expired messages are dropped first, then the
+// one expiring soonest.
+func (r *ThreadResolver) evict(now time.Time) {
+	if len(r.messages) < r.cacheSize {
+		return
+	}
+
+	var (
+		soonest   string
+		expiresAt time.Time
+	)
+	for key, cached := range r.messages {
+		if !now.Before(cached.expiresAt) {
+			delete(r.messages, key)
+			continue
+		}
+		if soonest == "" || cached.expiresAt.Before(expiresAt) {
+			soonest, expiresAt = key, cached.expiresAt
+		}
+	}
+	if len(r.messages) >= r.cacheSize {
+		delete(r.messages, soonest)
+	}
+}
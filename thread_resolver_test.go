@@ -0,0 +1,256 @@
+package bearychat
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/bearyinnovative/bearychat-go/openapi"
+)
+
+// Fetches messages by key, which refer the previous key.
+type testThreadFetcher struct {
+	refers map[string]string
+
+	lock    sync.Mutex
+	fetched map[string]int
+}
+
+func newTestThreadFetcher(refers map[string]string) *testThreadFetcher {
+	return &testThreadFetcher{refers: refers, fetched: map[string]int{}}
+}
+
+func (f *testThreadFetcher) Info(ctx context.Context, opt *openapi.MessageInfoOptions) (*openapi.Message, *http.Response, error) {
+	if opt.VChannelID != "=bw52O" {
+		return nil, nil, errors.New("vchannel not found")
+	}
+	key := string(opt.Key)
+
+	f.lock.Lock()
+	f.fetched[key] = f.fetched[key] + 1
+	f.lock.Unlock()
+
+	refer, present := f.refers[key]
+	if !present {
+		return nil, nil, errors.New("message not found")
+	}
+
+	messageKey := openapi.MessageKey(key)
+	text := "text of " + key
+	message := &openapi.Message{Key: &messageKey, Text: &text}
+	if refer != "" {
+		message.ReferKey = &refer
+	}
+	return message, nil, nil
+}
+
+func testThreadReply(key, referKey string) RTMMessage {
+	return RTMMessage{
+		"type":        RTMMessageTypeChannelMessage,
+		"key":         key,
+		"uid":         "=bw52P",
+		"vchannel_id": "=bw52O",
+		"refer_key":   referKey,
+		"text":        "@<==bot=> translate this",
+	}
+}
+
+func TestThreadResolver_Thread(t *testing.T) {
+	fetcher := newTestThreadFetcher(map[string]string{
+		"1": "",
+		"2": "1",
+		"3": "2",
+		"4": "3",
+	})
+
+	resolver, err := NewThreadResolver(fetcher, WithThreadResolverDepth(3))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	thread, err := resolver.Thread(context.Background(), testThreadReply("5", "4"))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(thread) != 3 || *thread[0].Text != "text of 4" || *thread[2].Text != "text of 2" {
+		t.Errorf("unexpected thread: %+v", thread)
+	}
+
+	referred, err := resolver.Referred(context.Background(), testThreadReply("6", "3"))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if *referred.Text != "text of 3" {
+		t.Errorf("unexpected referred: %+v", referred)
+	}
+
+	thread, err = resolver.Thread(context.Background(), testThreadReply("7", "2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(thread) != 2 || *thread[1].Text != "text of 1" {
+		t.Errorf("unexpected thread: %+v", thread)
+	}
+
+	for key, count := range fetcher.fetched {
+		if count != 1 {
+			t.Errorf("message %s should be cached, fetched %d times", key, count)
+		}
+	}
+
+	resolver.Forget("=bw52O", "3")
+	resolver.Referred(context.Background(), testThreadReply("8", "3"))
+	if fetcher.fetched["3"] != 2 {
+		t.Errorf("forgotten message should be fetched again")
+	}
+}
+
+func TestThreadResolver_NotReply(t *testing.T) {
+	fetcher := newTestThreadFetcher(nil)
+
+	resolver, _ := NewThreadResolver(fetcher)
+	m := testThreadReply("1", "")
+	delete(m, "refer_key")
+
+	referred, err := resolver.Referred(context.Background(), m)
+	if referred != nil || err != nil {
+		t.Errorf("unexpected referred: %+v, %+v", referred, err)
+	}
+	thread, err := resolver.Thread(context.Background(), m)
+	if len(thread) != 0 || err != nil {
+		t.Errorf("unexpected thread: %+v, %+v", thread, err)
+	}
+	if len(fetcher.fetched) != 0 {
+		t.Errorf("unexpected fetches: %+v", fetcher.fetched)
+	}
+}
+
+func TestThreadResolver_Errors(t *testing.T) {
+	fetcher := newTestThreadFetcher(map[string]string{
+		"2": "1",
+		"3": "4",
+		"4": "3",
+	})
+
+	resolver, _ := NewThreadResolver(fetcher)
+
+	// referred message is deleted
+	thread, err := resolver.Thread(context.Background(), testThreadReply("3", "2"))
+	if err == nil || len(thread) != 1 || *thread[0].Text != "text of 2" {
+		t.Errorf("unexpected thread: %+v, %+v", thread, err)
+	}
+
+	// cycles are walked once
+	thread, err = resolver.Thread(context.Background(), testThreadReply("5", "4"))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(thread) != 2 {
+		t.Errorf("unexpected thread: %+v", thread)
+	}
+
+	if _, err := NewThreadResolver(nil); err == nil {
+		t.Errorf("fetcher should be required")
+	}
+	if _, err := NewThreadResolver(fetcher, WithThreadResolverDepth(0)); err == nil {
+		t.Errorf("depth should be positive")
+	}
+}
+
+func TestThreadResolver_Cache(t *testing.T) {
+	fetcher := newTestThreadFetcher(map[string]string{
+		"1": "",
+		"2": "",
+		"3": "",
+	})
+
+	resolver, _ := NewThreadResolver(fetcher, WithThreadResolverCacheSize(2))
+	for _, key := range []string{"1", "2", "3", "3", "2"} {
+		if _, err := resolver.Message(context.Background(), "=bw52O", openapi.MessageKey(key)); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+	}
+	if fetcher.fetched["1"] != 1 || fetcher.fetched["2"] != 1 || fetcher.fetched["3"] != 1 || len(resolver.messages) != 2 {
+		t.Errorf("unexpected fetches: %+v", fetcher.fetched)
+	}
+	if _, cached := resolver.messages["=bw52O/1"]; cached {
+		t.Errorf("message expiring soonest should be evicted")
+	}
+
+	uncached, _ := NewThreadResolver(fetcher, WithThreadResolverCacheTTL(0))
+	uncached.Message(context.Background(), "=bw52O", "1")
+	if fetcher.fetched["1"] != 2 || len(uncached.messages) != 0 {
+		t.Errorf("message should not be cached")
+	}
+}
+
+func TestThreadResolver_Copies(t *testing.T) {
+	fetcher := newTestThreadFetcher(map[string]string{"1": ""})
+	resolver, _ := NewThreadResolver(fetcher)
+
+	message, err := resolver.Message(context.Background(), "=bw52O", "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	*message.Text = "changed"
+
+	cached, err := resolver.Message(context.Background(), "=bw52O", "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if *cached.Text != "text of 1" {
+		t.Errorf("cached message should not be changed: %s", *cached.Text)
+	}
+	*cached.Text = "changed"
+
+	if cached, _ := resolver.Message(context.Background(), "=bw52O", "1"); *cached.Text != "text of 1" {
+		t.Errorf("cached message should not be changed: %s", *cached.Text)
+	}
+	if fetcher.fetched["1"] != 1 {
+		t.Errorf("message should be cached")
+	}
+}
+
+func TestBotRequest_Referred(t *testing.T) {
+	fetcher := newTestThreadFetcher(map[string]string{
+		"1": "",
+	})
+
+	resolver, _ := NewThreadResolver(fetcher)
+	bot, loop := newTestBot(t, WithBotThreadResolver(resolver))
+	err := bot.Command(BotCommand{
+		Name: "translate",
+		Handler: func(ctx context.Context, req *BotRequest) error {
+			referred, err := req.Referred(ctx)
+			if err != nil {
+				return err
+			}
+			if referred == nil {
+				return req.Reply("reply to a message to translate it")
+			}
+			return req.Reply("translating: " + *referred.Text)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	cancel, _ := runTestBot(t, bot)
+	defer cancel()
+
+	loop.rtmC <- testThreadReply("2", "1")
+	waitTestRTMLoopSent(t, loop, 1)
+	loop.rtmC <- testBotChannelMessage("3", "=bw52P", "@<==bot=> translate")
+	waitTestRTMLoopSent(t, loop, 2)
+
+	loop.lock.Lock()
+	defer loop.lock.Unlock()
+	if loop.sent[0].Text() != "translating: text of 1" || loop.sent[0]["refer_key"] != "2" {
+		t.Errorf("unexpected reply: %+v", loop.sent[0])
+	}
+	if loop.sent[1].Text() != "reply to a message to translate it" {
+		t.Errorf("unexpected reply: %+v", loop.sent[1])
+	}
+}